@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+
+	"slrz.net/runtopo/topology"
+)
+
+// DiffMain implements the diff command. It prints the differences between two
+// topology files and, like diff(1), exits with status 1 if there are any.
+func diffMain(args []string) {
+	if len(args) != 2 {
+		log.Fatalf("usage: runtopo [options…] diff old.dot new.dot")
+	}
+
+	var ts [2]*topology.T
+	for i, file := range args {
+		t, err := topology.ParseFile(file, topologyOptions(file)...)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ts[i] = t
+	}
+
+	d := topology.Diff(ts[0], ts[1])
+	w := bufio.NewWriter(os.Stdout)
+	for _, dev := range d.RemovedDevices {
+		fmt.Fprintf(w, "- device %s\n", dev.Name)
+	}
+	for _, dev := range d.AddedDevices {
+		fmt.Fprintf(w, "+ device %s\n", dev.Name)
+	}
+	for _, c := range d.ChangedDevices {
+		fmt.Fprintf(w, "~ device %s\n", c.Name)
+		writeAttrChanges(w, c.Attrs)
+	}
+	for _, l := range d.RemovedLinks {
+		fmt.Fprintf(w, "- link %s\n", l.String())
+	}
+	for _, l := range d.AddedLinks {
+		fmt.Fprintf(w, "+ link %s\n", l.String())
+	}
+	for _, c := range d.ChangedLinks {
+		fmt.Fprintf(w, "~ link %s\n", c.Link.String())
+		writeAttrChanges(w, c.Attrs)
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatal(err)
+	}
+	if !d.Empty() {
+		os.Exit(1)
+	}
+}
+
+func writeAttrChanges(w *bufio.Writer, cs []topology.AttrChange) {
+	for _, c := range cs {
+		switch {
+		case c.Added:
+			fmt.Fprintf(w, "\t+ %s=%q\n", c.Key, c.New)
+		case c.Removed:
+			fmt.Fprintf(w, "\t- %s=%q\n", c.Key, c.Old)
+		default:
+			fmt.Fprintf(w, "\t~ %s: %q → %q\n", c.Key, c.Old, c.New)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"slrz.net/runtopo/topology"
+)
+
+// DumpMain implements the dump command, writing the effective topology
+// (including the automatic management network and resolved defaults) in DOT
+// format to standard output.
+func dumpMain(args []string) {
+	if len(args) != 1 {
+		log.Fatalf("usage: runtopo [options…] dump topology.dot")
+	}
+
+	topo, err := topology.ParseFile(args[0], topologyOptions(args[0])...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	p, err := topo.MarshalDOT()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := os.Stdout.Write(p); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"slrz.net/runtopo/generator"
+)
+
+// GenMain implements the gen command, writing a generated topology in DOT
+// format to standard output.
+func genMain(args []string) {
+	if len(args) == 0 || args[0] != "clos" {
+		log.Fatalf("usage: runtopo gen clos [options…]")
+	}
+
+	var c generator.Clos
+	fs := flag.NewFlagSet("gen clos", flag.ExitOnError)
+	fs.IntVar(&c.SuperSpines, "superspines", 0, "number of superspines")
+	fs.IntVar(&c.Spines, "spines", 2, "number of spines")
+	fs.IntVar(&c.Leaves, "leaves", 4, "number of leaves")
+	fs.IntVar(&c.HostsPerLeaf, "hosts-per-leaf", 1,
+		"number of hosts attached to each leaf")
+	fs.BoolVar(&c.OOB, "oob", false,
+		"add oob-mgmt-server for use with -automgmt")
+	fs.StringVar(&c.MgmtPrefix, "mgmtprefix", "",
+		"oob-mgmt-server address and management `prefix` (implies -oob)")
+	fs.Parse(args[1:])
+	if c.MgmtPrefix != "" {
+		c.OOB = true
+	}
+
+	topo, err := c.Topology()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := os.Stdout.Write(topo.DOT()); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,115 @@
+// Package generator produces topologies for common network designs.
+package generator
+
+import (
+	"fmt"
+
+	"slrz.net/runtopo/topology"
+)
+
+// Clos describes a folded Clos (leaf-spine) fabric. Every leaf connects to
+// every spine and, if there are any, every spine connects to every
+// superspine. Hosts are attached to a single leaf each.
+//
+// Ports are numbered consistently: on leaves, swp1 through swpN connect to
+// the N spines, followed by the host-facing ports. Spines use swp1 through
+// swpM for the M leaves, followed by their superspine uplinks. Superspines
+// connect to spine i using swp(i+1). Hosts use eth1 for their uplink, leaving
+// eth0 to the management network.
+type Clos struct {
+	SuperSpines  int
+	Spines       int
+	Leaves       int
+	HostsPerLeaf int
+
+	// If OOB is set, an oob-mgmt-server device is added. Its mgmt_ip
+	// attribute is set to MgmtPrefix (or 192.168.200.254/24, if empty),
+	// determining the address range used by the automatic management
+	// network (see topology.WithAutoMgmtNetwork).
+	OOB        bool
+	MgmtPrefix string
+
+	// Attrs holds additional node attributes per device function, for
+	// example to select a specific OS image for all leaves.
+	Attrs map[topology.DeviceFunction]map[string]string
+}
+
+// Builder returns a topology.Builder populated with the devices and links
+// making up the fabric described by c.
+func (c *Clos) Builder() (*topology.Builder, error) {
+	switch {
+	case c.Spines < 1:
+		return nil, fmt.Errorf("clos: need at least one spine, got %d", c.Spines)
+	case c.Leaves < 1:
+		return nil, fmt.Errorf("clos: need at least one leaf, got %d", c.Leaves)
+	case c.SuperSpines < 0 || c.HostsPerLeaf < 0:
+		return nil, fmt.Errorf("clos: negative device count")
+	}
+
+	b := topology.NewBuilder()
+	if c.OOB {
+		prefix := c.MgmtPrefix
+		if prefix == "" {
+			prefix = "192.168.200.254/24"
+		}
+		b.AddDevice("oob-mgmt-server", c.attrs(topology.OOBServer,
+			"mgmt_ip", prefix))
+	}
+	for i := 0; i < c.SuperSpines; i++ {
+		b.AddDevice(name("superspine", i), c.attrs(topology.SuperSpine))
+	}
+	for i := 0; i < c.Spines; i++ {
+		spine := name("spine", i)
+		b.AddDevice(spine, c.attrs(topology.Spine))
+		for j := 0; j < c.SuperSpines; j++ {
+			b.AddLink(spine, swp(c.Leaves+j),
+				name("superspine", j), swp(i), nil)
+		}
+	}
+	for i := 0; i < c.Leaves; i++ {
+		leaf := name("leaf", i)
+		b.AddDevice(leaf, c.attrs(topology.Leaf))
+		for j := 0; j < c.Spines; j++ {
+			b.AddLink(leaf, swp(j), name("spine", j), swp(i), nil)
+		}
+		for j := 0; j < c.HostsPerLeaf; j++ {
+			host := name("host", i*c.HostsPerLeaf+j)
+			b.AddDevice(host, c.attrs(topology.Host))
+			b.AddLink(leaf, swp(c.Spines+j), host, "eth1", nil)
+		}
+	}
+
+	return b, nil
+}
+
+// Topology returns the fabric described by c as a topology.T, processed with
+// the provided options.
+func (c *Clos) Topology(opts ...topology.Option) (*topology.T, error) {
+	b, err := c.Builder()
+	if err != nil {
+		return nil, err
+	}
+	return b.Build(opts...)
+}
+
+// Attrs returns the node attributes for a device with function f. The
+// variadic kv holds additional key/value pairs.
+func (c *Clos) attrs(f topology.DeviceFunction, kv ...string) map[string]string {
+	m := map[string]string{"function": f.String()}
+	for k, v := range c.Attrs[f] {
+		m[k] = v
+	}
+	for i := 0; i+1 < len(kv); i += 2 {
+		m[kv[i]] = kv[i+1]
+	}
+	return m
+}
+
+func name(prefix string, i int) string {
+	return fmt.Sprintf("%s%d", prefix, i)
+}
+
+// Swp returns the name of the switch port with zero-based index i.
+func swp(i int) string {
+	return fmt.Sprintf("swp%d", i+1)
+}
@@ -0,0 +1,75 @@
+package generator
+
+import (
+	"testing"
+
+	"slrz.net/runtopo/topology"
+)
+
+func TestClos(t *testing.T) {
+	c := &Clos{
+		SuperSpines:  2,
+		Spines:       2,
+		Leaves:       4,
+		HostsPerLeaf: 2,
+		OOB:          true,
+	}
+	topo, err := c.Topology(topology.WithAutoMgmtNetwork)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := make(map[topology.DeviceFunction]int)
+	for _, d := range topo.Devices() {
+		count[d.Function()]++
+	}
+	for f, want := range map[topology.DeviceFunction]int{
+		topology.OOBServer:  1,
+		topology.OOBSwitch:  1,
+		topology.SuperSpine: 2,
+		topology.Spine:      2,
+		topology.Leaf:       4,
+		topology.Host:       8,
+	} {
+		if got := count[f]; got != want {
+			t.Errorf("got %d devices with function %s, want %d",
+				got, f, want)
+		}
+	}
+
+	want := map[string]bool{
+		"leaf0:swp1 -- spine0:swp1":       true,
+		"leaf3:swp2 -- spine1:swp4":       true,
+		"leaf1:swp3 -- host2:eth1":        true,
+		"leaf1:swp4 -- host3:eth1":        true,
+		"spine1:swp5 -- superspine0:swp2": true,
+		"spine0:swp6 -- superspine1:swp1": true,
+	}
+	nfabric := 0
+	for _, l := range topo.Links() {
+		if l.From == "oob-mgmt-switch" || l.From == "oob-mgmt-server" {
+			continue
+		}
+		nfabric++
+		delete(want, l.String())
+	}
+	for l := range want {
+		t.Errorf("missing link %s", l)
+	}
+	// 4 superspine uplinks, 8 spine-leaf links, 8 host links
+	if nfabric != 20 {
+		t.Errorf("got %d fabric links, want 20", nfabric)
+	}
+}
+
+func TestClosInvalid(t *testing.T) {
+	for _, c := range []*Clos{
+		{Spines: 0, Leaves: 2},
+		{Spines: 2, Leaves: 0},
+		{Spines: 2, Leaves: 2, HostsPerLeaf: -1},
+	} {
+		if _, err := c.Topology(); err == nil {
+			t.Errorf("%+v: got nil error", c)
+		}
+	}
+}
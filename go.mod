@@ -7,6 +7,7 @@ require (
 	go4.org v0.0.0-20201209231011-d4a079459e60
 	golang.org/x/crypto v0.0.0-20210220033148-5ea612d1eb83
 	gonum.org/v1/gonum v0.8.2
+	gopkg.in/yaml.v2 v2.4.0
 	inet.af/netaddr v0.0.0-20210311133851-b21affee3d06
 	libvirt.org/libvirt-go v7.0.0+incompatible
 	libvirt.org/libvirt-go-xml v7.0.0+incompatible
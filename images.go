@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"slrz.net/runtopo/runner/libvirt"
+	"slrz.net/runtopo/topology"
+)
+
+const imagesUsage = "usage: runtopo [options…] images pull topology.dot | list [-json] | prune [-n]"
+
+// ImagesMain implements the images command, managing the base images in the
+// storage pools. Its subcommands are pull, fetching the base images of a
+// topology without starting it, list, printing the base images along with the
+// running topologies using them, and prune, deleting the unused ones.
+func imagesMain(args []string) {
+	if len(args) == 0 {
+		log.Fatal(imagesUsage)
+	}
+	runnerOpts := []libvirt.RunnerOption{
+		libvirt.WithNamePrefix(*namePrefix),
+		libvirt.WithStoragePool(*storagePool),
+	}
+	if s := *libvirtURI; s != "" {
+		runnerOpts = append(runnerOpts, libvirt.WithConnectionURI(s))
+	}
+	if s := *stateDir; s != "" {
+		runnerOpts = append(runnerOpts, libvirt.WithStateDir(s))
+	}
+	runnerOpts = append(runnerOpts, hostsOptions()...)
+	if s := *imageCache; s != "" {
+		runnerOpts = append(runnerOpts, libvirt.WithImageCache(s))
+	}
+	if s := *imageDir; s != "" {
+		runnerOpts = append(runnerOpts, libvirt.WithImageDir(s))
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(),
+		os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	switch cmd, args := args[0], args[1:]; cmd {
+	case "pull":
+		if len(args) != 1 {
+			log.Fatal(imagesUsage)
+		}
+		topo, err := topology.ParseFile(args[0], topologyOptions(args[0])...)
+		if err != nil {
+			log.Fatal(err)
+		}
+		runnerOpts = append(runnerOpts,
+			libvirt.WithConfigFS(os.DirFS(filepath.Dir(args[0]))))
+		r := libvirt.NewRunner(runnerOpts...)
+		if err := r.PullImages(ctx, topo); err != nil {
+			log.Fatal(err)
+		}
+	case "list":
+		fs := flag.NewFlagSet("images list", flag.ExitOnError)
+		asJSON := fs.Bool("json", false, "write JSON instead of a table")
+		fs.Parse(args)
+		if fs.NArg() != 0 {
+			log.Fatal(imagesUsage)
+		}
+		images, err := libvirt.NewRunner(runnerOpts...).Images(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *asJSON {
+			p, err := json.MarshalIndent(images, "", "\t")
+			if err != nil {
+				log.Fatal(err)
+			}
+			os.Stdout.Write(append(p, '\n'))
+			return
+		}
+		printImages(images)
+	case "prune":
+		fs := flag.NewFlagSet("images prune", flag.ExitOnError)
+		dryRun := fs.Bool("n", false, "only print what would be deleted")
+		fs.Parse(args)
+		if fs.NArg() != 0 {
+			log.Fatal(imagesUsage)
+		}
+		pruned, err := libvirt.NewRunner(runnerOpts...).PruneImages(ctx, *dryRun)
+		for _, img := range pruned {
+			fmt.Printf("%s\t%s\n", img.Volume, orDash(img.Source))
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatal(imagesUsage)
+	}
+}
+
+// PrintImages writes images as a table to stdout.
+func printImages(images []libvirt.Image) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tVOLUME\tSIZE\tFETCHED\tSOURCE\tUSED BY")
+	for _, img := range images {
+		fetched := "-"
+		if img.Fetched != nil {
+			fetched = img.Fetched.Format("2006-01-02")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", orDash(img.Host),
+			img.Volume, formatSize(img.Size), fetched,
+			orDash(img.Source), orDash(strings.Join(img.UsedBy, ",")))
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// FormatSize formats n bytes using binary prefixes.
+func formatSize(n uint64) string {
+	const unit = 1 << 10
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"slrz.net/runtopo/topology"
+)
+
+// LintMain implements the lint command. It reports all problems found in the
+// provided topology files and exits non-zero if there were any.
+func lintMain(args []string) {
+	if len(args) == 0 {
+		log.Fatalf("usage: runtopo [options…] lint topology.dot…")
+	}
+
+	failed := false
+	for _, file := range args {
+		_, err := topology.ParseFile(file, topologyOptions(file)...)
+		if err == nil {
+			continue
+		}
+		failed = true
+		var errs topology.ValidationErrors
+		if !errors.As(err, &errs) {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+			continue
+		}
+		for _, e := range errs {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", file, e)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
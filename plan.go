@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+
+	"gopkg.in/yaml.v2"
+	"slrz.net/runtopo/topology"
+)
+
+// PlanMain implements the plan command, writing the addresses allocated for
+// loopbacks and fabric links (see -linkpool and -loopbackpool) to standard
+// output in JSON or YAML format.
+func planMain(args []string) {
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	asYAML := fs.Bool("yaml", false, "write YAML instead of JSON")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		log.Fatalf("usage: runtopo [options…] plan [-yaml] topology.dot")
+	}
+
+	file := fs.Arg(0)
+	topo, err := topology.ParseFile(file, topologyOptions(file)...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	plan := topo.AddressPlan()
+	if plan == nil {
+		log.Fatalf("no address pools configured (use -linkpool or -loopbackpool)")
+	}
+
+	var p []byte
+	if *asYAML {
+		p, err = yaml.Marshal(plan)
+	} else {
+		p, err = json.MarshalIndent(plan, "", "\t")
+		p = append(p, '\n')
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := os.Stdout.Write(p); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,445 @@
+package libvirt
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"reflect"
+	"sort"
+	"text/template"
+
+	"libvirt.org/libvirt-go"
+	"slrz.net/runtopo/topology"
+)
+
+// A ChangeAction describes what Apply does to a device.
+type ChangeAction int
+
+// Possible ChangeAction values.
+const (
+	ChangeAdd ChangeAction = iota
+	ChangeRemove
+	ChangeRedefine
+	ChangeUpdate   // changed in place, see Apply
+	ChangeRecreate // recreated from the base image
+)
+
+func (a ChangeAction) String() string {
+	switch a {
+	case ChangeAdd:
+		return "add"
+	case ChangeRemove:
+		return "remove"
+	case ChangeRedefine:
+		return "redefine"
+	case ChangeUpdate:
+		return "update"
+	case ChangeRecreate:
+		return "recreate"
+	}
+	return fmt.Sprintf("ChangeAction(%d)", int(a))
+}
+
+// A DeviceChange describes a device created, destroyed or updated by Apply.
+type DeviceChange struct {
+	Device string
+	Action ChangeAction
+}
+
+func (c DeviceChange) String() string {
+	return c.Action.String() + " " + c.Device
+}
+
+// Apply reconciles the running topology with t, which is usually an edited
+// version of the one passed to Run. Apply requires the state file written by
+// Run (see WithStateDir) and falls back to Run if there is none.
+//
+// Devices missing from t are destroyed and devices new in t are created and
+// started. Devices whose disk customization changed (e.g. their image or
+// config) or that are placed on another host (see WithHosts) are destroyed
+// and recreated from their base image, losing the contents of their disk.
+// Devices whose domain definition changed otherwise (e.g. their memory or
+// virtual BMC) are redefined and restarted, keeping their disk. All other
+// devices keep running. Links between unchanged devices keep their MAC
+// addresses and UDP tunnel ports, so the recreated devices can rejoin their
+// peers.
+//
+// Links added to or removed from running devices are hot-plugged, after
+// rewriting the udev rules naming the ports over SSH. Adding or removing
+// devices also changes the DHCP reservations of the management server and
+// the ports of the management switches, which are updated on the running
+// devices as well: the server's dnsmasq hostsfile is rewritten and the switch
+// ports are added to the bridge. This requires the SSH credentials given
+// using WithSSHAuth and, for devices other than the management server and
+// switch, a management address. Devices lacking either are recreated
+// instead, as are devices with both link and domain definition changes. With
+// a generated fabric configuration (see WithFabric), link changes usually
+// alter the disk customization, recreating the devices.
+//
+// For the automatic management network to keep assigning the same addresses,
+// t should be parsed using topology.WithPreferredMgmtIPs with the addresses
+// recorded in the state file (see LoadState).
+//
+// The returned changes are sorted by device name. On error, the state file
+// still describes the devices present, allowing for another attempt.
+func (r *Runner) Apply(ctx context.Context, t *topology.T) (changes []DeviceChange, err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("libvirt.(*Runner).Apply: %w", err)
+		}
+	}()
+
+	if r.stateDir == "" {
+		return nil, errors.New("no state directory")
+	}
+	if n := len(r.macBase); n != 6 {
+		return nil, fmt.Errorf("got base MAC of len %d, want len 6", n)
+	}
+	prev, err := LoadState(r.stateDir, r.namePrefix)
+	if errors.Is(err, fs.ErrNotExist) {
+		// Nothing running yet.
+		if err := r.Run(ctx, t); err != nil {
+			return nil, err
+		}
+		return diffState(&State{}, r.state(t)), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if prev.URI != r.uri || prev.Pool != r.storagePool {
+		return nil, fmt.Errorf("running topology uses %s (pool %s), "+
+			"destroy it first", prev.URI, prev.Pool)
+	}
+
+	if err := r.buildInventoryFrom(t, prev); err != nil {
+		return nil, err
+	}
+	if err := r.checkGroups(t); err != nil {
+		return nil, err
+	}
+	next := r.state(t)
+	next.Created = prev.Created
+	if err := r.setDigests(ctx, t, next); err != nil {
+		return nil, err
+	}
+	changes = diffState(prev, next)
+	var rest, updates []DeviceChange
+	for i, c := range changes {
+		if c.Action == ChangeUpdate && !r.canUpdate(r.devices[c.Device]) {
+			changes[i].Action = ChangeRecreate
+		}
+		if changes[i].Action == ChangeUpdate {
+			updates = append(updates, changes[i])
+		} else {
+			rest = append(rest, changes[i])
+		}
+	}
+
+	if err := r.connect(); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			r.disconnect()
+		}
+	}()
+
+	// Until updated, the devices keep their previous live digest and
+	// interfaces in the state file, letting the next Apply retry.
+	staged := stagedState(prev, next, updates)
+	if len(rest) > 0 {
+		if err := r.applyChanges(ctx, t, prev, staged, rest); err != nil {
+			return nil, err
+		}
+	}
+
+	// Look up the untouched domains, writeSSHConfig needs the
+	// management server.
+	for _, d := range r.devices {
+		if r.domains[d.name] != nil {
+			continue
+		}
+		if dom, err := r.conn(d).LookupDomainByName(d.name); err == nil {
+			r.domains[d.name] = dom
+		}
+	}
+	if len(updates) > 0 {
+		if len(rest) == 0 {
+			if err := r.writeState(staged); err != nil {
+				return nil, err
+			}
+		}
+		if err := r.updateDevices(ctx, t, prev, next, updates); err != nil {
+			return nil, err
+		}
+		if err := r.writeState(next); err != nil {
+			return nil, err
+		}
+	}
+	if err := r.writeOutputs(ctx, t); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// StagedState returns a copy of next where the devices to be updated have
+// the live digest and interfaces recorded in prev.
+func stagedState(prev, next *State, updates []DeviceChange) *State {
+	prevDevs := make(map[string]StateDevice)
+	for _, d := range prev.Devices {
+		prevDevs[d.Name] = d
+	}
+	pending := make(map[string]bool)
+	for _, c := range updates {
+		pending[c.Device] = true
+	}
+	staged := *next
+	staged.Devices = nil
+	for _, d := range next.Devices {
+		if pending[d.Name] {
+			p := prevDevs[d.Name]
+			d.Live, d.Interfaces = p.Live, p.Interfaces
+		}
+		staged.Devices = append(staged.Devices, d)
+	}
+	return &staged
+}
+
+// ApplyChanges destroys the removed, recreated and redefined devices of prev
+// and creates the added, recreated and redefined ones of next. Redefined
+// devices keep their volume.
+func (r *Runner) applyChanges(ctx context.Context, t *topology.T, prev, next *State, changes []DeviceChange) (err error) {
+	prevDevs := make(map[string]StateDevice)
+	for _, d := range prev.Devices {
+		prevDevs[d.Name] = d
+	}
+	var stale, redefined []StateDevice
+	r.targets = make(map[string]bool)
+	r.keepDisks = make(map[string]bool)
+	defer func() {
+		r.targets, r.keepDisks = nil, nil
+	}()
+	for _, c := range changes {
+		switch c.Action {
+		case ChangeRemove, ChangeRecreate:
+			stale = append(stale, prevDevs[c.Device])
+		case ChangeRedefine:
+			redefined = append(redefined, prevDevs[c.Device])
+			r.keepDisks[c.Device] = true
+		}
+		if c.Action != ChangeRemove {
+			r.targets[c.Device] = true
+		}
+	}
+
+	if err := r.downloadBaseImages(ctx, t); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			for _, v := range r.baseImages {
+				v.Free()
+			}
+			r.baseImages = nil
+		}
+	}()
+	if err := destroyDevices(ctx, prev, stale, true); err != nil {
+		return err
+	}
+	if err := destroyDevices(ctx, prev, redefined, false); err != nil {
+		return err
+	}
+
+	// Record the new inventory before creating anything. Without
+	// digests, the targets are redefined or recreated by the next Apply
+	// if we fail.
+	pending := *next
+	pending.Devices = nil
+	for _, d := range next.Devices {
+		if r.targets[d.Name] {
+			d.Digest, d.BMC = "", nil
+			if !r.keepDisks[d.Name] {
+				d.Disk = ""
+			}
+		}
+		pending.Devices = append(pending.Devices, d)
+	}
+	if err := r.writeState(&pending); err != nil {
+		return err
+	}
+
+	if err := r.createVolumes(ctx, t); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			r.deleteVolumes(ctx, t)
+		}
+	}()
+	if err := r.defineDomains(ctx, t); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			r.undefineDomains(ctx, t)
+			for _, d := range r.domains {
+				d.Free()
+			}
+			r.domains = make(map[string]*libvirt.Domain)
+		}
+	}()
+	if err := r.customizeDomains(ctx, t); err != nil {
+		return err
+	}
+	if err := r.startDomains(ctx, t); err != nil {
+		return err
+	}
+
+	return r.writeState(next)
+}
+
+// DiffState returns the changes turning the devices in prev into those in
+// next, sorted by device name. Devices are recreated if their host or disk
+// digest differ and redefined if their digest or virtual BMC do. They are
+// updated if only their interfaces or live digest differ. Devices needing
+// both a new definition and an update are recreated, as the guest's udev
+// rules wouldn't match the new interfaces.
+func diffState(prev, next *State) []DeviceChange {
+	prevDevs := make(map[string]StateDevice)
+	for _, d := range prev.Devices {
+		prevDevs[d.Name] = d
+	}
+	var changes []DeviceChange
+	for _, d := range next.Devices {
+		p, ok := prevDevs[d.Name]
+		delete(prevDevs, d.Name)
+		switch {
+		case !ok:
+			changes = append(changes, DeviceChange{d.Name, ChangeAdd})
+		case p.Disk == "" || p.Disk != d.Disk,
+			!sameLocation(prev, &p, next, &d):
+			changes = append(changes, DeviceChange{d.Name, ChangeRecreate})
+		case p.Digest == "" || p.Digest != d.Digest,
+			!reflect.DeepEqual(p.BMC, d.BMC):
+			action := ChangeRedefine
+			if p.Live != d.Live || !sameInterfaces(p.Interfaces, d.Interfaces) {
+				action = ChangeRecreate
+			}
+			changes = append(changes, DeviceChange{d.Name, action})
+		case p.Live != d.Live,
+			!sameInterfaces(p.Interfaces, d.Interfaces):
+			changes = append(changes, DeviceChange{d.Name, ChangeUpdate})
+		}
+	}
+	for name := range prevDevs {
+		changes = append(changes, DeviceChange{name, ChangeRemove})
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Device < changes[j].Device
+	})
+	return changes
+}
+
+// SameLocation reports whether x in xs and y in ys are placed on the same
+// host and storage pool.
+func sameLocation(xs *State, x *StateDevice, ys *State, y *StateDevice) bool {
+	xURI, xPool := xs.location(x)
+	yURI, yPool := ys.location(y)
+	return x.Host == y.Host && xURI == yURI && xPool == yPool
+}
+
+// SameInterfaces reports whether xs and ys describe the same virtual NICs.
+// The remote ports are disregarded, they only matter for the other end.
+func sameInterfaces(xs, ys []StateInterface) bool {
+	if len(xs) != len(ys) {
+		return false
+	}
+	for i := range xs {
+		x, y := xs[i], ys[i]
+		x.Peer, y.Peer = "", ""
+		if x != y {
+			return false
+		}
+	}
+	return true
+}
+
+// SetDigests records in s a digest of everything going into the domain
+// definition and one of the disk customization of each device. The topology
+// written to /etc/ptm.d on Cumulus devices is left out on purpose, it changes
+// with every edit to the topology. So are the network interfaces, which are
+// compared separately (see diffState), and the dnsmasq hostsfile of the
+// management server, which goes into the live digest instead (see
+// liveDigest).
+func (r *Runner) setDigests(ctx context.Context, t *topology.T, s *State) (err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("setDigests: %w", err)
+		}
+	}()
+	tmpl, err := template.New("").
+		Funcs(templateFuncs).
+		Parse(domainTemplateText)
+	if err != nil {
+		return err
+	}
+	fabric, err := fabricConfig(t, r.fabricMode)
+	if err != nil {
+		return err
+	}
+	for i := range s.Devices {
+		sd := &s.Devices[i]
+		d := r.devices[sd.Name]
+		h := sha256.New()
+		args := d.templateArgs()
+		args.Interfaces = nil
+		if err := tmpl.Execute(h, args); err != nil {
+			return fmt.Errorf("domain %s: %w", d.name, err)
+		}
+		disk := sha256.New()
+		fmt.Fprintf(disk, "%s\x00%s\x00%d\x00%q\x00%q\x00",
+			d.Function(), d.OSImage(), d.DiskSize(), sd.MgmtIPs,
+			r.authorizedKeys)
+		disk.Write(d.config)
+		for _, f := range fabric[d.Name] {
+			fmt.Fprintf(disk, "\x00%s\x00", f.path)
+			disk.Write(f.content)
+		}
+		if d.Function() == topology.OOBServer {
+			fmt.Fprintf(disk, "\x00%s\x00%s\x00", d.Attr("mgmt_ip"),
+				d.Attr("mgmt_ip6"))
+		}
+		if sd.Live, err = r.liveDigest(ctx, t, d); err != nil {
+			return err
+		}
+		sd.Digest = hex.EncodeToString(h.Sum(nil))
+		sd.Disk = hex.EncodeToString(disk.Sum(nil))
+	}
+	return nil
+}
+
+// LiveDigest returns a digest of what Apply updates on the running device d,
+// or the empty string if there's nothing. That's the DHCP reservations for
+// the management server and the ports of management switches.
+func (r *Runner) liveDigest(ctx context.Context, t *topology.T, d *device) (string, error) {
+	h := sha256.New()
+	switch d.Function() {
+	case topology.OOBServer:
+		h.Write(generateDnsmasqHostsFile(gatherHosts(ctx, r, t)))
+	case topology.OOBSwitch:
+		rules, err := renderUdevRules(d)
+		if err != nil {
+			return "", err
+		}
+		h.Write(rules)
+		for _, intf := range d.templateArgs().Interfaces {
+			fmt.Fprintf(h, "\x00%+v", intf)
+		}
+	default:
+		return "", nil
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,188 @@
+package libvirt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"libvirt.org/libvirt-go"
+)
+
+// Base image volumes are named baseVolumePrefix followed by 16 hex digits,
+// see baseVolumeName.
+const baseVolumePrefix = "runtopo-base-"
+
+// BaseVolumeName returns the name of the volume holding the base image
+// referred to by the os attribute value ref. If the os_sha256 attribute value
+// digestAttr is a digest, the name is derived from it and the same image
+// fetched from different mirrors is stored once. Otherwise, the name is
+// derived from ref. Either way, images of the same file name from different
+// sources don't end up sharing a volume.
+func baseVolumeName(ref, digestAttr string) string {
+	key := "source " + ref
+	if isSHA256(digestAttr) {
+		key = "sha256 " + strings.ToLower(digestAttr)
+	}
+	sum := sha256.Sum256([]byte(key))
+	return baseVolumePrefix + hex.EncodeToString(sum[:8])
+}
+
+// IsBaseVolume reports whether name was returned by baseVolumeName.
+func isBaseVolume(name string) bool {
+	s := strings.TrimPrefix(name, baseVolumePrefix)
+	if s == name || len(s) != 16 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// An imageMeta describes what a base image volume holds. Libvirt doesn't keep
+// custom elements in volume XML: there's no metadata element like for domains
+// and the XML of volumes in most pool types is regenerated from the files on
+// disk. So it's stored as JSON in a companion volume named like the base
+// volume with the suffix ".meta".
+type imageMeta struct {
+	Source  string    `json:"source"`  // os attribute value
+	Name    string    `json:"name"`    // file name, see imageName
+	Digest  string    `json:"sha256"`  // of the file as fetched
+	Fetched time.Time `json:"fetched"` // time the fetch completed
+}
+
+// WriteImageMeta stores m as metadata of the base volume name in pool,
+// replacing what was there before.
+func writeImageMeta(conn *libvirt.Connect, pool *libvirt.StoragePool, name string, m *imageMeta) (err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("writeImageMeta %s: %w", name, err)
+		}
+	}()
+	p, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	metaName := name + ".meta"
+	if v, err := pool.LookupStorageVolByName(metaName); err == nil {
+		err = v.Delete(0)
+		v.Free()
+		if err != nil {
+			return fmt.Errorf("vol-delete: %w", err)
+		}
+	}
+	xmlVol := newVolume(metaName, int64(len(p)))
+	xmlVol.Target.Format.Type = "raw"
+	xmlStr, err := xmlVol.Marshal()
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	vol, err := pool.StorageVolCreateXML(xmlStr, 0)
+	if err != nil {
+		return fmt.Errorf("vol-create: %w", err)
+	}
+	defer vol.Free()
+	if err := uploadVolume(conn, vol, bytes.NewReader(p), int64(len(p))); err != nil {
+		vol.Delete(0)
+		return err
+	}
+	return nil
+}
+
+// ReadImageMeta returns the metadata of the base volume name in pool.
+func readImageMeta(conn *libvirt.Connect, pool *libvirt.StoragePool, name string) (m *imageMeta, err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("readImageMeta %s: %w", name, err)
+		}
+	}()
+	vol, err := pool.LookupStorageVolByName(name + ".meta")
+	if err != nil {
+		return nil, err
+	}
+	defer vol.Free()
+	info, err := vol.GetInfo()
+	if err != nil {
+		return nil, fmt.Errorf("get-info: %w", err)
+	}
+	stream, err := conn.NewStream(0)
+	if err != nil {
+		return nil, fmt.Errorf("new-stream: %w", err)
+	}
+	defer stream.Free()
+	if err := vol.Download(stream, 0, info.Capacity, 0); err != nil {
+		stream.Abort()
+		return nil, fmt.Errorf("vol-download: %w", err)
+	}
+	p, err := io.ReadAll(io.LimitReader(&streamReader{stream: stream}, 1<<20))
+	if err != nil {
+		stream.Abort()
+		return nil, fmt.Errorf("download: %w", err)
+	}
+	if err := stream.Finish(); err != nil {
+		return nil, fmt.Errorf("stream-finish: %w", err)
+	}
+	m = new(imageMeta)
+	// Volumes may be rounded up to some allocation unit.
+	if err := json.Unmarshal(bytes.TrimRight(p, "\x00"), m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// A baseImage is a base image volume found in a storage pool.
+type baseImage struct {
+	Volume string     // volume name
+	Path   string     // volume path, as referred to by backing stores
+	Size   uint64     // allocation in bytes
+	Meta   *imageMeta // nil if the metadata is missing or unreadable
+}
+
+// ListBaseImages returns the base image volumes in pool along with what they
+// hold, ordered by volume name.
+func listBaseImages(conn *libvirt.Connect, pool *libvirt.StoragePool) (images []baseImage, err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("listBaseImages: %w", err)
+		}
+	}()
+	vols, err := pool.ListAllStorageVolumes(0)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, v := range vols {
+			v.Free()
+		}
+	}()
+	for _, v := range vols {
+		name, err := v.GetName()
+		if err != nil {
+			return nil, err
+		}
+		if !isBaseVolume(name) {
+			continue
+		}
+		path, err := v.GetPath()
+		if err != nil {
+			return nil, err
+		}
+		info, err := v.GetInfo()
+		if err != nil {
+			return nil, err
+		}
+		img := baseImage{Volume: name, Path: path, Size: info.Allocation}
+		if m, err := readImageMeta(conn, pool, name); err == nil {
+			img.Meta = m
+		}
+		images = append(images, img)
+	}
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].Volume < images[j].Volume
+	})
+	return images, nil
+}
@@ -8,6 +8,7 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"sort"
 	"strings"
 
 	"golang.org/x/crypto/bcrypt"
@@ -89,6 +90,11 @@ func commandsForFunction(d *device) []byte {
 		// hostnames for CL. Work around by directly writing to
 		// /etc/hostname.
 		fmt.Fprintf(&buf, "write /etc/hostname:%s\\\n\n", d.Name)
+		if hasIPv6Mgmt(d) {
+			// CL only configures DHCPv4 on eth0 out of the box.
+			buf.WriteString("write /etc/network/interfaces.d/eth0-inet6.intf:" +
+				"iface eth0 inet6 dhcp\\\n\n")
+		}
 		if d.Function() == topology.OOBSwitch {
 			writeExtraMgmtSwitchCommands(&buf, d)
 		}
@@ -122,6 +128,17 @@ func commandsForFunction(d *device) []byte {
 }
 
 func writeExtraMgmtSwitchCommands(w io.Writer, d *device) {
+	bridgeConf := mgmtSwitchBridgeConf(d)
+
+	// From virt-customize(1): […] arguments can be spread across multiple
+	// lines, by adding a "\" (continuation character) at the of a line […]
+	io.WriteString(w, "write /etc/network/interfaces.d/bridge.intf:"+
+		strings.Replace(bridgeConf, "\n", "\\\n", -1)+"\n")
+}
+
+// MgmtSwitchBridgeConf returns the ifupdown2 configuration bridging the
+// ports of the management switch d.
+func mgmtSwitchBridgeConf(d *device) string {
 	var bridgePorts []string
 	for _, intf := range d.interfaces {
 		if intf.name == "eth0" {
@@ -130,18 +147,29 @@ func writeExtraMgmtSwitchCommands(w io.Writer, d *device) {
 		}
 		bridgePorts = append(bridgePorts, intf.name)
 	}
-	bridgeConf := "auto bridge\niface bridge\n    bridge-ports " +
+	return "auto bridge\niface bridge\n    bridge-ports " +
 		strings.Join(bridgePorts, " ") + "\n"
+}
 
-	// From virt-customize(1): […] arguments can be spread across multiple
-	// lines, by adding a "\" (continuation character) at the of a line […]
-	io.WriteString(w, "write /etc/network/interfaces.d/bridge.intf:"+
-		strings.Replace(bridgeConf, "\n", "\\\n", -1)+"\n")
+// GenerateEtcHosts returns the /etc/hosts lines for hosts on the management
+// server. They end in hostsMarker, so they can be replaced later on.
+func generateEtcHosts(hosts []etherHost) []byte {
+	var buf bytes.Buffer
+	for _, h := range hosts {
+		for _, ip := range h.ips {
+			fmt.Fprintf(&buf, "%s %s%s\n", ip, h.name, hostsMarker)
+		}
+	}
+	return buf.Bytes()
 }
 
+// HostsMarker ends the /etc/hosts lines written by runtopo.
+const hostsMarker = " # runtopo"
+
 const (
+	// The inet family covers IPv4 as well as IPv6.
 	nftablesRuleset = `
-table ip nat {
+table inet nat {
 	chain postrouting {
 		type nat hook postrouting priority srcnat; policy accept;
 		masquerade
@@ -151,7 +179,6 @@ table ip nat {
 	dnsmasqConf = `
 strict-order
 interface=eth1
-dhcp-range=%s,static
 dhcp-no-override
 dhcp-authoritative
 dhcp-hostsfile=/etc/dnsmasq.hostsfile
@@ -162,31 +189,65 @@ TYPE=Ethernet
 DEVICE=eth1
 ONBOOT=yes
 BOOTPROTO=none
-IPADDR=%s
-PREFIX=%d
 `
 )
 
+// MgmtPrefixes returns the management network prefixes configured on the
+// oob-mgmt-server d. The first one is from the mgmt_ip attribute, an optional
+// second one from mgmt_ip6.
+func mgmtPrefixes(d *device) []netaddr.IPPrefix {
+	// We assume that the prefixes have already been validated.
+	ps := []netaddr.IPPrefix{netaddr.MustParseIPPrefix(d.Attr("mgmt_ip"))}
+	if s := d.Attr("mgmt_ip6"); s != "" {
+		ps = append(ps, netaddr.MustParseIPPrefix(s))
+	}
+	return ps
+}
+
+// HasIPv6Mgmt reports whether d was assigned an IPv6 management address.
+func hasIPv6Mgmt(d *device) bool {
+	for _, ip := range d.MgmtIPs() {
+		if ip.IP.To4() == nil {
+			return true
+		}
+	}
+	return false
+}
+
 func writeExtraMgmtServerCommands(w io.Writer, d *device) {
 	io.WriteString(w, "install nftables,dnsmasq\n")
-	// We assume that the prefix has already been validated.
-	p := netaddr.MustParseIPPrefix(d.Attr("mgmt_ip"))
+	ifcfg := ifcfgEth1
+	conf := dnsmasqConf
+	sysctl := "net.ipv4.ip_forward=1\n"
+	for _, p := range mgmtPrefixes(d) {
+		if p.IP.Is4() {
+			ifcfg += fmt.Sprintf("IPADDR=%s\nPREFIX=%d\n", p.IP, p.Bits)
+			conf += fmt.Sprintf("dhcp-range=%s,static\n", p.Masked().IP)
+			continue
+		}
+		// Stateful DHCPv6 for the static reservations, with router
+		// advertisements announcing the on-link prefix.
+		ifcfg += fmt.Sprintf("IPV6INIT=yes\nIPV6ADDR=%s\n", p)
+		conf += fmt.Sprintf("dhcp-range=%s,static,%d\nenable-ra\n",
+			p.Masked().IP, p.Bits)
+		// Forwarding disables accepting router advertisements,
+		// unless told otherwise. Keep them on the uplink.
+		sysctl += "net.ipv6.conf.all.forwarding=1\n" +
+			"net.ipv6.conf.eth0.accept_ra=2\n"
+	}
 	io.WriteString(w, "write /etc/sysconfig/network-scripts/ifcfg-eth0:"+
 		"TYPE=Ethernet\\\nDEVICE=eth0\\\nPEERDNS=yes\\\nBOOTPROTO=dhcp\\\nONBOOT=yes\n")
 	io.WriteString(w, "write /etc/sysconfig/network-scripts/ifcfg-eth1:"+
-		strings.Replace(
-			fmt.Sprintf(ifcfgEth1, p.IP, p.Bits),
-			"\n", "\\\n", -1,
-		)+"\n",
+		strings.Replace(ifcfg, "\n", "\\\n", -1)+"\n",
 	)
 	io.WriteString(w, "write /etc/sysconfig/nftables.conf:"+
 		strings.Replace(nftablesRuleset, "\n", "\\\n", -1)+"\n")
 
 	io.WriteString(w, "run-command systemctl enable nftables.service\n")
-	io.WriteString(w, "write /etc/sysctl.d/98-ipfwd.conf:net.ipv4.ip_forward=1\n")
+	io.WriteString(w, "write /etc/sysctl.d/98-ipfwd.conf:"+
+		strings.Replace(sysctl, "\n", "\\\n", -1)+"\n")
 	io.WriteString(w, "write /etc/dnsmasq.conf:"+
-		strings.Replace(fmt.Sprintf(dnsmasqConf, p.Masked().IP),
-			"\n", "\\\n", -1)+"\n")
+		strings.Replace(conf, "\n", "\\\n", -1)+"\n")
 	io.WriteString(w, "run-command systemctl disable systemd-resolved.service\n")
 	// Ensure /etc/resolv.conf is a regular file (and not a symlink to
 	// systemd-resolved's stub-resolv.conf). Dnsmasq reads its upstream
@@ -199,7 +260,7 @@ func writeExtraMgmtServerCommands(w io.Writer, d *device) {
 
 type etherHost struct {
 	name string
-	ip   *net.IPAddr
+	ips  []*net.IPAddr // IPv4 and/or IPv6
 	mac  net.HardwareAddr
 }
 
@@ -209,29 +270,46 @@ func gatherHosts(ctx context.Context, r *Runner, t *topology.T) []etherHost {
 		if name == "oob-mgmt-server" || name == "oob-mgmt-switch" {
 			continue
 		}
+		if len(d.interfaces) == 0 {
+			continue
+		}
 		eth0 := d.interfaces[0]
 		if eth0.name != "eth0" {
 			// most likely, device does not have a mgmt interface
 			continue
 		}
-		mgmtIP := d.MgmtIP()
-		if mgmtIP == nil {
+		mgmtIPs := d.MgmtIPs()
+		if len(mgmtIPs) == 0 {
 			continue
 		}
 		hosts = append(hosts, etherHost{
 			name: name,
-			ip:   mgmtIP,
+			ips:  mgmtIPs,
 			mac:  eth0.mac,
 		})
 	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].name < hosts[j].name
+	})
 
 	return hosts
 }
 
+// GenerateDnsmasqHostsFile returns a dhcp-hostsfile reserving the hosts'
+// addresses. IPv6 addresses are enclosed in brackets, as expected by dnsmasq
+// for DHCPv6 reservations.
 func generateDnsmasqHostsFile(hosts []etherHost) []byte {
 	var buf bytes.Buffer
 	for _, h := range hosts {
-		fmt.Fprintf(&buf, "%s,%s,%s\n", h.mac, h.ip, h.name)
+		fmt.Fprintf(&buf, "%s,", h.mac)
+		for _, ip := range h.ips {
+			if ip.IP.To4() == nil {
+				fmt.Fprintf(&buf, "[%s],", ip)
+			} else {
+				fmt.Fprintf(&buf, "%s,", ip)
+			}
+		}
+		fmt.Fprintf(&buf, "%s\n", h.name)
 	}
 	return buf.Bytes()
 }
@@ -0,0 +1,197 @@
+package libvirt
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"text/template"
+
+	libvirtxml "libvirt.org/libvirt-go-xml"
+	"slrz.net/runtopo/topology"
+)
+
+// DryRun renders the artifacts Run would create for t into dir instead of
+// creating them, without connecting to libvirt or fetching images. For each
+// device, a subdirectory holds its domain XML (domain.xml), volume XML
+// (volume.xml), udev rules naming its interfaces (70-persistent-net.rules)
+// and, if it has an OS image, the commands passed to virt-customize
+// (customize.txt) together with its config snippet (config). The volumes
+// reference their backing images by volume name, with the format derived from
+// the image's file name (see formatFromName) and left out if unknown. They
+// have a capacity of zero if the capacity is taken from the backing image.
+// The dnsmasq hostsfile of the management server, if any, and a table of the
+// assigned interface MAC addresses and UDP tunnel ports (allocations.txt) are
+// written to dir itself, as is a table of the hosts devices are placed on
+// (placement.txt) if WithHosts was given.
+func (r *Runner) DryRun(ctx context.Context, t *topology.T, dir string) (err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("libvirt.(*Runner).DryRun: %w", err)
+		}
+	}()
+
+	if n := len(r.macBase); n != 6 {
+		return fmt.Errorf("got base MAC of len %d, want len 6", n)
+	}
+	if err := r.buildInventory(t); err != nil {
+		return err
+	}
+	if err := r.checkGroups(t); err != nil {
+		return err
+	}
+	tmpl, err := template.New("").
+		Funcs(templateFuncs).
+		Parse(domainTemplateText)
+	if err != nil {
+		return err
+	}
+	ptmDOT, err := t.MarshalDOT()
+	if err != nil {
+		return err
+	}
+	fabric, err := fabricConfig(t, r.fabricMode)
+	if err != nil {
+		return err
+	}
+
+	digests, err := r.imageDigestAttrs()
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(r.devices))
+	for name := range r.devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		d := r.devices[name]
+		devDir := filepath.Join(dir, name)
+		if err := os.MkdirAll(devDir, 0o755); err != nil {
+			return err
+		}
+		write := func(file string, p []byte) error {
+			return os.WriteFile(filepath.Join(devDir, file), p, 0o644)
+		}
+
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, d.templateArgs()); err != nil {
+			return fmt.Errorf("domain %s: %w", d.name, err)
+		}
+		if err := write("domain.xml", buf.Bytes()); err != nil {
+			return err
+		}
+
+		vol, err := dryRunVolume(d, digests[d.OSImage()])
+		if err != nil {
+			return err
+		}
+		if err := write("volume.xml", append([]byte(vol), '\n')); err != nil {
+			return err
+		}
+
+		rules, err := renderUdevRules(d)
+		if err != nil {
+			return err
+		}
+		if err := write("70-persistent-net.rules", rules); err != nil {
+			return err
+		}
+
+		if d.OSImage() == "" {
+			continue
+		}
+		buf.Reset()
+		buf.Write(r.customizeCommands(ctx, t, d, ptmDOT, fabric))
+		if len(d.config) > 0 {
+			if err := write("config", d.config); err != nil {
+				return err
+			}
+			buf.WriteString("run config\n")
+		}
+		buf.Write(commandsForFunction(d))
+		if err := write("customize.txt", buf.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	if r.devices["oob-mgmt-server"] != nil {
+		dnsmasqHosts := generateDnsmasqHostsFile(gatherHosts(ctx, r, t))
+		err := os.WriteFile(filepath.Join(dir, "dnsmasq.hostsfile"),
+			dnsmasqHosts, 0o644)
+		if err != nil {
+			return err
+		}
+	}
+	st := r.state(t)
+	if len(r.hosts) > 0 {
+		err := os.WriteFile(filepath.Join(dir, "placement.txt"),
+			placementTable(st), 0o644)
+		if err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(filepath.Join(dir, "allocations.txt"),
+		allocationTable(st), 0o644)
+}
+
+// DryRunVolume returns the volume XML for d, referring to its backing image by
+// volume name and, if its file name tells, format. The os_sha256 attribute
+// value digestAttr goes into the name, see baseVolumeName.
+func dryRunVolume(d *device, digestAttr string) (string, error) {
+	vol := newVolume(d.name, d.DiskSize())
+	if osImage := d.OSImage(); osImage != "" {
+		vol.BackingStore = &libvirtxml.StorageVolumeBackingStore{
+			Path: baseVolumeName(osImage, digestAttr),
+		}
+		if format := formatFromName(imageName(osImage)); format != "" {
+			vol.BackingStore.Format = &libvirtxml.StorageVolumeTargetFormat{
+				Type: format,
+			}
+		}
+	}
+	return vol.Marshal()
+}
+
+// AllocationTable formats the interfaces recorded in s as a table listing
+// their MAC address and either the libvirt network or the peer and UDP
+// endpoints of their tunnel.
+func allocationTable(s *State) []byte {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "DEVICE\tPORT\tMAC\tPEER\tLOCAL PORT\tREMOTE")
+	for _, d := range s.Devices {
+		for _, intf := range d.Interfaces {
+			if intf.Network != "" {
+				fmt.Fprintf(w, "%s\t%s\t%s\tnetwork:%s\t-\t-\n",
+					d.Name, intf.Name, intf.MAC, intf.Network)
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\n",
+				d.Name, intf.Name, intf.MAC, intf.Peer, intf.LocalPort,
+				net.JoinHostPort(intf.RemoteTunnelIP,
+					strconv.FormatUint(uint64(intf.Port), 10)))
+		}
+	}
+	w.Flush()
+	return buf.Bytes()
+}
+
+// PlacementTable formats the hosts, connection URIs and storage pools of the
+// devices recorded in s as a table.
+func placementTable(s *State) []byte {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "DEVICE\tHOST\tURI\tPOOL")
+	for _, d := range s.Devices {
+		uri, pool := s.location(&d)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", d.Name, d.Host, uri, pool)
+	}
+	w.Flush()
+	return buf.Bytes()
+}
@@ -0,0 +1,331 @@
+package libvirt
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"slrz.net/runtopo/topology"
+)
+
+// A FabricMode selects the routing configuration generated for fabric
+// devices.
+type FabricMode int
+
+const (
+	// NoFabric leaves device configuration to the config node attribute.
+	NoFabric FabricMode = iota
+
+	// FabricUnnumbered peers fabric devices using BGP unnumbered (IPv6
+	// link-local addresses) on their fabric ports.
+	FabricUnnumbered
+
+	// FabricNumbered peers fabric devices using the point-to-point
+	// addresses from the topology's address plan.
+	FabricNumbered
+)
+
+// ParseFabricMode returns the FabricMode named by s, one of "none",
+// "unnumbered" or "numbered".
+func ParseFabricMode(s string) (FabricMode, error) {
+	switch s {
+	case "", "none":
+		return NoFabric, nil
+	case "unnumbered":
+		return FabricUnnumbered, nil
+	case "numbered":
+		return FabricNumbered, nil
+	}
+	return NoFabric, fmt.Errorf("unknown fabric mode %q", s)
+}
+
+// WithFabric makes the Runner generate an eBGP fabric configuration for
+// devices with a switch function (superspine, spine, leaf, tor and exit):
+// /etc/frr/frr.conf and ifupdown2 interface configuration. Hosts with
+// addresses in the topology's address plan get a matching systemd-networkd
+// configuration. The files are written when customizing the domains, so the
+// started topology routes without further provisioning.
+//
+// Unless set explicitly using the bgp_asn node attribute, ASNs are derived
+// from the device function: superspines share 65000, spines share 65100,
+// exits are numbered from 65201 and leaves (including tors) from 65301, in
+// order of their names. The router ID is taken from the device's IPv4
+// loopback address if available.
+func WithFabric(mode FabricMode) RunnerOption {
+	return func(r *Runner) {
+		r.fabricMode = mode
+	}
+}
+
+// A fabricFile is a configuration file generated for a device.
+type fabricFile struct {
+	path    string
+	content []byte
+}
+
+// ASN ranges assigned to fabric devices by function. Devices of functions
+// with a zero count share the base ASN.
+var fabricASNRanges = []struct {
+	function topology.DeviceFunction
+	base     int
+	count    int
+}{
+	{topology.SuperSpine, 65000, 0},
+	{topology.Spine, 65100, 0},
+	{topology.Exit, 65200, 99},
+	{topology.Leaf, 65300, 234},
+	{topology.TOR, 65300, 234},
+}
+
+func isFabricRouter(d *topology.Device) bool {
+	return topology.HasFunction(d,
+		topology.SuperSpine,
+		topology.Spine,
+		topology.Leaf,
+		topology.TOR,
+		topology.Exit,
+	)
+}
+
+func isMgmtDevice(d *topology.Device) bool {
+	return topology.HasFunction(d, topology.OOBServer, topology.OOBSwitch)
+}
+
+// FabricASNs assigns BGP AS numbers to the routers (given in sorted order).
+func fabricASNs(routers []*topology.Device) (map[string]int, error) {
+	asns := make(map[string]int)
+	next := make(map[int]int) // base → last assigned offset
+	for _, d := range routers {
+		if s := d.Attr("bgp_asn"); s != "" {
+			asn, err := strconv.Atoi(s)
+			if err != nil {
+				return nil, fmt.Errorf("device %s: bgp_asn: %w",
+					d.Name, err)
+			}
+			asns[d.Name] = asn
+			continue
+		}
+		for _, r := range fabricASNRanges {
+			if r.function != d.Function() {
+				continue
+			}
+			if r.count == 0 {
+				asns[d.Name] = r.base
+				break
+			}
+			next[r.base]++
+			if next[r.base] > r.count {
+				return nil, fmt.Errorf("device %s: out of ASNs "+
+					"for %s devices, set bgp_asn", d.Name,
+					d.Function())
+			}
+			asns[d.Name] = r.base + next[r.base]
+			break
+		}
+	}
+	return asns, nil
+}
+
+// FabricConfig generates the configuration files for the devices of t,
+// keyed by device name.
+func fabricConfig(t *topology.T, mode FabricMode) (map[string][]fabricFile, error) {
+	if mode == NoFabric {
+		return nil, nil
+	}
+	plan := t.AddressPlan()
+	if plan == nil {
+		if mode == FabricNumbered {
+			return nil, fmt.Errorf("numbered fabric requires an address plan")
+		}
+		plan = new(topology.AddressPlan)
+	}
+
+	devs := t.Devices()
+	sort.Slice(devs, func(i, j int) bool {
+		return devs[i].Name < devs[j].Name
+	})
+	byName := make(map[string]*topology.Device)
+	var routers []*topology.Device
+	for i := range devs {
+		d := &devs[i]
+		byName[d.Name] = d
+		if isFabricRouter(d) {
+			routers = append(routers, d)
+		}
+	}
+	asns, err := fabricASNs(routers)
+	if err != nil {
+		return nil, err
+	}
+
+	// Collect the ports of each device, noting the peer device.
+	type port struct {
+		name, peer, peerPort string
+	}
+	ports := make(map[string][]port)
+	for _, l := range t.Links() {
+		if l.To == "" || l.Attr("libvirt_type") == "network" {
+			continue
+		}
+		ports[l.From] = append(ports[l.From], port{l.FromPort, l.To, l.ToPort})
+		ports[l.To] = append(ports[l.To], port{l.ToPort, l.From, l.FromPort})
+	}
+	for _, ps := range ports {
+		sort.Slice(ps, func(i, j int) bool {
+			return natCompare(ps[i].name, ps[j].name) < 0
+		})
+	}
+
+	files := make(map[string][]fabricFile)
+	for i, d := range routers {
+		var frr, intf bytes.Buffer
+		routerID := fmt.Sprintf("10.255.%d.%d", (i+1)>>8, (i+1)&0xff)
+		lo := plan.Loopback(d.Name)
+		for _, a := range lo {
+			if !strings.Contains(a, ":") {
+				routerID = strings.TrimSuffix(a, "/32")
+				break
+			}
+		}
+		if len(lo) > 0 {
+			intf.WriteString("auto lo\niface lo inet loopback\n")
+			for _, a := range lo {
+				fmt.Fprintf(&intf, "    address %s\n", a)
+			}
+		}
+
+		var neighbors []string
+		for _, p := range ports[d.Name] {
+			peer := byName[p.peer]
+			if peer != nil && isMgmtDevice(peer) {
+				continue
+			}
+			addrs := plan.Interface(d.Name, p.name)
+			if peer == nil || !isFabricRouter(peer) {
+				// Host-facing port, addressed if the plan says so.
+				fmt.Fprintf(&intf, "\nauto %s\niface %s\n", p.name, p.name)
+				for _, a := range addrs {
+					fmt.Fprintf(&intf, "    address %s\n", a)
+				}
+				continue
+			}
+			fmt.Fprintf(&intf, "\nauto %s\niface %s\n", p.name, p.name)
+			if mode == FabricUnnumbered {
+				neighbors = append(neighbors, p.name+" interface")
+				continue
+			}
+			peerAddrs := plan.Interface(p.peer, p.peerPort)
+			if len(addrs) == 0 || len(peerAddrs) != len(addrs) {
+				return nil, fmt.Errorf("device %s: no address for port %s",
+					d.Name, p.name)
+			}
+			for j, a := range addrs {
+				fmt.Fprintf(&intf, "    address %s\n", a)
+				neighbors = append(neighbors,
+					peerAddrs[j][:strings.IndexByte(peerAddrs[j], '/')])
+			}
+		}
+
+		fmt.Fprintf(&frr, "frr defaults datacenter\nhostname %s\n"+
+			"log syslog informational\nservice integrated-vtysh-config\n!\n",
+			d.Name)
+		fmt.Fprintf(&frr, "router bgp %d\n", asns[d.Name])
+		fmt.Fprintf(&frr, " bgp router-id %s\n", routerID)
+		frr.WriteString(" bgp bestpath as-path multipath-relax\n")
+		frr.WriteString(" neighbor fabric peer-group\n")
+		frr.WriteString(" neighbor fabric remote-as external\n")
+		for _, n := range neighbors {
+			fmt.Fprintf(&frr, " neighbor %s peer-group fabric\n", n)
+		}
+		frr.WriteString(" !\n address-family ipv4 unicast\n" +
+			"  redistribute connected\n exit-address-family\n")
+		frr.WriteString(" !\n address-family ipv6 unicast\n" +
+			"  neighbor fabric activate\n  redistribute connected\n" +
+			" exit-address-family\n!\n")
+
+		files[d.Name] = []fabricFile{
+			{"/etc/frr/frr.conf", frr.Bytes()},
+			{"/etc/network/interfaces.d/fabric.intf", intf.Bytes()},
+		}
+	}
+
+	for i := range devs {
+		d := &devs[i]
+		if d.Function() != topology.Host {
+			continue
+		}
+		var fs []fabricFile
+		if lo := plan.Loopback(d.Name); len(lo) > 0 {
+			var buf bytes.Buffer
+			buf.WriteString("[Match]\nName=lo\n\n[Network]\n")
+			for _, a := range lo {
+				fmt.Fprintf(&buf, "Address=%s\n", a)
+			}
+			fs = append(fs, fabricFile{
+				"/etc/systemd/network/50-runtopo-lo.network",
+				buf.Bytes(),
+			})
+		}
+		for _, p := range ports[d.Name] {
+			addrs := plan.Interface(d.Name, p.name)
+			if len(addrs) == 0 {
+				continue
+			}
+			var buf bytes.Buffer
+			fmt.Fprintf(&buf, "[Match]\nName=%s\n\n[Network]\n", p.name)
+			for _, a := range addrs {
+				fmt.Fprintf(&buf, "Address=%s\n", a)
+			}
+			if peer := byName[p.peer]; peer != nil && isFabricRouter(peer) {
+				for _, a := range plan.Interface(p.peer, p.peerPort) {
+					fmt.Fprintf(&buf, "Gateway=%s\n",
+						a[:strings.IndexByte(a, '/')])
+				}
+			}
+			fs = append(fs, fabricFile{
+				"/etc/systemd/network/50-runtopo-" + p.name + ".network",
+				buf.Bytes(),
+			})
+		}
+		if len(fs) > 0 {
+			files[d.Name] = fs
+		}
+	}
+
+	return files, nil
+}
+
+// WriteFabricCommands writes the virt-customize commands installing files on
+// d and enabling the services using them.
+func writeFabricCommands(w io.Writer, d *device, files []fabricFile) {
+	if len(files) == 0 {
+		return
+	}
+	var managed []string
+	for _, f := range files {
+		io.WriteString(w, "write "+f.path+":"+
+			strings.Replace(string(f.content), "\n", "\\\n", -1)+"\n")
+		if strings.HasPrefix(f.path, "/etc/systemd/network/") {
+			name := strings.TrimSuffix(strings.TrimPrefix(f.path,
+				"/etc/systemd/network/50-runtopo-"), ".network")
+			if name != "lo" {
+				managed = append(managed, "interface-name:"+name)
+			}
+		}
+	}
+	if hasCumulusFunction(d) {
+		io.WriteString(w, "run-command sed -i 's/^bgpd=no/bgpd=yes/' /etc/frr/daemons\n")
+		io.WriteString(w, "run-command systemctl enable frr.service\n")
+		return
+	}
+	// Keep NetworkManager (if installed) from configuring the ports
+	// handed to systemd-networkd.
+	if len(managed) > 0 {
+		io.WriteString(w, "write /etc/NetworkManager/conf.d/90-runtopo-fabric.conf:"+
+			"[keyfile]\\\nunmanaged-devices="+strings.Join(managed, ";")+"\n")
+	}
+	io.WriteString(w, "run-command systemctl enable systemd-networkd.service\n")
+}
@@ -84,57 +84,6 @@ func mustParseMAC(s string) net.HardwareAddr {
 	return hw
 }
 
-func fetchImageContentLength(ctx context.Context, imageURL string) (n int64, err error) {
-	defer func() {
-		if err != nil {
-			err = fmt.Errorf("fetchImageContentLength: %w (url: %s)",
-				err, imageURL)
-		}
-	}()
-	req, err := http.NewRequestWithContext(ctx, "HEAD", imageURL, nil)
-	if err != nil {
-		return 0, err
-	}
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return 0, err
-	}
-	defer resp.Body.Close()
-
-	if !statusOK(resp) {
-		return 0, fmt.Errorf("status %s", resp.Status)
-	}
-
-	return strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
-}
-
-func fetchImage(ctx context.Context, w io.Writer, url string) (err error) {
-	defer func() {
-		if err != nil {
-			err = fmt.Errorf("fetchImage: %w (url: %s)", err, url)
-		}
-	}()
-
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-	if err != nil {
-		return err
-	}
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	if !statusOK(resp) {
-		return fmt.Errorf("status %s", resp.Status)
-	}
-
-	_, err = io.Copy(w, resp.Body)
-	return err
-}
-
 func statusOK(r *http.Response) bool {
 	return 200 <= r.StatusCode && r.StatusCode < 300
 }
@@ -238,18 +187,10 @@ func waitForLease(ctx context.Context, d *libvirt.Domain) (ip netaddr.IP, err er
 			err = fmt.Errorf("waitForLease: %w", err)
 		}
 	}()
-	var intf libvirt.DomainInterface
 	for {
-		xs, err1 := d.ListAllInterfaceAddresses(
-			libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_LEASE,
-		)
-		if err1 != nil {
-			err = err1
-			break
-		}
-		if len(xs) > 0 {
-			intf = xs[0]
-			break
+		ip, err := lookupLease(d)
+		if err != nil || !ip.IsZero() {
+			return ip, err
 		}
 
 		select {
@@ -258,9 +199,18 @@ func waitForLease(ctx context.Context, d *libvirt.Domain) (ip netaddr.IP, err er
 		case <-time.After(100 * time.Millisecond):
 		}
 	}
-	if err != nil {
+}
+
+// Returns the address of d's first DHCP lease from a libvirt network or the
+// zero IP if there's none (yet).
+func lookupLease(d *libvirt.Domain) (netaddr.IP, error) {
+	xs, err := d.ListAllInterfaceAddresses(
+		libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_LEASE,
+	)
+	if err != nil || len(xs) == 0 {
 		return netaddr.IP{}, err
 	}
+	intf := xs[0]
 	if len(intf.Addrs) == 0 {
 		return netaddr.IP{}, fmt.Errorf(
 			"interface %s: no addresses (hwaddr=%s)",
@@ -3,6 +3,7 @@ package libvirt
 import (
 	"sort"
 	"testing"
+	"time"
 )
 
 func TestNatSort(t *testing.T) {
@@ -21,6 +22,33 @@ func TestNatSort(t *testing.T) {
 	}
 }
 
+func TestParseUptime(t *testing.T) {
+	got, err := parseUptime([]byte("3725.42 14000.17\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 3725420 * time.Millisecond; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := parseUptime(nil); err == nil {
+		t.Error("parseUptime(nil): got nil error")
+	}
+}
+
+func TestSSHUser(t *testing.T) {
+	for function, want := range map[string]string{
+		"leaf":       "cumulus",
+		"oob-switch": "cumulus",
+		"host":       "root",
+		"oob-server": "root",
+		"":           "root",
+	} {
+		if got := sshUser(function); got != want {
+			t.Errorf("sshUser(%q) = %s, want %s", function, got, want)
+		}
+	}
+}
+
 // These test vectors were taken from Dave Koelle's website describing
 // Alphanum. http://www.davekoelle.com/alphanum.html
 var natSortTests = []struct {
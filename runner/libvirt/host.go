@@ -0,0 +1,275 @@
+package libvirt
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+	"slrz.net/runtopo/topology"
+)
+
+// A Host is a hypervisor devices may be placed on, see WithHosts.
+type Host struct {
+	Name     string // referred to by the host node attribute
+	URI      string // libvirt connection URI
+	TunnelIP net.IP // local address for UDP tunnels, reachable from the other hosts
+	Pool     string // storage pool, defaults to the one set by WithStoragePool
+
+	// Capacity available for devices, zero means unlimited.
+	CPUs   int   // VCPUs
+	Memory int64 // bytes
+}
+
+// WithHosts spreads the devices across the given hosts instead of placing all
+// of them on the host given by WithConnectionURI. Devices with a host
+// attribute are placed on the named host. The management server and switches
+// default to the first host, which needs to be the local one for the SSH
+// configuration written by WriteSSHConfig to work. Remaining devices are
+// assigned to the host with the lowest share of its memory in use, considering
+// the largest devices first. Hosts without a memory limit count as having
+// enough memory for the whole topology. Devices never exceed a host's
+// capacity.
+//
+// UDP tunnels use the tunnel IP of the host a device is placed on unless the
+// device has an explicit tunnelip attribute. With more than one host, each
+// host needs a tunnel IP.
+//
+// Virtual BMCs and virt-customize run locally, talking to remote hosts through
+// their connection URI. For virt-customize, the volumes of remote hosts must be
+// accessible locally, e.g. by using a shared storage pool.
+func WithHosts(hosts ...Host) RunnerOption {
+	return func(r *Runner) {
+		r.hosts = append([]Host(nil), hosts...)
+	}
+}
+
+// LoadHosts reads a list of hosts from a YAML file:
+//
+//	# hosts.yaml
+//	- name: hv1
+//	  uri: qemu:///system
+//	  tunnel_ip: 192.0.2.1
+//	  cpus: 32
+//	  memory: 128GiB
+//	- name: hv2
+//	  uri: qemu+ssh://root@hv2.example.org/system
+//	  tunnel_ip: 192.0.2.2
+//	  pool: images
+//
+// Bare numbers for memory are taken as MiB, like for the memory node
+// attribute.
+func LoadHosts(file string) (hosts []Host, err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("LoadHosts: %w", err)
+		}
+	}()
+	p, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var doc []struct {
+		Name     string `yaml:"name"`
+		URI      string `yaml:"uri"`
+		TunnelIP string `yaml:"tunnel_ip"`
+		Pool     string `yaml:"pool"`
+		CPUs     int    `yaml:"cpus"`
+		Memory   string `yaml:"memory"`
+	}
+	if err := yaml.UnmarshalStrict(p, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	for _, h := range doc {
+		host := Host{
+			Name: h.Name,
+			URI:  h.URI,
+			Pool: h.Pool,
+			CPUs: h.CPUs,
+		}
+		if h.TunnelIP != "" {
+			if host.TunnelIP = net.ParseIP(h.TunnelIP); host.TunnelIP == nil {
+				return nil, fmt.Errorf("%s: host %s: cannot parse tunnel_ip %q",
+					file, h.Name, h.TunnelIP)
+			}
+		}
+		if h.Memory != "" {
+			if host.Memory, err = topology.ParseSize(h.Memory, 1<<20); err != nil {
+				return nil, fmt.Errorf("%s: host %s: %w", file, h.Name, err)
+			}
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// CheckHosts validates the hosts passed to WithHosts.
+func checkHosts(hosts []Host) error {
+	seen := make(map[string]bool)
+	for _, h := range hosts {
+		switch {
+		case h.Name == "":
+			return errors.New("host without name")
+		case seen[h.Name]:
+			return fmt.Errorf("duplicate host %s", h.Name)
+		case h.URI == "":
+			return fmt.Errorf("host %s: no connection URI", h.Name)
+		case h.TunnelIP == nil && len(hosts) > 1:
+			return fmt.Errorf("host %s: no tunnel IP", h.Name)
+		case h.CPUs < 0 || h.Memory < 0:
+			return fmt.Errorf("host %s: negative capacity", h.Name)
+		}
+		seen[h.Name] = true
+	}
+	return nil
+}
+
+// PlaceDevices assigns the devices of t to r.hosts as described for WithHosts,
+// returning a map from device name to host. Devices keep the host recorded in
+// prev, if any, as long as it still exists and has room for them.
+func (r *Runner) placeDevices(t *topology.T, prev *State) (map[string]*Host, error) {
+	placement := make(map[string]*Host)
+	if len(r.hosts) == 0 {
+		// Everything on the host given by WithConnectionURI.
+		local := &Host{URI: r.uri, Pool: r.storagePool}
+		for _, d := range t.Devices() {
+			placement[d.Name] = local
+		}
+		return placement, nil
+	}
+	if err := checkHosts(r.hosts); err != nil {
+		return nil, err
+	}
+
+	type usage struct {
+		cpus   int
+		memory int64
+	}
+	hosts := make(map[string]*Host)
+	used := make(map[*Host]*usage)
+	for i := range r.hosts {
+		h := &r.hosts[i]
+		hosts[h.Name] = h
+		used[h] = new(usage)
+	}
+	var total int64
+	for _, d := range t.Devices() {
+		total += d.Memory()
+	}
+	fits := func(h *Host, d *topology.Device) bool {
+		u := used[h]
+		return (h.CPUs == 0 || u.cpus+d.VCPUs() <= h.CPUs) &&
+			(h.Memory == 0 || u.memory+d.Memory() <= h.Memory)
+	}
+	place := func(h *Host, d *topology.Device) {
+		used[h].cpus += d.VCPUs()
+		used[h].memory += d.Memory()
+		placement[d.Name] = h
+	}
+	prevHosts := make(map[string]string)
+	if prev != nil {
+		for _, d := range prev.Devices {
+			prevHosts[d.Name] = d.Host
+		}
+	}
+
+	// Explicitly placed devices first, then the management devices and
+	// those that were placed before.
+	var rest []topology.Device
+	for _, d := range t.Devices() {
+		if d.Function() == topology.Fake {
+			continue
+		}
+		name := d.Attr("host")
+		if name == "" {
+			rest = append(rest, d)
+			continue
+		}
+		h := hosts[name]
+		if h == nil {
+			return nil, fmt.Errorf("device %s: unknown host %s", d.Name, name)
+		}
+		if !fits(h, &d) {
+			return nil, fmt.Errorf("device %s: exceeds capacity of host %s",
+				d.Name, name)
+		}
+		place(h, &d)
+	}
+	ds := rest
+	rest = nil
+	for _, d := range ds {
+		if topology.HasFunction(&d, topology.OOBServer, topology.OOBSwitch) {
+			h := &r.hosts[0]
+			if !fits(h, &d) {
+				return nil, fmt.Errorf("device %s: exceeds capacity of host %s",
+					d.Name, h.Name)
+			}
+			place(h, &d)
+			continue
+		}
+		if h := hosts[prevHosts[d.Name]]; h != nil && fits(h, &d) {
+			place(h, &d)
+			continue
+		}
+		rest = append(rest, d)
+	}
+
+	sort.SliceStable(rest, func(i, j int) bool {
+		return rest[i].Memory() > rest[j].Memory()
+	})
+	for _, d := range rest {
+		var best *Host
+		var bestShare float64
+		for i := range r.hosts {
+			h := &r.hosts[i]
+			if !fits(h, &d) {
+				continue
+			}
+			capacity := h.Memory
+			if capacity == 0 {
+				capacity = total
+			}
+			share := float64(used[h].memory+d.Memory()) / float64(capacity)
+			if best == nil || share < bestShare {
+				best, bestShare = h, share
+			}
+		}
+		if best == nil {
+			return nil, fmt.Errorf("device %s: no host with enough capacity",
+				d.Name)
+		}
+		place(best, &d)
+	}
+	return placement, nil
+}
+
+// DeviceURI returns the connection URI of the host the named device of t is
+// placed on. The placement recorded in the state file takes precedence over
+// the one computed for t.
+func (r *Runner) deviceURI(t *topology.T, name string) (string, error) {
+	if r.stateDir != "" {
+		s, err := LoadState(r.stateDir, r.namePrefix)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		if s != nil {
+			for _, d := range s.Devices {
+				if d.Name == name {
+					uri, _ := s.location(&d)
+					return uri, nil
+				}
+			}
+		}
+	}
+	placement, err := r.placeDevices(t, nil)
+	if err != nil {
+		return "", err
+	}
+	if h := placement[name]; h != nil {
+		return h.URI, nil
+	}
+	return r.uri, nil
+}
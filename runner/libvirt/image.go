@@ -0,0 +1,341 @@
+package libvirt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"libvirt.org/libvirt-go"
+)
+
+// WithImageCache sets the directory where downloaded base images are kept
+// before importing them into the storage pools. Interrupted downloads are
+// resumed from there. Defaults to $XDG_CACHE_HOME/runtopo/images.
+func WithImageCache(dir string) RunnerOption {
+	return func(r *Runner) {
+		r.imageCache = dir
+	}
+}
+
+func defaultImageCache() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "runtopo", "images")
+}
+
+// FetchImage returns the path of a verified local copy of img, fetching it
+// into cacheDir under the given name if needed. Data goes to a file with the
+// suffix ".part" first, which is renamed once complete. The source's validator
+// for the data is kept alongside in a file with the suffix ".part.validator".
+// A partial download is resumed if the source supports it and still provides
+// the same data according to the validator. With neither validator nor
+// digest, there's no telling and we start over. If digest is non-empty, the
+// image must have that SHA-256 digest (hex-encoded). The digest of each
+// complete image is recorded next to it in a file with the suffix ".sha256",
+// sparing us from hashing it again, its validator in one with the suffix
+// ".validator". Without a digest, a cached copy of a source able to report
+// its validator cheaply (local files) is fetched again once that changed.
+func fetchImage(ctx context.Context, cacheDir, name string, img *sourceImage, digest string) (file string, err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("fetchImage %s: %w", name, err)
+		}
+	}()
+	file = filepath.Join(cacheDir, name)
+
+	if _, err := os.Stat(file); err == nil {
+		have, err := cachedDigest(file)
+		if err != nil {
+			return "", err
+		}
+		stale := digest != "" && digest != have
+		if digest == "" && img.stat != nil {
+			current, err := img.stat()
+			if err != nil {
+				return "", err
+			}
+			p, _ := os.ReadFile(file + ".validator")
+			stale = strings.TrimSpace(string(p)) != current
+		}
+		if !stale {
+			return file, nil
+		}
+		// Stale or different image of the same name, fetch
+		// it again.
+		if err := os.Remove(file); err != nil {
+			return "", err
+		}
+		os.Remove(file + ".unpacked")
+		os.Remove(file + ".validator")
+	}
+
+	if err := os.MkdirAll(cacheDir, 0o755); err != nil {
+		return "", err
+	}
+	part := file + ".part"
+	f, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+	h := sha256.New()
+	// Hash what we have so far, leaving the offset at the end.
+	offset, err := io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	validatorFile := part + ".validator"
+	var validator string
+	if p, err := os.ReadFile(validatorFile); err == nil {
+		validator = strings.TrimSpace(string(p))
+	}
+	if validator == "" && digest == "" {
+		offset = 0
+	}
+	if err := download(ctx, f, h, img, offset, validator, validatorFile); err != nil {
+		return "", err
+	}
+	have := hex.EncodeToString(h.Sum(nil))
+	if digest != "" && have != digest {
+		os.Remove(part)
+		os.Remove(validatorFile)
+		return "", fmt.Errorf("checksum mismatch: got sha256 %s, want %s",
+			have, digest)
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	f = nil
+	if err := os.WriteFile(file+".sha256", []byte(have+"\n"), 0o644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(part, file); err != nil {
+		return "", err
+	}
+	err = os.Rename(validatorFile, file+".validator")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	return file, nil
+}
+
+// Download appends img to f, which already holds the first offset bytes of
+// it as identified by validator, and writes the appended data to h as well. It
+// starts over if the source can't resume at offset, recording the validator
+// of the new data in validatorFile.
+func download(ctx context.Context, f *os.File, h hash.Hash, img *sourceImage, offset int64, validator, validatorFile string) error {
+	rc, resumed, validator, err := img.open(ctx, offset, validator)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if !resumed {
+		// Full data, replace whatever we had.
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		h.Reset()
+		if err := os.WriteFile(validatorFile, []byte(validator+"\n"), 0o644); err != nil {
+			return err
+		}
+	}
+	_, err = io.Copy(io.MultiWriter(f, h), rc)
+	return err
+}
+
+// CachedDigest returns the SHA-256 digest recorded for the cached image file,
+// computing and recording it if missing.
+func cachedDigest(file string) (string, error) {
+	if p, err := os.ReadFile(file + ".sha256"); err == nil {
+		return strings.TrimSpace(string(p)), nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+	return digest, os.WriteFile(file+".sha256", []byte(digest+"\n"), 0o644)
+}
+
+// ImageDigest returns the expected SHA-256 digest of the image with the given
+// file name (see imageName) given the value of its os_sha256 attribute. This is
+// either the hex-encoded digest itself or the URL of a checksum file like
+// SHA256SUMS listing it.
+func imageDigest(ctx context.Context, name, attr string) (digest string, err error) {
+	if attr == "" || isSHA256(attr) {
+		return strings.ToLower(attr), nil
+	}
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("imageDigest: %w (url: %s)", err, attr)
+		}
+	}()
+	req, err := http.NewRequestWithContext(ctx, "GET", attr, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if !statusOK(resp) {
+		return "", fmt.Errorf("status %s", resp.Status)
+	}
+	// Checksum files are small, don't let a wrong URL fill memory.
+	p, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	if digest := lookupChecksum(p, name); digest != "" {
+		return digest, nil
+	}
+	return "", fmt.Errorf("no checksum for %s", name)
+}
+
+// LookupChecksum returns the SHA-256 digest listed for name in the checksum
+// file p, or the empty string if there is none. Both the format written by
+// sha256sum ("<digest>  <name>", with "*" before binary file names) and the
+// BSD one ("SHA256 (<name>) = <digest>") are understood. Other lines, like
+// PGP armor, are ignored.
+func lookupChecksum(p []byte, name string) string {
+	sc := bufio.NewScanner(bytes.NewReader(p))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if s := strings.TrimPrefix(line, "SHA256 ("); s != line {
+			i := strings.LastIndex(s, ") = ")
+			if i >= 0 && s[:i] == name && isSHA256(s[i+4:]) {
+				return strings.ToLower(s[i+4:])
+			}
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 2 && isSHA256(fields[0]) &&
+			strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0])
+		}
+	}
+	return ""
+}
+
+func isSHA256(s string) bool {
+	p, err := hex.DecodeString(s)
+	return err == nil && len(p) == sha256.Size
+}
+
+// ImportImage creates the volume name in pool from the local image file of the
+// given format (see prepareImage), recording m as its metadata. The data is
+// uploaded to a temporary volume first, which is then cloned into place and
+// deleted, so a volume named name is always complete. Libvirt can't rename
+// volumes, so the clone copies the image once more, doubling the I/O of an
+// import. That's paid once per base image and host. The metadata is written
+// once the clone succeeded. Leftovers of earlier attempts are removed.
+func importImage(conn *libvirt.Connect, pool *libvirt.StoragePool, name, file, format string, m *imageMeta) (vol *libvirt.StorageVol, err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("importImage %s: %w", name, err)
+		}
+	}()
+	tmpName := name + ".part"
+	if v, err := pool.LookupStorageVolByName(tmpName); err == nil {
+		v.Delete(0)
+		v.Free()
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+
+	tmpVol := newVolume(tmpName, size)
+	tmpVol.Target.Format.Type = format
+	xmlStr, err := tmpVol.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("marshal: %w", err)
+	}
+	tmp, err := pool.StorageVolCreateXML(xmlStr, 0)
+	if err != nil {
+		return nil, fmt.Errorf("vol-create: %w", err)
+	}
+	defer func() {
+		tmp.Delete(0)
+		tmp.Free()
+	}()
+	if err := uploadVolume(conn, tmp, f, size); err != nil {
+		return nil, err
+	}
+
+	// There's no renaming volumes, clone it instead.
+	info, err := tmp.GetInfo()
+	if err != nil {
+		return nil, fmt.Errorf("get-info: %w", err)
+	}
+	xmlVol := newVolume(name, int64(info.Capacity))
+	xmlVol.Target.Format.Type = format
+	xmlStr, err = xmlVol.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("marshal: %w", err)
+	}
+	vol, err = pool.StorageVolCreateXMLFrom(xmlStr, tmp, 0)
+	if err != nil {
+		return nil, fmt.Errorf("vol-clone: %w", err)
+	}
+	if err := writeImageMeta(conn, pool, name, m); err != nil {
+		vol.Delete(0)
+		vol.Free()
+		return nil, err
+	}
+	return vol, nil
+}
+
+// UploadVolume writes size bytes read from r to vol.
+func uploadVolume(conn *libvirt.Connect, vol *libvirt.StorageVol, r io.Reader, size int64) error {
+	stream, err := conn.NewStream(0)
+	if err != nil {
+		return fmt.Errorf("new-stream: %w", err)
+	}
+	defer stream.Free()
+	if err := vol.Upload(stream, 0, uint64(size), 0); err != nil {
+		stream.Abort()
+		return fmt.Errorf("vol-upload: %w", err)
+	}
+	if _, err := io.Copy(&streamWriter{stream: stream}, r); err != nil {
+		stream.Abort()
+		return fmt.Errorf("upload: %w", err)
+	}
+	if err := stream.Finish(); err != nil {
+		return fmt.Errorf("stream-finish: %w", err)
+	}
+	return nil
+}
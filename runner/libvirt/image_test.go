@@ -0,0 +1,542 @@
+package libvirt
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestFetchImage(t *testing.T) {
+	image := bytes.Repeat([]byte("runtopo image "), 1<<12)
+	sum := sha256.Sum256(image)
+	digest := hex.EncodeToString(sum[:])
+
+	var ranges, ifRanges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/disk.qcow2":
+			ranges = append(ranges, req.Header.Get("Range"))
+			ifRanges = append(ifRanges, req.Header.Get("If-Range"))
+			w.Header().Set("ETag", `"v1"`)
+			http.ServeContent(w, req, "disk.qcow2", time.Time{},
+				bytes.NewReader(image))
+		case "/SHA256SUMS":
+			w.Write([]byte(digest + "  disk.qcow2\n"))
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	imageURL := srv.URL + "/disk.qcow2"
+
+	// Resume a partial download.
+	dir := t.TempDir()
+	part := filepath.Join(dir, "disk.qcow2.part")
+	if err := os.WriteFile(part, image[:1000], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	want, err := imageDigest(ctx, "disk.qcow2", srv.URL+"/SHA256SUMS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != digest {
+		t.Errorf("got digest %s from SHA256SUMS, want %s", want, digest)
+	}
+	file, err := fetchImage(ctx, dir, "disk.qcow2", httpImage(imageURL), want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, err := os.ReadFile(file); err != nil || !bytes.Equal(p, image) {
+		t.Errorf("got cached image of len %d (err=%v), want len %d",
+			len(p), err, len(image))
+	}
+	if got := strings.Join(ranges, ","); got != "bytes=1000-" {
+		t.Errorf("got range requests %q, want resumption at 1000", got)
+	}
+	if _, err := os.Stat(part); err == nil {
+		t.Errorf("partial download %s still exists", part)
+	}
+	if _, err := os.Stat(part + ".validator"); err == nil {
+		t.Errorf("validator of partial download still exists")
+	}
+
+	// A changed image is fetched in full, a partial download without
+	// validator and digest isn't resumed at all.
+	for _, test := range []struct {
+		validator              string
+		wantRange, wantIfRange string
+	}{
+		{`"v0"`, "bytes=1000-", `"v0"`},
+		{`"v1"`, "bytes=1000-", `"v1"`},
+		{"", "", ""},
+	} {
+		dir := t.TempDir()
+		part := filepath.Join(dir, "disk.qcow2.part")
+		prefix := image[:1000]
+		if test.validator == `"v0"` {
+			prefix = bytes.Repeat([]byte("x"), 1000)
+		}
+		if err := os.WriteFile(part, prefix, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if test.validator != "" {
+			err := os.WriteFile(part+".validator", []byte(test.validator+"\n"), 0o644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		ranges, ifRanges = nil, nil
+		file, err := fetchImage(ctx, dir, "disk.qcow2", httpImage(imageURL), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p, err := os.ReadFile(file); err != nil || !bytes.Equal(p, image) {
+			t.Errorf("validator %s: got cached image of len %d (err=%v), want len %d",
+				test.validator, len(p), err, len(image))
+		}
+		if len(ranges) != 1 || ranges[0] != test.wantRange || ifRanges[0] != test.wantIfRange {
+			t.Errorf("validator %s: got Range %q, If-Range %q, want %q, %q",
+				test.validator, ranges, ifRanges, test.wantRange, test.wantIfRange)
+		}
+	}
+
+	// Served from the cache.
+	ranges = nil
+	if _, err := fetchImage(ctx, dir, "disk.qcow2", httpImage(imageURL), digest); err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != 0 {
+		t.Errorf("got %d requests for cached image, want none", len(ranges))
+	}
+
+	// Corrupt partial downloads fail verification.
+	dir = t.TempDir()
+	part = filepath.Join(dir, "disk.qcow2.part")
+	if err := os.WriteFile(part, []byte("garbage"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fetchImage(ctx, dir, "disk.qcow2", httpImage(imageURL), digest); err == nil ||
+		!strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("got err=%v for corrupt image, want checksum mismatch", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "disk.qcow2")); err == nil {
+		t.Error("corrupt image made it into the cache")
+	}
+	if _, err := os.Stat(part); err == nil {
+		t.Error("corrupt partial download wasn't removed")
+	}
+}
+
+func TestFetchImageLocalFile(t *testing.T) {
+	ctx := context.Background()
+	src, cache := t.TempDir(), t.TempDir()
+	img := fileImage(os.DirFS(src), "disk.img")
+	mtime := time.Now().Add(-time.Hour)
+	for i, data := range []string{"first image", "first image", "second image"} {
+		path := filepath.Join(src, "disk.img")
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime.Add(time.Duration(i/2)*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		file, err := fetchImage(ctx, cache, "disk.img", img, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p, err := os.ReadFile(file); err != nil || string(p) != data {
+			t.Errorf("fetch %d: got cached image %q (err=%v), want %q",
+				i, p, err, data)
+		}
+	}
+}
+
+func TestLookupChecksum(t *testing.T) {
+	const sums = `-----BEGIN PGP SIGNED MESSAGE-----
+Hash: SHA256
+
+# Fedora-Cloud-34-1.2-x86_64-CHECKSUM
+SHA256 (Fedora-Cloud-Base-34-1.2.x86_64.qcow2) = B9B621B26725BA95442D9A56CBAA054784E0779A9522EC6EAFFF07C6F8F717EA
+SHA256 (Fedora-Cloud-Base-34-1.2.x86_64.raw.xz) = 3d8a2c6f3c3a6bc8d4d5ef0ecf4fa5d3df4c3b47c2d59f1b0b7e2e5a4c5b5b1d
+e9d6dc3e0ae4c7a40e5c6a1d0d47b7bfbbc11c3ea7f1c5b8c1b3fa47a3e5b7d4 *cumulus-linux-4.4.0-vx-amd64-qemu.qcow2
+`
+	for _, test := range []struct {
+		name, want string
+	}{
+		{"Fedora-Cloud-Base-34-1.2.x86_64.qcow2", "b9b621b26725ba95442d9a56cbaa054784e0779a9522ec6eafff07c6f8f717ea"},
+		{"cumulus-linux-4.4.0-vx-amd64-qemu.qcow2", "e9d6dc3e0ae4c7a40e5c6a1d0d47b7bfbbc11c3ea7f1c5b8c1b3fa47a3e5b7d4"},
+		{"Fedora-Cloud-Base-34-1.2.x86_64.raw", ""},
+	} {
+		if got := lookupChecksum([]byte(sums), test.name); got != test.want {
+			t.Errorf("lookupChecksum(%s): got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestPrepareImage(t *testing.T) {
+	qcow2 := append([]byte("QFI\xfb\x00\x00\x00\x03"), bytes.Repeat([]byte{1}, 4096)...)
+	raw := append(make([]byte, 510), 0x55, 0xaa)
+
+	gz := func(p []byte) []byte {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		w.Write(p)
+		w.Close()
+		return buf.Bytes()
+	}
+	tarball := func(files map[string][]byte) []byte {
+		var buf bytes.Buffer
+		w := tar.NewWriter(&buf)
+		for _, name := range []string{"README", "disk.qcow2"} {
+			p, ok := files[name]
+			if !ok {
+				continue
+			}
+			w.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(p))})
+			w.Write(p)
+		}
+		w.Close()
+		return buf.Bytes()
+	}
+	zipped := func(name string, p []byte) []byte {
+		var buf bytes.Buffer
+		w := zip.NewWriter(&buf)
+		fw, _ := w.Create("README")
+		fw.Write([]byte("hello"))
+		fw, _ = w.Create(name)
+		fw.Write(p)
+		w.Close()
+		return buf.Bytes()
+	}
+
+	type imageTest struct {
+		name   string
+		data   []byte
+		want   []byte
+		format string
+	}
+	tests := []imageTest{
+		{"disk.qcow2", qcow2, qcow2, "qcow2"},
+		{"disk.img", raw, raw, "raw"},
+		{"disk.qcow2.gz", gz(qcow2), qcow2, "qcow2"},
+		{"disk.img.gz", gz(raw), raw, "raw"},
+		{"disk.tar.gz", gz(tarball(map[string][]byte{"README": []byte("hi"), "disk.qcow2": qcow2})), qcow2, "qcow2"},
+		{"disk.zip", zipped("images/disk.img", raw), raw, "raw"},
+		{"disk.zip", zipped("disk.qcow2.gz", gz(qcow2)), qcow2, "qcow2"},
+	}
+	if _, err := exec.LookPath("xz"); err == nil {
+		var buf bytes.Buffer
+		cmd := exec.Command("xz", "-c")
+		cmd.Stdin, cmd.Stdout = bytes.NewReader(qcow2), &buf
+		if err := cmd.Run(); err != nil {
+			t.Fatal(err)
+		}
+		tests = append(tests, imageTest{"disk.qcow2.xz", buf.Bytes(), qcow2, "qcow2"})
+	}
+	for _, test := range tests {
+		file := filepath.Join(t.TempDir(), test.name)
+		if err := os.WriteFile(file, test.data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		image, format, err := prepareImage(context.Background(), file)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if format != test.format {
+			t.Errorf("%s: got format %s, want %s", test.name, format, test.format)
+		}
+		if p, err := os.ReadFile(image); err != nil || !bytes.Equal(p, test.want) {
+			t.Errorf("%s: got image of len %d (err=%v), want len %d",
+				test.name, len(p), err, len(test.want))
+		}
+	}
+
+	file := filepath.Join(t.TempDir(), "disk.tar.gz")
+	os.WriteFile(file, gz(tarball(map[string][]byte{"README": []byte("hi")})), 0o644)
+	if _, _, err := prepareImage(context.Background(), file); err == nil {
+		t.Error("got no error for archive without disk image")
+	}
+}
+
+func TestFormatFromName(t *testing.T) {
+	for _, test := range []struct {
+		name, want string
+	}{
+		{"cumulus.qcow2", "qcow2"},
+		{"debian.QCOW2.xz", "qcow2"},
+		{"disk.raw.zst", "raw"},
+		{"disk.img", ""},
+		{"cumulus-vx_4.4.0", ""},
+	} {
+		if got := formatFromName(test.name); got != test.want {
+			t.Errorf("formatFromName(%s): got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestImageSources(t *testing.T) {
+	image := bytes.Repeat([]byte("runtopo image "), 1<<12)
+	sum := sha256.Sum256(image)
+	digest := hex.EncodeToString(sum[:])
+	ctx := context.Background()
+
+	// A registry holding the image as single layer artifact, requiring an
+	// anonymous bearer token.
+	blob := "sha256:" + digest
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/token" {
+			if req.URL.Query().Get("scope") != "repository:lab/cumulus-vx:pull" {
+				http.Error(w, "bad scope", http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(`{"token": "t0k3n"}`))
+			return
+		}
+		if req.Header.Get("Authorization") != "Bearer t0k3n" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+srv.URL+
+				`/token",service="test",scope="repository:lab/cumulus-vx:pull"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch req.URL.Path {
+		case "/v2/lab/cumulus-vx/manifests/4.4.0":
+			w.Header().Set("Content-Type", ociManifestType)
+			fmt.Fprintf(w, `{
+				"schemaVersion": 2,
+				"mediaType": %q,
+				"layers": [{
+					"mediaType": "application/vnd.oci.image.layer.v1.tar",
+					"digest": %q,
+					"size": %d,
+					"annotations": {"org.opencontainers.image.title": "cumulus.qcow2"}
+				}]
+			}`, ociManifestType, blob, len(image))
+		case "/v2/lab/cumulus-vx/blobs/" + blob:
+			http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(image))
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer srv.Close()
+	registry := strings.TrimPrefix(srv.URL, "http://")
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "local.qcow2"), image, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	topoFS := fstest.MapFS{
+		"images/disk.qcow2": &fstest.MapFile{Data: image},
+	}
+
+	for _, test := range []struct {
+		ref      string
+		imageDir string
+		name     string
+		digest   string // known by the source
+	}{
+		{"images/disk.qcow2", "", "disk.qcow2", ""},
+		{"file:images/disk.qcow2", "", "disk.qcow2", ""},
+		{"file://" + filepath.Join(dir, "local.qcow2"), "", "local.qcow2", ""},
+		{"file://localhost" + filepath.Join(dir, "local.qcow2"), "", "local.qcow2", ""},
+		{"oci://" + registry + "/lab/cumulus-vx:4.4.0", "", "cumulus-vx_4.4.0", digest},
+		{"https://example.org/local.qcow2", dir, "local.qcow2", ""},
+	} {
+		r := NewRunner(WithConfigFS(topoFS), WithImageDir(test.imageDir))
+		if name := imageName(test.ref); name != test.name {
+			t.Errorf("imageName(%s): got %s, want %s", test.ref, name, test.name)
+		}
+		img, err := r.resolveImage(ctx, test.ref)
+		if err != nil {
+			t.Errorf("resolveImage(%s): %v", test.ref, err)
+			continue
+		}
+		if img.digest != test.digest {
+			t.Errorf("%s: got source digest %q, want %q", test.ref, img.digest, test.digest)
+		}
+		cache := t.TempDir()
+		// Resume a partial fetch.
+		part := filepath.Join(cache, test.name+".part")
+		if err := os.WriteFile(part, image[:1000], 0o644); err != nil {
+			t.Fatal(err)
+		}
+		file, err := fetchImage(ctx, cache, test.name, img, digest)
+		if err != nil {
+			t.Errorf("%s: %v", test.ref, err)
+			continue
+		}
+		if p, err := os.ReadFile(file); err != nil || !bytes.Equal(p, image) {
+			t.Errorf("%s: got cached image of len %d (err=%v), want len %d",
+				test.ref, len(p), err, len(image))
+		}
+	}
+
+	// Nothing is downloaded with an image directory.
+	r := NewRunner(WithImageDir(dir))
+	if _, err := r.resolveImage(ctx, srv.URL+"/missing.qcow2"); err == nil {
+		t.Error("got no error for image missing from image directory")
+	}
+
+	// The host part of file URLs isn't taken as path element.
+	r = NewRunner(WithConfigFS(topoFS))
+	if _, err := r.resolveImage(ctx, "file://images/disk.qcow2"); err == nil {
+		t.Error("file://images/disk.qcow2: got no error")
+	}
+}
+
+func TestParseOCIRef(t *testing.T) {
+	for _, test := range []struct {
+		ref                       string
+		registry, repo, reference string
+	}{
+		{"oci://ghcr.io/lab/cumulus-vx:4.4.0", "ghcr.io", "lab/cumulus-vx", "4.4.0"},
+		{"oci://localhost:5000/cumulus-vx", "localhost:5000", "cumulus-vx", "latest"},
+		{"oci://localhost:5000/a/b@sha256:0123", "localhost:5000", "a/b", "sha256:0123"},
+		{"oci://localhost:5000", "", "", ""},
+	} {
+		registry, repo, reference, err := parseOCIRef(test.ref)
+		if test.repo == "" {
+			if err == nil {
+				t.Errorf("parseOCIRef(%s): got no error", test.ref)
+			}
+			continue
+		}
+		if err != nil || registry != test.registry || repo != test.repo || reference != test.reference {
+			t.Errorf("parseOCIRef(%s): got (%s, %s, %s, %v), want (%s, %s, %s)",
+				test.ref, registry, repo, reference, err,
+				test.registry, test.repo, test.reference)
+		}
+	}
+}
+
+func TestBaseVolumeName(t *testing.T) {
+	const digest = "e9d6dc3e0ae4c7a40e5c6a1d0d47b7bfbbc11c3ea7f1c5b8c1b3fa47a3e5b7d4"
+	a := baseVolumeName("https://a.example.org/disk.qcow2", "")
+	b := baseVolumeName("https://b.example.org/disk.qcow2", "")
+	if a == b {
+		t.Errorf("images of the same file name share volume %s", a)
+	}
+	if a != baseVolumeName("https://a.example.org/disk.qcow2", "") {
+		t.Error("volume name isn't stable")
+	}
+	// Same content from different mirrors.
+	c := baseVolumeName("https://a.example.org/disk.qcow2", digest)
+	d := baseVolumeName("https://b.example.org/disk.qcow2", strings.ToUpper(digest))
+	if c != d {
+		t.Errorf("got volumes %s and %s for the same digest", c, d)
+	}
+	// Checksum file URLs don't identify the content.
+	if e := baseVolumeName("https://b.example.org/disk.qcow2", "https://b.example.org/SHA256SUMS"); e != b {
+		t.Errorf("got volume %s with checksum file, want %s", e, b)
+	}
+	for _, name := range []string{a, b, c} {
+		if !isBaseVolume(name) {
+			t.Errorf("isBaseVolume(%s) = false", name)
+		}
+	}
+	for _, name := range []string{a + ".meta", a + ".part", "runtopo-leaf0", "disk.qcow2"} {
+		if isBaseVolume(name) {
+			t.Errorf("isBaseVolume(%s) = true", name)
+		}
+	}
+}
+
+func TestVolumeUsers(t *testing.T) {
+	dir := t.TempDir()
+	r := NewRunner(WithStateDir(dir))
+	for _, s := range []*State{{
+		URI:        "qemu:///system",
+		NamePrefix: "lab1-",
+		Pool:       "default",
+		Devices: []StateDevice{
+			{Name: "leaf0", Volume: "lab1-leaf0"},
+			{Name: "leaf1", Volume: "lab1-leaf1", URI: "qemu+ssh://hv2/system"},
+		},
+	}, {
+		URI:        "qemu:///system",
+		NamePrefix: "lab2-",
+		Pool:       "default",
+		Devices: []StateDevice{
+			{Name: "leaf0", Volume: "lab2-leaf0", Pool: "fast"},
+		},
+	}} {
+		if err := r.writeState(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	states, err := r.loadStates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 2 {
+		t.Fatalf("got %d states, want 2", len(states))
+	}
+
+	refs := []volumeRef{
+		{pool: "default", name: "lab1-leaf0"},
+		{pool: "default", name: "lab1-leaf1"}, // on another host
+		{pool: "fast", name: "lab2-leaf0"},
+		{pool: "default", name: "lab2-leaf0"}, // in another pool
+		{pool: "default", name: "lab1-leaf0"},
+	}
+	got := strings.Join(volumeUsers(refs, "qemu:///system", states), ",")
+	if want := "lab1-,lab1-leaf1,lab2-,lab2-leaf0"; got != want {
+		t.Errorf("got users %s, want %s", got, want)
+	}
+	if got := volumeUsers(nil, "qemu:///system", states); len(got) != 0 {
+		t.Errorf("got users %v for unreferenced image, want none", got)
+	}
+}
+
+func TestPruneImageCache(t *testing.T) {
+	cache := t.TempDir()
+	r := NewRunner(WithImageCache(cache))
+	a := baseVolumeName("https://example.org/a.qcow2", "")
+	b := baseVolumeName("https://example.org/b.qcow2", "")
+	c := baseVolumeName("https://example.org/c.qcow2", "")
+	for _, v := range []string{a, b, c} {
+		dir := filepath.Join(cache, strings.TrimPrefix(v, baseVolumePrefix))
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "disk.qcow2"), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// B is pruned from one host but still used on another.
+	pruned := []Image{{Volume: a}, {Volume: b, Host: "hv1"}}
+	kept := []Image{{Volume: b, Host: "hv2", UsedBy: []string{"lab-"}}, {Volume: c}}
+	if err := r.pruneImageCache(pruned, kept); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		volume string
+		exists bool
+	}{
+		{a, false},
+		{b, true},
+		{c, true},
+	} {
+		_, err := os.Stat(filepath.Join(cache, strings.TrimPrefix(test.volume, baseVolumePrefix)))
+		if exists := err == nil; exists != test.exists {
+			t.Errorf("%s: got cache entry exists=%v, want %v",
+				test.volume, exists, test.exists)
+		}
+	}
+}
@@ -0,0 +1,381 @@
+package libvirt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"libvirt.org/libvirt-go"
+	libvirtxml "libvirt.org/libvirt-go-xml"
+	"slrz.net/runtopo/topology"
+)
+
+// An Image describes a base image volume, see Images.
+type Image struct {
+	Host   string `json:"host,omitempty"` // see WithHosts
+	URI    string `json:"uri"`
+	Pool   string `json:"pool"`
+	Volume string `json:"volume"`
+	Size   uint64 `json:"size"` // allocated bytes
+
+	// Source is the os attribute value the image was fetched from.
+	// Source, Digest and Fetched are unset if the image's metadata is
+	// missing.
+	Source  string     `json:"source,omitempty"`
+	Digest  string     `json:"sha256,omitempty"` // of the file as fetched
+	Fetched *time.Time `json:"fetched,omitempty"`
+
+	// UsedBy lists the running topologies, by name prefix, with volumes
+	// backed by the image. Volumes not recorded in any state file are
+	// listed by name. The volumes of inactive storage pools can't be
+	// inspected, these pools are listed as pool:name and might be using
+	// any of the host's images.
+	UsedBy []string `json:"used_by,omitempty"`
+}
+
+// PullImages makes sure the storage pools have the base images of the devices
+// of t, without creating anything else. It's useful for fetching images ahead
+// of time.
+func (r *Runner) PullImages(ctx context.Context, t *topology.T) (err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("libvirt.(*Runner).PullImages: %w", err)
+		}
+	}()
+	if err := r.buildInventory(t); err != nil {
+		return err
+	}
+	if err := r.connect(); err != nil {
+		return err
+	}
+	defer r.disconnect()
+	if err := r.downloadBaseImages(ctx, t); err != nil {
+		return err
+	}
+	for _, v := range r.baseImages {
+		v.Free()
+	}
+	r.baseImages = nil
+	return nil
+}
+
+// Images lists the base image volumes in the storage pools of the hosts (see
+// WithHosts) along with the running topologies using them. A base image is in
+// use if a volume in a storage pool of the same host has it as backing store,
+// or possibly so if the host has inactive storage pools. Topologies are identified using the state files in the
+// directory given by WithStateDir.
+func (r *Runner) Images(ctx context.Context) (images []Image, err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("libvirt.(*Runner).Images: %w", err)
+		}
+	}()
+	states, err := r.loadStates()
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range r.imageHosts() {
+		conn, err := libvirt.NewConnect(h.URI)
+		if err != nil {
+			return nil, err
+		}
+		imgs, err := hostImages(conn, &h, states)
+		conn.Close()
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, imgs...)
+	}
+	return images, nil
+}
+
+// PruneImages deletes the base image volumes not used by any other volume, as
+// determined by Images, and returns them. The image cache entries of pruned
+// images are removed as well unless another host still has the image. If
+// dryRun is set, nothing is deleted. Nothing is pruned from hosts with inactive storage pools, and
+// topologies being started concurrently on the same hosts aren't considered.
+func (r *Runner) PruneImages(ctx context.Context, dryRun bool) (pruned []Image, err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("libvirt.(*Runner).PruneImages: %w", err)
+		}
+	}()
+	states, err := r.loadStates()
+	if err != nil {
+		return nil, err
+	}
+	var kept []Image
+	for _, h := range r.imageHosts() {
+		conn, err := libvirt.NewConnect(h.URI)
+		if err != nil {
+			return nil, err
+		}
+		all, err := hostImages(conn, &h, states)
+		var imgs []Image
+		if err == nil {
+			imgs = unusedImages(all)
+			if !dryRun {
+				imgs, err = deleteImages(conn, &h, imgs)
+			}
+		}
+		conn.Close()
+		pruned = append(pruned, imgs...)
+		if err != nil {
+			return pruned, err
+		}
+		for _, img := range all {
+			if len(img.UsedBy) != 0 {
+				kept = append(kept, img)
+			}
+		}
+	}
+	if !dryRun {
+		if err := r.pruneImageCache(pruned, kept); err != nil {
+			return pruned, err
+		}
+	}
+	return pruned, nil
+}
+
+// PruneImageCache removes the image cache entries (see fetchBaseImage) of the
+// pruned images, keeping those of images still kept on any host.
+func (r *Runner) pruneImageCache(pruned, kept []Image) error {
+	keep := make(map[string]bool)
+	for _, img := range kept {
+		keep[img.Volume] = true
+	}
+	for _, img := range pruned {
+		if keep[img.Volume] || !isBaseVolume(img.Volume) {
+			continue
+		}
+		dir := filepath.Join(r.imageCache,
+			strings.TrimPrefix(img.Volume, baseVolumePrefix))
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteImages deletes imgs, along with their metadata, from the storage pool
+// of h and returns those that were deleted.
+func deleteImages(conn *libvirt.Connect, h *Host, imgs []Image) (deleted []Image, err error) {
+	pool, err := conn.LookupStoragePoolByName(h.Pool)
+	if err != nil {
+		return nil, err
+	}
+	defer pool.Free()
+	for _, img := range imgs {
+		vol, err := pool.LookupStorageVolByName(img.Volume)
+		if err != nil {
+			return deleted, err
+		}
+		err = vol.Delete(0)
+		vol.Free()
+		if err != nil {
+			return deleted, fmt.Errorf("vol-delete %s: %w", img.Volume, err)
+		}
+		deleted = append(deleted, img)
+		// The metadata may be missing, see imageMeta.
+		meta, err := pool.LookupStorageVolByName(img.Volume + ".meta")
+		if err != nil {
+			continue
+		}
+		err = meta.Delete(0)
+		meta.Free()
+		if err != nil {
+			return deleted, fmt.Errorf("vol-delete %s.meta: %w", img.Volume, err)
+		}
+	}
+	return deleted, nil
+}
+
+func unusedImages(imgs []Image) []Image {
+	var unused []Image
+	for _, img := range imgs {
+		if len(img.UsedBy) == 0 {
+			unused = append(unused, img)
+		}
+	}
+	return unused
+}
+
+// ImageHosts returns the hosts whose storage pools hold base images.
+func (r *Runner) imageHosts() []Host {
+	if len(r.hosts) == 0 {
+		return []Host{{URI: r.uri, Pool: r.storagePool}}
+	}
+	return r.hosts
+}
+
+// LoadStates reads all state files in the state directory, if any.
+func (r *Runner) loadStates() ([]*State, error) {
+	if r.stateDir == "" {
+		return nil, nil
+	}
+	files, err := filepath.Glob(StateFile(r.stateDir, "*"))
+	if err != nil {
+		return nil, err
+	}
+	var states []*State
+	for _, file := range files {
+		prefix := strings.TrimSuffix(filepath.Base(file), StateFile("", ""))
+		s, err := LoadState(r.stateDir, prefix)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		if s != nil {
+			states = append(states, s)
+		}
+	}
+	return states, nil
+}
+
+// HostImages returns the base images in the storage pool of h along with
+// their users, see Images.
+func hostImages(conn *libvirt.Connect, h *Host, states []*State) (images []Image, err error) {
+	pool, err := conn.LookupStoragePoolByName(h.Pool)
+	if err != nil {
+		return nil, err
+	}
+	defer pool.Free()
+	bases, err := listBaseImages(conn, pool)
+	if err != nil {
+		return nil, err
+	}
+	refs, inactive, err := backingRefs(conn)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range bases {
+		img := Image{
+			Host:   h.Name,
+			URI:    h.URI,
+			Pool:   h.Pool,
+			Volume: b.Volume,
+			Size:   b.Size,
+			UsedBy: volumeUsers(refs[b.Path], h.URI, states),
+		}
+		for _, name := range inactive {
+			img.UsedBy = append(img.UsedBy, "pool:"+name)
+		}
+		if m := b.Meta; m != nil {
+			fetched := m.Fetched
+			img.Source, img.Digest, img.Fetched = m.Source, m.Digest, &fetched
+		}
+		images = append(images, img)
+	}
+	return images, nil
+}
+
+// A volumeRef identifies a volume within the storage pools of a host.
+type volumeRef struct {
+	pool, name string
+}
+
+// BackingRefs returns the volumes in the active storage pools of conn that
+// have a backing store, keyed by the backing store's path, and the names of
+// the inactive pools, whose volumes can't be listed.
+func backingRefs(conn *libvirt.Connect) (refs map[string][]volumeRef, inactive []string, err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("backingRefs: %w", err)
+		}
+	}()
+	pools, err := conn.ListAllStoragePools(0)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		for _, p := range pools {
+			p.Free()
+		}
+	}()
+	refs = make(map[string][]volumeRef)
+	for _, p := range pools {
+		poolName, err := p.GetName()
+		if err != nil {
+			return nil, nil, err
+		}
+		active, err := p.IsActive()
+		if err != nil {
+			return nil, nil, err
+		}
+		if !active {
+			inactive = append(inactive, poolName)
+			continue
+		}
+		vols, err := p.ListAllStorageVolumes(0)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, v := range vols {
+			if err == nil {
+				var name, path string
+				name, path, err = backingPath(&v)
+				if path != "" {
+					refs[path] = append(refs[path],
+						volumeRef{pool: poolName, name: name})
+				}
+			}
+			v.Free()
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	sort.Strings(inactive)
+	return refs, inactive, nil
+}
+
+// BackingPath returns the name of vol and the path of its backing store, if
+// any.
+func backingPath(vol *libvirt.StorageVol) (name, path string, err error) {
+	name, err = vol.GetName()
+	if err != nil {
+		return "", "", err
+	}
+	xmlStr, err := vol.GetXMLDesc(0)
+	if err != nil {
+		return "", "", err
+	}
+	xmlVol := new(libvirtxml.StorageVolume)
+	if err := xmlVol.Unmarshal(xmlStr); err != nil {
+		return "", "", err
+	}
+	if bs := xmlVol.BackingStore; bs != nil {
+		path = bs.Path
+	}
+	return name, path, nil
+}
+
+// VolumeUsers returns the name prefixes of the topologies in states owning
+// the volumes refs on the host with the given URI, or the volume name for
+// volumes not in any of them.
+func volumeUsers(refs []volumeRef, uri string, states []*State) []string {
+	seen := make(map[string]bool)
+	var users []string
+	for _, ref := range refs {
+		user := ref.name
+		for _, s := range states {
+			for _, d := range s.Devices {
+				u, p := s.location(&d)
+				if u == uri && p == ref.pool && d.Volume == ref.name {
+					user = s.NamePrefix
+				}
+			}
+		}
+		if !seen[user] {
+			seen[user] = true
+			users = append(users, user)
+		}
+	}
+	sort.Strings(users)
+	return users
+}
@@ -3,7 +3,12 @@ package libvirt
 import (
 	"bytes"
 	"context"
+	"errors"
+	"io/fs"
+	"net"
+	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 	"text/template"
@@ -95,6 +100,52 @@ func TestDnsmasqHostsFile(t *testing.T) {
 	}
 }
 
+func TestDnsmasqHostsFileDualStack(t *testing.T) {
+	const G = `graph G {
+		"oob-mgmt-server" [function="oob-server" mgmt_ip="192.168.200.254/24" mgmt_ip6="fd00:200::fe/64"]
+		"leaf0" [function=leaf]
+		"host0" [function=host mgmt_ip6="fd00:200::10"]
+		"leaf0":swp1 -- "host0":eth1
+	}`
+	topo, err := topology.Parse([]byte(G), topology.WithAutoMgmtNetwork)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRunner()
+	if err := r.buildInventory(topo); err != nil {
+		t.Fatal(err)
+	}
+	hosts := gatherHosts(context.Background(), r, topo)
+	content := string(generateDnsmasqHostsFile(hosts))
+	for _, l := range strings.Split(strings.TrimSpace(content), "\n") {
+		xs := strings.Split(l, ",")
+		if len(xs) != 4 || !strings.HasPrefix(xs[2], "[fd00:200::") {
+			t.Errorf("line invalid: %q", l)
+		}
+	}
+	if !strings.Contains(content, ",[fd00:200::10],host0\n") {
+		t.Errorf("missing reservation for host0:\n%s", content)
+	}
+
+	srv := r.devices["oob-mgmt-server"]
+	cmds := string(commandsForFunction(srv))
+	for _, w := range []string{
+		`IPADDR=192.168.200.254`,
+		`IPV6ADDR=fd00:200::fe/64`,
+		`dhcp-range=192.168.200.0,static`,
+		`dhcp-range=fd00:200::,static,64`,
+		`net.ipv4.ip_forward=1`,
+		`net.ipv6.conf.all.forwarding=1`,
+		`table inet nat`,
+	} {
+		if !strings.Contains(cmds, w) {
+			t.Errorf("missing %q in oob-mgmt-server commands:\n%s",
+				w, cmds)
+		}
+	}
+}
+
 func TestDomainPXEBoot(t *testing.T) {
 	topo, err := topology.ParseFile("testdata/pxehost.dot")
 	if err != nil {
@@ -139,3 +190,792 @@ func TestDomainPXEBoot(t *testing.T) {
 		t.Fatalf("domain %s: no interface configured for booting", d.name)
 	}
 }
+
+func TestStartSequence(t *testing.T) {
+	const G = `graph G {
+		subgraph cluster_pod1 { "leaf0" [function=leaf] "host0" [function=host] }
+		subgraph cluster_pod2 { "leaf1" [function=leaf] "host1" [function=host] }
+		"spine0" [function=spine]
+		"leaf0":swp1 -- "spine0":swp1
+		"leaf1":swp1 -- "spine0":swp2
+		"leaf0":swp2 -- "host0":eth1
+		"leaf1":swp2 -- "host1":eth1
+	}`
+	topo, err := topology.Parse([]byte(G), topology.WithAutoMgmtNetwork)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		opts []RunnerOption
+		want string
+	}{{
+		want: "oob-mgmt-server oob-mgmt-switch spine0 leaf0 leaf1 host0 host1",
+	}, {
+		opts: []RunnerOption{WithStartOrder("pod2", "pod1")},
+		want: "leaf1 host1 leaf0 host0 oob-mgmt-server oob-mgmt-switch spine0",
+	}, {
+		opts: []RunnerOption{WithStartOnly("pod1")},
+		want: "oob-mgmt-server oob-mgmt-switch leaf0 host0",
+	}} {
+		var names []string
+		for _, d := range NewRunner(test.opts...).startSequence(topo) {
+			names = append(names, d.Name)
+		}
+		if got := strings.Join(names, " "); got != test.want {
+			t.Errorf("got start sequence %q, want %q", got, test.want)
+		}
+	}
+
+	var buf bytes.Buffer
+	r := NewRunner(WriteInventory(&buf))
+	if err := r.writeInventory(context.Background(), topo); err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range []string{
+		"[pod1]\nhost0\nleaf0\n",
+		"[pod2]\nhost1\nleaf1\n",
+		"[leaf]\nleaf0\nleaf1\n",
+		"[oob_server]\noob-mgmt-server\n",
+	} {
+		if !strings.Contains(buf.String(), w) {
+			t.Errorf("inventory lacks %q:\n%s", w, buf.String())
+		}
+	}
+}
+
+func TestFabricConfig(t *testing.T) {
+	const G = `graph G {
+		"spine0" [function=spine]
+		"leaf0" [function=leaf]
+		"leaf1" [function=leaf bgp_asn=4200000001]
+		"host0" [function=host]
+		"leaf0":swp1 -- "spine0":swp1
+		"leaf1":swp1 -- "spine0":swp2
+		"leaf0":swp2 -- "host0":eth1
+	}`
+	opts := []topology.Option{
+		topology.WithAutoMgmtNetwork,
+		topology.WithLinkAddressPool("10.1.0.0/24"),
+		topology.WithLoopbackPool("10.0.0.0/24"),
+	}
+	topo, err := topology.Parse([]byte(G), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := func(files []fabricFile, path string) string {
+		for _, f := range files {
+			if f.path == path {
+				return string(f.content)
+			}
+		}
+		return ""
+	}
+	for _, test := range []struct {
+		mode         FabricMode
+		device, path string
+		want         []string
+	}{
+		{FabricUnnumbered, "leaf0", "/etc/frr/frr.conf", []string{
+			"router bgp 65301\n",
+			" bgp router-id 10.0.0.2\n",
+			" neighbor swp1 interface peer-group fabric\n",
+		}},
+		{FabricUnnumbered, "leaf1", "/etc/frr/frr.conf", []string{
+			"router bgp 4200000001\n",
+		}},
+		{FabricUnnumbered, "spine0", "/etc/frr/frr.conf", []string{
+			"router bgp 65100\n",
+			" neighbor swp2 interface peer-group fabric\n",
+		}},
+		{FabricUnnumbered, "leaf0", "/etc/network/interfaces.d/fabric.intf", []string{
+			"iface lo inet loopback\n    address 10.0.0.2/32\n",
+			"\nauto swp1\niface swp1\n\n",
+			"iface swp2\n    address 10.1.0.1/31\n",
+		}},
+		{FabricNumbered, "spine0", "/etc/frr/frr.conf", []string{
+			" neighbor 10.1.0.2 peer-group fabric\n",
+			" neighbor 10.1.0.4 peer-group fabric\n",
+		}},
+		{FabricNumbered, "spine0", "/etc/network/interfaces.d/fabric.intf", []string{
+			"iface swp1\n    address 10.1.0.3/31\n",
+		}},
+		{FabricNumbered, "host0", "/etc/systemd/network/50-runtopo-eth1.network", []string{
+			"Name=eth1\n",
+			"Address=10.1.0.0/31\nGateway=10.1.0.1\n",
+		}},
+	} {
+		files, err := fabricConfig(topo, test.mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := content(files[test.device], test.path)
+		for _, w := range test.want {
+			if !strings.Contains(got, w) {
+				t.Errorf("%s:%s lacks %q:\n%s",
+					test.device, test.path, w, got)
+			}
+		}
+	}
+
+	files, err := fabricConfig(topo, FabricUnnumbered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fs := files["oob-mgmt-server"]; fs != nil {
+		t.Errorf("got fabric config for oob-mgmt-server: %v", fs)
+	}
+	if got := content(files["leaf0"], "/etc/network/interfaces.d/fabric.intf"); strings.Contains(got, "eth0") {
+		t.Errorf("fabric config touches management interface:\n%s", got)
+	}
+
+	topo, err = topology.Parse([]byte(G))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fabricConfig(topo, FabricNumbered); err == nil {
+		t.Error("numbered fabric without address plan succeeded")
+	}
+}
+
+func TestCheckCabling(t *testing.T) {
+	const G = `graph G {
+		"spine0" [function=spine os="http://example.org/cl.qcow2"]
+		"leaf0" [function=leaf os="http://example.org/cl.qcow2"]
+		"leaf1" [function=leaf os="http://example.org/cl.qcow2"]
+		"host0" [function=fake]
+		"leaf0":swp1 -- "spine0":swp1
+		"leaf1":swp1 -- "spine0":swp2
+		"leaf0":swp2 -- "leaf1":swp2
+		"leaf0":swp3 -- "host0":eth1
+		"leaf0":swp4 -- "spine0":swp4
+		"mgmt" [function=fake]
+		"spine0":eth0 -- "mgmt":swp1
+		"leaf0":eth0 -- "mgmt":swp2
+		"leaf1":eth0 -- "mgmt":swp3
+	}`
+	topo, err := topology.Parse([]byte(G))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	neighbors := map[string]map[string]lldpNeighbor{
+		"spine0": parseLLDPKeyValue([]byte(
+			"lldp.swp1.via=LLDP\n" +
+				"lldp.swp1.chassis.name=leaf0.example.org\n" +
+				"lldp.swp1.port.ifname=swp1\n" +
+				"lldp.swp2.chassis.name=leaf1\n" +
+				"lldp.swp2.port.local=swp3\n")),
+		"leaf0": parseLLDPKeyValue([]byte(
+			"lldp.swp1.chassis.name=spine0\n" +
+				"lldp.swp1.port.ifname=swp1\n" +
+				"lldp.swp2.chassis.name=spine0\n" +
+				"lldp.swp2.port.ifname=swp9\n")),
+	}
+	errs := map[string]error{
+		"leaf1": errors.New("connection refused"),
+	}
+
+	var got []string
+	for _, c := range checkCabling(topo, neighbors, errs) {
+		got = append(got, c.String())
+	}
+	want := []string{
+		"leaf0:swp1: ok (want spine0:swp1, got spine0:swp1)",
+		"leaf0:swp2: wrong neighbor (want leaf1:swp2, got spine0:swp9)",
+		"leaf0:swp4: missing neighbor (want spine0:swp4)",
+		"leaf1:swp1: unreachable (want spine0:swp2, connection refused)",
+		"leaf1:swp2: unreachable (want leaf0:swp2, connection refused)",
+		"spine0:swp1: ok (want leaf0:swp1, got leaf0:swp1)",
+		"spine0:swp2: wrong port (want leaf1:swp1, got leaf1:swp3)",
+		"spine0:swp4: missing neighbor (want leaf0:swp4)",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got checks\n%s\nwant\n%s",
+			strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestCheckCablingMgmtSwitches(t *testing.T) {
+	const G = `graph G {
+		"spine0" [function=spine]
+		"leaf0" [function=leaf]
+		"leaf1" [function=leaf]
+		"leaf0":swp1 -- "spine0":swp1
+		"leaf1":swp1 -- "spine0":swp2
+	}`
+	topo, err := topology.Parse([]byte(G), topology.WithAutoMgmtNetwork,
+		topology.WithMgmtSwitchPorts(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, d := range verifiableDevices(topo) {
+		names = append(names, d.Name)
+	}
+	want := "leaf0 leaf1 oob-mgmt-server oob-mgmt-switch spine0"
+	if got := strings.Join(names, " "); got != want {
+		t.Errorf("got verifiable devices %s, want %s", got, want)
+	}
+
+	// Everything answers except the generated switches, which can't be
+	// logged into.
+	neighbors := make(map[string]map[string]lldpNeighbor)
+	for _, l := range topo.Links() {
+		if l.To == "" {
+			continue
+		}
+		for _, e := range [][4]string{
+			{l.From, l.FromPort, l.To, l.ToPort},
+			{l.To, l.ToPort, l.From, l.FromPort},
+		} {
+			if strings.HasPrefix(e[0], "oob-mgmt-switch-") {
+				continue
+			}
+			if neighbors[e[0]] == nil {
+				neighbors[e[0]] = make(map[string]lldpNeighbor)
+			}
+			neighbors[e[0]][e[1]] = lldpNeighbor{e[2], e[3]}
+		}
+	}
+	checks := checkCabling(topo, neighbors, nil)
+	if len(checks) == 0 {
+		t.Fatal("got no checks")
+	}
+	for _, c := range checks {
+		if c.Status != LinkOK {
+			t.Errorf("got %v", &c)
+		}
+	}
+}
+
+func TestState(t *testing.T) {
+	const G = `graph G {
+		"leaf0" [function=leaf bmc=1]
+		"host0" [function=host]
+		"leaf0":swp1 -- "host0":eth1
+		"default" [function=fake]
+		"leaf0":swp2 -- "default":eth0 [libvirt_type=network]
+	}`
+	topo, err := topology.Parse([]byte(G), topology.WithAutoMgmtNetwork)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	r := NewRunner(WithNamePrefix("lab1-"), WithStateDir(dir))
+	if err := r.buildInventory(topo); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.writeState(r.state(topo)); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(StateFile(dir, "lab1-"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0o600 {
+		t.Errorf("got state file mode %v, want 0600", perm)
+	}
+	s, err := LoadState(dir, "lab1-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.URI != "qemu:///system" || s.NamePrefix != "lab1-" || s.Pool != "default" {
+		t.Errorf("got uri=%q prefix=%q pool=%q", s.URI, s.NamePrefix, s.Pool)
+	}
+	var names []string
+	for _, d := range s.Devices {
+		names = append(names, d.Domain)
+	}
+	want := "lab1-host0 lab1-leaf0 lab1-oob-mgmt-server lab1-oob-mgmt-switch"
+	if got := strings.Join(names, " "); got != want {
+		t.Errorf("got domains %q, want %q", got, want)
+	}
+	leaf0 := s.Devices[1]
+	if leaf0.BMC == nil || leaf0.BMC.Password == "" {
+		t.Errorf("leaf0: got BMC %+v, want one with password", leaf0.BMC)
+	}
+	var ifaces []string
+	for _, intf := range leaf0.Interfaces {
+		ifaces = append(ifaces, intf.Name+"/"+intf.Network)
+		if intf.MAC == "" {
+			t.Errorf("leaf0: %s lacks MAC address", intf.Name)
+		}
+	}
+	if got, want := strings.Join(ifaces, " "), "eth0/ swp1/ swp2/default"; got != want {
+		t.Errorf("leaf0: got interfaces %q, want %q", got, want)
+	}
+
+	if err := r.removeState(s); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadState(dir, "lab1-"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got err=%v after removing state, want ErrNotExist", err)
+	}
+}
+
+func TestApplyChanges(t *testing.T) {
+	const G1 = `graph G {
+		"spine0" [function=spine]
+		"leaf0" [function=leaf bmc=1]
+		"leaf1" [function=leaf]
+		"host0" [function=host]
+		"leaf0":swp1 -- "spine0":swp1
+		"leaf1":swp1 -- "spine0":swp2
+		"host0":eth1 -- "leaf1":swp2
+	}`
+	// Drops host0, adds host1 and a second link between leaf0 and spine0
+	// ahead of the existing ones.
+	const G2 = `graph G {
+		"spine0" [function=spine]
+		"leaf0" [function=leaf bmc=1]
+		"leaf1" [function=leaf]
+		"host1" [function=host bmc=1]
+		"leaf0":swp2 -- "spine0":swp3
+		"leaf0":swp1 -- "spine0":swp1
+		"leaf1":swp1 -- "spine0":swp2
+		"host1":eth1 -- "leaf1":swp3
+	}`
+	ctx := context.Background()
+	inventory := func(g string, prev *State) *State {
+		topo, err := topology.Parse([]byte(g))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := NewRunner()
+		if err := r.buildInventoryFrom(topo, prev); err != nil {
+			t.Fatal(err)
+		}
+		s := r.state(topo)
+		if err := r.setDigests(ctx, topo, s); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	prev := inventory(G1, nil)
+	if changes := diffState(prev, inventory(G1, prev)); len(changes) != 0 {
+		t.Errorf("unchanged topology: got changes %v", changes)
+	}
+
+	next := inventory(G2, prev)
+	var got []string
+	for _, c := range diffState(prev, next) {
+		got = append(got, c.String())
+	}
+	want := []string{
+		"remove host0",
+		"add host1",
+		"update leaf0",
+		"update leaf1",
+		"update spine0",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got changes\n%s\nwant\n%s",
+			strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	intfs := func(s *State) map[string]StateInterface {
+		m := make(map[string]StateInterface)
+		for _, d := range s.Devices {
+			for _, intf := range d.Interfaces {
+				m[d.Name+":"+intf.Name] = intf
+			}
+		}
+		return m
+	}
+	before, after := intfs(prev), intfs(next)
+	for _, port := range []string{"leaf0:swp1", "spine0:swp1", "leaf1:swp1", "spine0:swp2"} {
+		if b, a := before[port], after[port]; !reflect.DeepEqual(a, b) {
+			t.Errorf("%s: got %+v, want unchanged %+v", port, a, b)
+		}
+	}
+	seenMACs := make(map[string]string)
+	seenPorts := make(map[uint]string)
+	for port, intf := range after {
+		if other := seenMACs[intf.MAC]; other != "" {
+			t.Errorf("%s: MAC %s already used by %s", port, intf.MAC, other)
+		}
+		seenMACs[intf.MAC] = port
+		if other := seenPorts[intf.LocalPort]; other != "" {
+			t.Errorf("%s: local port %d already used by %s",
+				port, intf.LocalPort, other)
+		}
+		seenPorts[intf.LocalPort] = port
+	}
+	if p, q := after["leaf0:swp2"], after["spine0:swp3"]; p.Port != q.LocalPort || p.LocalPort != q.Port {
+		t.Errorf("new link leaf0:swp2 -- spine0:swp3: got ports %d/%d and %d/%d",
+			p.Port, p.LocalPort, q.Port, q.LocalPort)
+	}
+
+	// Only changes to what's on the disk, or moving it, wipe it.
+	for _, test := range []struct {
+		g    string
+		want string
+	}{
+		{strings.Replace(G1, `"leaf0" [function=leaf bmc=1]`,
+			`"leaf0" [function=leaf bmc=1 memory=2048]`, 1), "redefine leaf0"},
+		{strings.Replace(G1, `"leaf0" [function=leaf bmc=1]`,
+			`"leaf0" [function=leaf]`, 1), "redefine leaf0"},
+		{strings.Replace(G1, `"leaf0" [function=leaf bmc=1]`,
+			`"leaf0" [function=leaf bmc=1 os="https://example.org/leaf.qcow2"]`, 1), "recreate leaf0"},
+		{strings.Replace(G1, `"leaf0" [function=leaf bmc=1]`,
+			`"leaf0" [function=leaf bmc=1 disk=20]`, 1), "recreate leaf0"},
+		// A new definition along with new links.
+		{strings.Replace(G1, `"leaf0":swp1 -- "spine0":swp1`,
+			`"leaf0":swp2 -- "spine0":swp1
+			"leaf0" [memory=2048]`, 1), "recreate leaf0\nupdate spine0"},
+	} {
+		var got []string
+		for _, c := range diffState(prev, inventory(test.g, prev)) {
+			got = append(got, c.String())
+		}
+		if g := strings.Join(got, "\n"); g != test.want {
+			t.Errorf("got changes\n%s\nwant\n%s\nfor\n%s", g, test.want, test.g)
+		}
+	}
+
+	bmcs := make(map[string]string)
+	for _, d := range append(prev.Devices, next.Devices...) {
+		if d.BMC != nil {
+			bmcs[d.Name] = d.BMC.Addr
+		}
+	}
+	if got, want := bmcs["leaf0"], prev.Devices[1].BMC.Addr; got != want {
+		t.Errorf("leaf0: got BMC address %s, want unchanged %s", got, want)
+	}
+	if bmcs["host1"] == bmcs["leaf0"] {
+		t.Errorf("host1: got BMC address %s in use by leaf0", bmcs["host1"])
+	}
+}
+
+func TestSetDigestsUnconnected(t *testing.T) {
+	for _, g := range []string{
+		`graph G {
+			"leaf0" [function=leaf]
+			"host0" [function=host]
+		}`,
+		`graph G {
+			"oob-mgmt-server" [function="oob-server"]
+			"oob-mgmt-switch" [function="oob-switch"]
+			"leaf0" [function=leaf]
+			"host0" [function=host]
+			"oob-mgmt-server":eth1 -- "oob-mgmt-switch":swp1
+			"leaf0":eth0 -- "oob-mgmt-switch":swp2
+		}`,
+	} {
+		topo, err := topology.Parse([]byte(g))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := NewRunner()
+		if err := r.buildInventory(topo); err != nil {
+			t.Fatal(err)
+		}
+		s := r.state(topo)
+		if err := r.setDigests(context.Background(), topo, s); err != nil {
+			t.Fatal(err)
+		}
+		for _, d := range s.Devices {
+			if d.Digest == "" {
+				t.Errorf("%s: no digest", d.Name)
+			}
+		}
+	}
+}
+
+func TestApplyChangesAutoMgmt(t *testing.T) {
+	const G1 = `graph G {
+		"leaf0" [function=leaf]
+		"spine0" [function=spine]
+		"leaf0":swp1 -- "spine0":swp1
+	}`
+	ctx := context.Background()
+	inventory := func(g string, prev *State) *State {
+		var opts []topology.Option
+		if prev != nil {
+			ips := make(map[string][]string)
+			for _, d := range prev.Devices {
+				ips[d.Name] = d.MgmtIPs
+			}
+			opts = append(opts, topology.WithPreferredMgmtIPs(ips))
+		}
+		topo, err := topology.Parse([]byte(g),
+			append(opts, topology.WithAutoMgmtNetwork)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := NewRunner()
+		if err := r.buildInventoryFrom(topo, prev); err != nil {
+			t.Fatal(err)
+		}
+		s := r.state(topo)
+		if err := r.setDigests(ctx, topo, s); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	prev := inventory(G1, nil)
+	// The management devices are updated in place, not recreated.
+	tests := []struct {
+		name string
+		g    string
+		want []string
+	}{
+		{
+			name: "unchanged",
+			g:    G1,
+		},
+		{
+			name: "add leaf",
+			g: `graph G {
+				"leaf0" [function=leaf]
+				"leaf1" [function=leaf]
+				"spine0" [function=spine]
+				"leaf0":swp1 -- "spine0":swp1
+			}`,
+			want: []string{
+				"add leaf1",
+				"update oob-mgmt-server",
+				"update oob-mgmt-switch",
+			},
+		},
+		{
+			// Sorts first, shifting the management switch ports
+			// of the others.
+			name: "add host",
+			g: `graph G {
+				"leaf0" [function=leaf]
+				"spine0" [function=spine]
+				"host0" [function=host]
+				"leaf0":swp1 -- "spine0":swp1
+			}`,
+			want: []string{
+				"add host0",
+				"update oob-mgmt-server",
+				"update oob-mgmt-switch",
+			},
+		},
+		{
+			name: "remove leaf",
+			g: `graph G {
+				"spine0" [function=spine]
+			}`,
+			want: []string{
+				"remove leaf0",
+				"update oob-mgmt-server",
+				"update oob-mgmt-switch",
+				"update spine0",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, c := range diffState(prev, inventory(tt.g, prev)) {
+				got = append(got, c.String())
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("got changes\n%s\nwant\n%s",
+					strings.Join(got, "\n"),
+					strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	topo, err := topology.ParseFile("testdata/leafspine.dot", topology.WithAutoMgmtNetwork)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	r := NewRunner(WithAuthorizedKeys("ssh-ed25519 AAAA test"))
+	if err := r.DryRun(context.Background(), topo, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, d := range topo.Devices() {
+		if d.Function() == topology.Fake {
+			continue
+		}
+		p, err := os.ReadFile(filepath.Join(dir, d.Name, "domain.xml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dom := new(libvirtxml.Domain)
+		if err := dom.Unmarshal(string(p)); err != nil {
+			t.Errorf("%s: domain.xml: %v", d.Name, err)
+		} else if want := "runtopo-" + d.Name; dom.Name != want {
+			t.Errorf("%s: got domain name %s, want %s", d.Name, dom.Name, want)
+		}
+		p, err = os.ReadFile(filepath.Join(dir, d.Name, "volume.xml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		vol := new(libvirtxml.StorageVolume)
+		if err := vol.Unmarshal(string(p)); err != nil {
+			t.Errorf("%s: volume.xml: %v", d.Name, err)
+		}
+		if d.OSImage() == "" {
+			continue
+		}
+		p, err = os.ReadFile(filepath.Join(dir, d.Name, "customize.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(p, []byte("ssh-inject root:string:ssh-ed25519 AAAA test\n")) {
+			t.Errorf("%s: customize.txt lacks authorized key:\n%s", d.Name, p)
+		}
+	}
+
+	for _, file := range []string{"dnsmasq.hostsfile", "allocations.txt"} {
+		if _, err := os.Stat(filepath.Join(dir, file)); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestPlaceDevices(t *testing.T) {
+	const G = `graph G {
+		"spine0" [function=spine memory=4096]
+		"leaf0" [function=leaf host=hv2]
+		"leaf1" [function=leaf]
+		"leaf0":swp1 -- "spine0":swp1
+		"leaf1":swp1 -- "spine0":swp2
+	}`
+	topo, err := topology.Parse([]byte(G), topology.WithAutoMgmtNetwork)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := []Host{{
+		Name:     "hv1",
+		URI:      "qemu+ssh://hv1/system",
+		TunnelIP: net.ParseIP("192.0.2.1"),
+		Memory:   8 << 30,
+	}, {
+		Name:     "hv2",
+		URI:      "qemu+ssh://hv2/system",
+		TunnelIP: net.ParseIP("192.0.2.2"),
+		Pool:     "lab",
+	}}
+	r := NewRunner(WithHosts(hosts...))
+	if err := r.buildInventory(topo); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"oob-mgmt-server": "hv1",
+		"oob-mgmt-switch": "hv1",
+		"leaf0":           "hv2", // host attribute
+		"spine0":          "hv2", // largest device, least loaded host
+		"leaf1":           "hv1",
+	}
+	for name, host := range want {
+		if got := r.devices[name].host.Name; got != host {
+			t.Errorf("%s: got host %s, want %s", name, got, host)
+		}
+	}
+	if got := r.devices["spine0"].pool; got != "lab" {
+		t.Errorf("spine0: got pool %s, want lab", got)
+	}
+	leaf1 := r.devices["leaf1"]
+	if got := leaf1.tunnelIP.String(); got != "192.0.2.1" {
+		t.Errorf("leaf1: got tunnel IP %s, want 192.0.2.1", got)
+	}
+	for _, intf := range leaf1.interfaces {
+		if intf.name != "swp1" {
+			continue
+		}
+		if got := intf.remoteTunnelIP.String(); got != "192.0.2.2" {
+			t.Errorf("leaf1:swp1: got remote tunnel IP %s, want 192.0.2.2", got)
+		}
+	}
+
+	s := r.state(topo)
+	for _, d := range s.Devices {
+		uri, pool := s.location(&d)
+		if d.Name == "spine0" && (uri != "qemu+ssh://hv2/system" || pool != "lab") {
+			t.Errorf("spine0: got uri=%s pool=%s", uri, pool)
+		}
+		if d.Name == "leaf1" && (uri != "qemu+ssh://hv1/system" || pool != "default") {
+			t.Errorf("leaf1: got uri=%s pool=%s", uri, pool)
+		}
+	}
+
+	// Devices stay on their previous host if it has room.
+	for i := range s.Devices {
+		if s.Devices[i].Name == "leaf1" {
+			s.Devices[i].Host = "hv2"
+		}
+	}
+	placement, err := NewRunner(WithHosts(hosts...)).placeDevices(topo, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := placement["leaf1"].Name; got != "hv2" {
+		t.Errorf("leaf1: got host %s after move, want hv2", got)
+	}
+
+	for _, test := range []struct {
+		hosts []Host
+		want  string
+	}{{
+		hosts: hosts[:1],
+		want:  "unknown host hv2",
+	}, {
+		hosts: []Host{{Name: "hv1", URI: "qemu:///system"}, {Name: "hv2", URI: "qemu:///system"}},
+		want:  "no tunnel IP",
+	}, {
+		hosts: []Host{
+			{Name: "hv1", URI: "qemu:///system", TunnelIP: hosts[0].TunnelIP, Memory: 4 << 30},
+			{Name: "hv2", URI: "qemu:///system", TunnelIP: hosts[1].TunnelIP, CPUs: 1},
+		},
+		want: "device spine0: no host with enough capacity",
+	}} {
+		_, err := NewRunner(WithHosts(test.hosts...)).placeDevices(topo, nil)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("got err=%v, want %q", err, test.want)
+		}
+	}
+}
+
+func TestLoadHosts(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "hosts.yaml")
+	doc := `
+- name: hv1
+  uri: qemu:///system
+  tunnel_ip: 192.0.2.1
+  cpus: 32
+  memory: 128GiB
+- name: hv2
+  uri: qemu+ssh://root@hv2.example.org/system
+  tunnel_ip: 192.0.2.2
+  memory: 1024
+  pool: images
+`
+	if err := os.WriteFile(file, []byte(doc), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	hosts, err := LoadHosts(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Host{{
+		Name:     "hv1",
+		URI:      "qemu:///system",
+		TunnelIP: net.ParseIP("192.0.2.1"),
+		CPUs:     32,
+		Memory:   128 << 30,
+	}, {
+		Name:     "hv2",
+		URI:      "qemu+ssh://root@hv2.example.org/system",
+		TunnelIP: net.ParseIP("192.0.2.2"),
+		Pool:     "images",
+		Memory:   1 << 30,
+	}}
+	if !reflect.DeepEqual(hosts, want) {
+		t.Errorf("got hosts %+v, want %+v", hosts, want)
+	}
+}
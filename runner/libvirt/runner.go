@@ -5,16 +5,18 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"net"
-	"net/url"
-	"path"
+	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 	"text/template"
 
+	"golang.org/x/crypto/ssh"
 	"libvirt.org/libvirt-go"
 	libvirtxml "libvirt.org/libvirt-go-xml"
 	"slrz.net/runtopo/topology"
@@ -22,15 +24,18 @@ import (
 
 // Runner implements the topology.Runner interface using libvirt/qemu.
 type Runner struct {
-	conn         *libvirt.Connect
+	conns        map[string]*libvirt.Connect // by host URI
 	devices      map[string]*device
 	domains      map[string]*libvirt.Domain
-	baseImages   map[string]*libvirt.StorageVol
+	baseImages   map[imageKey]*libvirt.StorageVol
 	sshConfigOut io.Writer
 	bmcConfigOut io.Writer
+	inventoryOut io.Writer
 	configFS     fs.FS
 	bmcMan       *bmcMan
 	bmcs         []hostBMC
+	targets      map[string]bool // devices (re)created by Apply, nil for all
+	keepDisks    map[string]bool // targets redefined by Apply, keeping their volume
 
 	// fields below are immutable after initialization
 	uri            string // libvirt connection URI
@@ -42,6 +47,14 @@ type Runner struct {
 	storagePool    string
 	authorizedKeys []string
 	bmcAddr        string
+	startOrder     []string // groups to start first, in order
+	startOnly      []string // if non-empty, start only these groups
+	fabricMode     FabricMode
+	sshAuth        []ssh.AuthMethod
+	stateDir       string
+	hosts          []Host
+	imageCache     string // directory for downloaded base images
+	imageDir       string // local base images, used instead of downloading
 }
 
 // A RunnerOption may be passed to NewRunner to customize the Runner's
@@ -128,6 +141,34 @@ func WriteBMCConfig(w io.Writer) RunnerOption {
 	}
 }
 
+// WriteInventory configures the Runner to write an Ansible inventory in INI
+// format to w. Devices are listed in a section per topology group and
+// function.
+func WriteInventory(w io.Writer) RunnerOption {
+	return func(r *Runner) {
+		r.inventoryOut = w
+	}
+}
+
+// WithStartOrder makes the Runner start devices belonging to the named
+// topology groups first, one group after another in the given order. Devices
+// not in any of the groups are started last. Within each batch, devices are
+// started in the usual order (management devices first, then by function).
+func WithStartOrder(groups ...string) RunnerOption {
+	return func(r *Runner) {
+		r.startOrder = groups
+	}
+}
+
+// WithStartOnly restricts the set of started devices to members of the named
+// topology groups, plus the management server and switches. All devices are
+// still created, allowing the remaining ones to be started later.
+func WithStartOnly(groups ...string) RunnerOption {
+	return func(r *Runner) {
+		r.startOnly = groups
+	}
+}
+
 // WithBMCAddr specifies the address for any created virtual BMCs to bind to.
 func WithBMCAddr(a string) RunnerOption {
 	return func(r *Runner) {
@@ -157,6 +198,7 @@ func NewRunner(opts ...RunnerOption) *Runner {
 		portBase:    1e4,
 		portGap:     1e3,
 		storagePool: "default",
+		imageCache:  defaultImageCache(),
 		devices:     make(map[string]*device),
 		domains:     make(map[string]*libvirt.Domain),
 	}
@@ -164,6 +206,11 @@ func NewRunner(opts ...RunnerOption) *Runner {
 	for _, opt := range opts {
 		opt(r)
 	}
+	for i := range r.hosts {
+		if r.hosts[i].Pool == "" {
+			r.hosts[i].Pool = r.storagePool
+		}
+	}
 
 	bmcConf := &bmcConfig{
 		connect: r.uri,
@@ -174,9 +221,15 @@ func NewRunner(opts ...RunnerOption) *Runner {
 	return r
 }
 
-// Run starts up the topology described by t.
+// Run starts up the topology described by t. On failure, the created
+// resources are removed again. The state file is kept if that fails too.
 func (r *Runner) Run(ctx context.Context, t *topology.T) (err error) {
+	// First error encountered while undoing a failed Run.
+	var rollbackErr error
 	defer func() {
+		if rollbackErr != nil {
+			err = fmt.Errorf("%w (cleanup: %v)", err, rollbackErr)
+		}
 		if err != nil {
 			err = fmt.Errorf("libvirt.(*Runner).Run: %w", err)
 		}
@@ -188,16 +241,16 @@ func (r *Runner) Run(ctx context.Context, t *topology.T) (err error) {
 	if err := r.buildInventory(t); err != nil {
 		return err
 	}
+	if err := r.checkGroups(t); err != nil {
+		return err
+	}
 
-	c, err := libvirt.NewConnect(r.uri)
-	if err != nil {
+	if err := r.connect(); err != nil {
 		return err
 	}
-	r.conn = c
 	defer func() {
 		if err != nil {
-			c.Close()
-			r.conn = nil
+			r.disconnect()
 		}
 	}()
 
@@ -212,12 +265,35 @@ func (r *Runner) Run(ctx context.Context, t *topology.T) (err error) {
 			r.baseImages = nil
 		}
 	}()
+	var s *State
+	if r.stateDir != "" {
+		// Record the resources before creating them, allowing for
+		// cleanup even if we get interrupted.
+		file := StateFile(r.stateDir, r.namePrefix)
+		if _, err := os.Stat(file); err == nil {
+			return fmt.Errorf("state file %s exists, "+
+				"destroy the running topology first", file)
+		}
+		s = r.state(t)
+		if err := r.writeState(s); err != nil {
+			return err
+		}
+		defer func() {
+			// Keep the state around for DestroyState if we
+			// failed to clean up after ourselves.
+			if err != nil && rollbackErr == nil {
+				r.removeState(s)
+			}
+		}()
+	}
 	if err := r.createVolumes(ctx, t); err != nil {
 		return err
 	}
 	defer func() {
 		if err != nil {
-			r.deleteVolumes(ctx, t)
+			if err := r.deleteVolumes(ctx, t); err != nil && rollbackErr == nil {
+				rollbackErr = err
+			}
 		}
 	}()
 
@@ -226,7 +302,9 @@ func (r *Runner) Run(ctx context.Context, t *topology.T) (err error) {
 	}
 	defer func() {
 		if err != nil {
-			r.undefineDomains(ctx, t)
+			if err := r.undefineDomains(ctx, t); err != nil && rollbackErr == nil {
+				rollbackErr = err
+			}
 			for _, d := range r.domains {
 				d.Free()
 			}
@@ -239,7 +317,22 @@ func (r *Runner) Run(ctx context.Context, t *topology.T) (err error) {
 	if err := r.startDomains(ctx, t); err != nil {
 		return err
 	}
+	if s != nil {
+		// Everything's set up, allow Apply to skip the devices.
+		if err := r.setDigests(ctx, t, s); err != nil {
+			return err
+		}
+		if err := r.writeState(s); err != nil {
+			return err
+		}
+	}
 
+	return r.writeOutputs(ctx, t)
+}
+
+// WriteOutputs writes the files requested using WriteSSHConfig,
+// WriteBMCConfig and WriteInventory.
+func (r *Runner) writeOutputs(ctx context.Context, t *topology.T) error {
 	if r.sshConfigOut != nil {
 		// Caller asked us to write out an ssh_config.
 		if err := r.writeSSHConfig(ctx, t); err != nil {
@@ -252,45 +345,66 @@ func (r *Runner) Run(ctx context.Context, t *topology.T) (err error) {
 			return err
 		}
 	}
+	if r.inventoryOut != nil {
+		if err := r.writeInventory(ctx, t); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
-// Destroy destroys any resources created by a previous Run invocation. Destroy
-// may be called on a different Runner instance than Run as long as the
-// instance was created using the same same of RunnerOptions.
+// CheckGroups verifies that the groups passed to WithStartOrder and
+// WithStartOnly exist in t.
+func (r *Runner) checkGroups(t *topology.T) error {
+	groups := make(map[string]bool)
+	for _, g := range t.Groups() {
+		groups[g.Name] = true
+	}
+	for _, g := range append(r.startOrder, r.startOnly...) {
+		if !groups[g] {
+			return fmt.Errorf("unknown group %q", g)
+		}
+	}
+	return nil
+}
+
+// Destroy destroys any resources created by a previous Run invocation. If the
+// Runner was configured using WithStateDir and a state file exists, the
+// resources recorded there are destroyed and t is not consulted. Otherwise,
+// Destroy may be called on a different Runner instance than Run as long as the
+// instance was created using the same set of RunnerOptions.
 func (r *Runner) Destroy(ctx context.Context, t *topology.T) (err error) {
 	defer func() {
 		if err != nil {
 			err = fmt.Errorf("libvirt.(*Runner).Destroy: %w", err)
 		}
 	}()
-	if err := r.buildInventory(t); err != nil {
-		return err
-	}
 
-	if r.conn == nil {
-		c, err := libvirt.NewConnect(r.uri)
-		if err != nil {
+	var s *State
+	if r.stateDir != "" {
+		s, err = LoadState(r.stateDir, r.namePrefix)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
 			return err
 		}
-		r.conn = c
 	}
-	if err := r.bmcMan.stopAll(ctx); err != nil {
-		return fmt.Errorf("bmc-stop: %w", err)
+	if s == nil {
+		// The inventory is already there if Run was called on r.
+		if len(r.devices) == 0 {
+			if err := r.buildInventory(t); err != nil {
+				return err
+			}
+		}
+		s = r.state(t)
 	}
-
-	if err := r.undefineDomains(ctx, t); err != nil {
+	if err := r.DestroyState(ctx, s); err != nil {
 		return err
 	}
+
 	for _, d := range r.domains {
 		d.Free()
 	}
 	r.domains = nil
-
-	if err := r.deleteVolumes(ctx, t); err != nil {
-		return err
-	}
 	for _, v := range r.baseImages {
 		v.Free()
 	}
@@ -299,30 +413,84 @@ func (r *Runner) Destroy(ctx context.Context, t *topology.T) (err error) {
 	return nil
 }
 
-func (r *Runner) buildInventory(t *topology.T) (err error) {
+func (r *Runner) buildInventory(t *topology.T) error {
+	return r.buildInventoryFrom(t, nil)
+}
+
+// BuildInventoryFrom is like buildInventory but keeps the MAC addresses, UDP
+// tunnel ports and virtual BMCs recorded in prev for the interfaces, links
+// and devices that still exist in t. Fresh assignments avoid anything used in
+// prev.
+func (r *Runner) buildInventoryFrom(t *topology.T, prev *State) (err error) {
 	defer func() {
 		if err != nil {
 			err = fmt.Errorf("buildInventory: %w", err)
 		}
 	}()
 
+	prevIntfs := make(map[string]StateInterface) // keyed by device:port
+	prevBMCs := make(map[string]*StateBMC)
+	usedMACs := make(map[string]bool)
+	usedPorts := make(map[uint]bool)
+	if prev != nil {
+		for _, d := range prev.Devices {
+			for _, intf := range d.Interfaces {
+				prevIntfs[d.Name+":"+intf.Name] = intf
+				usedMACs[intf.MAC] = true
+				if intf.Network == "" {
+					usedPorts[intf.Port] = true
+					usedPorts[intf.LocalPort] = true
+				}
+			}
+			if d.BMC != nil {
+				prevBMCs[d.Name] = d.BMC
+				r.bmcMan.reserve(d.BMC.Addr)
+			}
+		}
+	}
+
 	var macInt uint64
 	for _, b := range r.macBase {
 		macInt = macInt<<8 | uint64(b)
 	}
 
 	allocateMAC := func() net.HardwareAddr {
-		mac := macAddrFromUint64(macInt)
-		macInt++
-		return mac
+		for {
+			mac := macAddrFromUint64(macInt)
+			macInt++
+			if !usedMACs[mac.String()] {
+				return mac
+			}
+		}
+	}
+	// Returns the MAC address for port, reusing the previous one unless
+	// explicitly configured.
+	portMAC := func(dev, port string, mac net.HardwareAddr, hasMAC bool) net.HardwareAddr {
+		if hasMAC {
+			return mac
+		}
+		if intf, ok := prevIntfs[dev+":"+port]; ok {
+			if mac, err := net.ParseMAC(intf.MAC); err == nil {
+				return mac
+			}
+		}
+		return allocateMAC()
 	}
 
+	placement, err := r.placeDevices(t, prev)
+	if err != nil {
+		return err
+	}
 	for _, topoDev := range t.Devices() {
 		if topoDev.Function() == topology.Fake {
 			continue
 		}
 
+		host := placement[topoDev.Name]
 		tunnelIP := r.tunnelIP
+		if host.TunnelIP != nil {
+			tunnelIP = host.TunnelIP
+		}
 		if s := topoDev.Attr("tunnelip"); s != "" {
 			if tunnelIP = net.ParseIP(s); tunnelIP == nil {
 				return fmt.Errorf(
@@ -342,11 +510,14 @@ func (r *Runner) buildInventory(t *topology.T) (err error) {
 		}
 		devName := r.namePrefix + topoDev.Name
 		if topoDev.Attr("bmc") != "" {
-			bmc, err := r.bmcMan.add(devName)
-			if err != nil {
+			var bmc *bmc
+			if b := prevBMCs[topoDev.Name]; b != nil {
+				bmc = r.bmcMan.restore(devName, b.Addr, b.User, b.Password)
+			} else if bmc, err = r.bmcMan.add(devName); err != nil {
 				return fmt.Errorf("device %s: %w",
 					topoDev.Name, err)
 			}
+			bmc.uri = host.URI
 			r.bmcs = append(r.bmcs, hostBMC{
 				Name: topoDev.Name,
 				BMC:  bmc,
@@ -355,21 +526,58 @@ func (r *Runner) buildInventory(t *topology.T) (err error) {
 
 		r.devices[topoDev.Name] = &device{
 			name:     devName,
+			host:     host,
 			tunnelIP: tunnelIP,
-			pool:     r.storagePool,
+			pool:     host.Pool,
 			config:   config,
 			Device:   topoDev,
 		}
 	}
+	// Returns the previous interface of dev:port if it was connected to
+	// peer:peerPort. Management switch ports are assigned in order of
+	// device names, so a device moving to another port of the same switch
+	// still counts as connected.
+	claimed := make(map[string]bool)
+	prevLink := func(dev, port, peer, peerPort string) (StateInterface, bool) {
+		key := dev + ":" + port
+		intf, ok := prevIntfs[key]
+		if !ok || intf.Network != "" || claimed[key] || claimed[intf.Peer] {
+			return intf, false
+		}
+		if intf.Peer != peer+":"+peerPort {
+			d := r.devices[peer]
+			if d == nil || d.Function() != topology.OOBSwitch ||
+				!strings.HasPrefix(intf.Peer, peer+":") {
+				return intf, false
+			}
+		}
+		claimed[key], claimed[intf.Peer] = true, true
+		return intf, true
+	}
 	nextPort := uint(r.portBase)
+	allocatePort := func() uint {
+		for usedPorts[nextPort] || usedPorts[nextPort+uint(r.portGap)] {
+			nextPort++
+		}
+		nextPort++
+		return nextPort - 1
+	}
 	for _, l := range t.Links() {
+		// UDP tunnel ports of the from side (port, localPort), the
+		// to side gets them swapped. Links that existed before keep
+		// their ports.
+		var port, localPort uint
+		if intf, ok := prevLink(l.From, l.FromPort, l.To, l.ToPort); ok {
+			port, localPort = intf.Port, intf.LocalPort
+		} else if intf, ok := prevLink(l.To, l.ToPort, l.From, l.FromPort); ok {
+			port, localPort = intf.LocalPort, intf.Port
+		}
+
 		fromTunnelIP := r.tunnelIP
 		if from := r.devices[l.From]; from != nil {
 			fromTunnelIP = from.tunnelIP
 			mac, hasMAC := l.FromMAC()
-			if !hasMAC {
-				mac = allocateMAC()
-			}
+			mac = portMAC(l.From, l.FromPort, mac, hasMAC)
 			if (l.From == "oob-mgmt-server" || l.From == "oob-mgmt-switch") &&
 				l.To == "" {
 				// XXX
@@ -395,31 +603,38 @@ func (r *Runner) buildInventory(t *topology.T) (err error) {
 			if to := r.devices[l.To]; to != nil {
 				toTunnelIP = to.tunnelIP
 			}
+			if port == 0 {
+				port = allocatePort()
+				localPort = port + uint(r.portGap)
+			}
 			from.interfaces = append(from.interfaces, iface{
 				name:           l.FromPort,
 				mac:            mac,
-				port:           nextPort,
-				localPort:      nextPort + uint(r.portGap),
+				peer:           l.To + ":" + l.ToPort,
+				port:           port,
+				localPort:      localPort,
 				remoteTunnelIP: toTunnelIP,
 				pxe:            l.Attr("left_pxe") != "",
 			})
 		}
+		if port == 0 {
+			port = allocatePort()
+			localPort = port + uint(r.portGap)
+		}
 		if to := r.devices[l.To]; to != nil {
 			mac, hasMAC := l.ToMAC()
-			if !hasMAC {
-				mac = allocateMAC()
-			}
+			mac = portMAC(l.To, l.ToPort, mac, hasMAC)
 			to.interfaces = append(to.interfaces, iface{
 				name:           l.ToPort,
 				mac:            mac,
-				port:           nextPort + uint(r.portGap),
-				localPort:      nextPort,
+				peer:           l.From + ":" + l.FromPort,
+				port:           localPort,
+				localPort:      port,
 				remoteTunnelIP: fromTunnelIP,
 				pxe:            l.Attr("right_pxe") != "",
 			})
 
 		}
-		nextPort++
 	}
 
 	for _, d := range r.devices {
@@ -434,58 +649,113 @@ func (r *Runner) buildInventory(t *topology.T) (err error) {
 	return nil
 }
 
+// An imageKey identifies a base image volume by the host it's stored on and
+// the URL it was downloaded from.
+type imageKey struct {
+	uri string // host connection URI
+	url string
+}
+
+// Connect opens a libvirt connection to each host devices are placed on.
+func (r *Runner) connect() (err error) {
+	r.conns = make(map[string]*libvirt.Connect)
+	defer func() {
+		if err != nil {
+			r.disconnect()
+		}
+	}()
+	for _, d := range r.devices {
+		if r.conns[d.host.URI] != nil {
+			continue
+		}
+		c, err := libvirt.NewConnect(d.host.URI)
+		if err != nil {
+			return err
+		}
+		r.conns[d.host.URI] = c
+	}
+	return nil
+}
+
+// Disconnect closes the connections opened by connect.
+func (r *Runner) disconnect() {
+	for _, c := range r.conns {
+		c.Close()
+	}
+	r.conns = nil
+}
+
+// Conn returns the connection to the host d is placed on.
+func (r *Runner) conn(d *device) *libvirt.Connect {
+	return r.conns[d.host.URI]
+}
+
+// DownloadBaseImages makes sure the storage pool of each host has the base
+// images of the devices placed on it. Missing images are downloaded into the
+// image cache, verified against their os_sha256 attribute, unpacked and
+// imported.
 func (r *Runner) downloadBaseImages(ctx context.Context, t *topology.T) (err error) {
 	defer func() {
 		if err != nil {
 			err = fmt.Errorf("downloadBaseImages: %w", err)
 		}
 	}()
-	pool, err := r.conn.LookupStoragePoolByName(r.storagePool)
+	pools := make(map[string]*libvirt.StoragePool) // by host URI
+	defer func() {
+		for _, p := range pools {
+			p.Free()
+		}
+	}()
+
+	digests, err := r.imageDigestAttrs()
 	if err != nil {
 		return err
 	}
-	defer pool.Free()
-
-	wantImages := make(map[string]struct{})
-	haveImages := make(map[string]*libvirt.StorageVol)
+	wantImages := make(map[string][]*device) // a device per host lacking the image
+	haveImages := make(map[imageKey]*libvirt.StorageVol)
 	for _, d := range r.devices {
 		osImage := d.OSImage()
-		if osImage == "" {
+		if osImage == "" || !r.needsDisk(d) {
 			continue
 		}
-		u, err := url.Parse(osImage)
-		if err != nil {
-			return err
+		key := imageKey{uri: d.host.URI, url: osImage}
+		if _, ok := haveImages[key]; ok {
+			continue
+		}
+		pool := pools[d.host.URI]
+		if pool == nil {
+			pool, err = r.conn(d).LookupStoragePoolByName(d.host.Pool)
+			if err != nil {
+				return err
+			}
+			pools[d.host.URI] = pool
 		}
-		vol, err := pool.LookupStorageVolByName(path.Base(u.Path))
+		vol, err := pool.LookupStorageVolByName(
+			baseVolumeName(osImage, digests[osImage]))
 		if err == nil {
 			// skip over already present volumes
-			haveImages[osImage] = vol
+			haveImages[key] = vol
 			continue
 		}
-		wantImages[osImage] = struct{}{}
+		haveImages[key] = nil // importing below
+		wantImages[osImage] = append(wantImages[osImage], d)
 	}
 
 	type result struct {
-		vol *libvirt.StorageVol
-		url string
-		err error
+		vols map[imageKey]*libvirt.StorageVol
+		err  error
 	}
 	ch := make(chan result)
 	fetchCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	numStarted := 0
-	for sourceURL := range wantImages {
-		sourceURL := sourceURL
+	for sourceURL, devs := range wantImages {
+		sourceURL, devs := sourceURL, devs
 		go func() {
-			vol, err := createVolumeFromURL(fetchCtx, r.conn, pool, sourceURL)
-			if err != nil {
-				ch <- result{err: err, url: sourceURL}
-				return
-			}
-			ch <- result{vol: vol, url: sourceURL}
-
+			vols, err := r.fetchBaseImage(fetchCtx, sourceURL,
+				digests[sourceURL], devs, pools)
+			ch <- result{vols: vols, err: err}
 		}()
 		numStarted++
 	}
@@ -493,19 +763,21 @@ func (r *Runner) downloadBaseImages(ctx context.Context, t *topology.T) (err err
 	for i := 0; i < numStarted; i++ {
 		res := <-ch
 		if res.err == nil {
-			haveImages[res.url] = res.vol
+			for k, v := range res.vols {
+				haveImages[k] = v
+			}
 			continue
 		}
-		if res.err != nil {
-			cancel() // tell other goroutines to shut down
-			if err == nil {
-				err = res.err
-			}
+		cancel() // tell other goroutines to shut down
+		if err == nil {
+			err = res.err
 		}
 	}
 	if err != nil {
 		for _, v := range haveImages {
-			v.Free()
+			if v != nil {
+				v.Free()
+			}
 		}
 		return err
 	}
@@ -513,6 +785,84 @@ func (r *Runner) downloadBaseImages(ctx context.Context, t *topology.T) (err err
 	return nil
 }
 
+// ImageDigestAttrs returns the os_sha256 attribute values of the devices by
+// the value of their os attribute. Devices with the same os attribute must not
+// disagree on them.
+func (r *Runner) imageDigestAttrs() (map[string]string, error) {
+	digests := make(map[string]string)
+	for _, d := range r.devices {
+		osImage, a := d.OSImage(), d.Attr("os_sha256")
+		if osImage == "" || a == "" {
+			continue
+		}
+		if b, ok := digests[osImage]; ok && a != b {
+			return nil, fmt.Errorf("conflicting os_sha256 for %s", osImage)
+		}
+		digests[osImage] = a
+	}
+	return digests, nil
+}
+
+// FetchBaseImage fetches the image referred to by the os attribute value ref
+// into the image cache, verifies it against the os_sha256 attribute value
+// digestAttr and the digest known to its source and imports it into the
+// storage pools of the hosts devs are placed on. Each source gets its own
+// directory in the image cache, named like its volume.
+func (r *Runner) fetchBaseImage(ctx context.Context, ref, digestAttr string, devs []*device, pools map[string]*libvirt.StoragePool) (vols map[imageKey]*libvirt.StorageVol, err error) {
+	name := imageName(ref)
+	volName := baseVolumeName(ref, digestAttr)
+	img, err := r.resolveImage(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	digest, err := imageDigest(ctx, name, digestAttr)
+	if err != nil {
+		return nil, err
+	}
+	if img.digest != "" {
+		if digest != "" && digest != img.digest {
+			return nil, fmt.Errorf("%s: os_sha256 %s doesn't match source digest %s",
+				ref, digest, img.digest)
+		}
+		digest = img.digest
+	}
+	cacheDir := filepath.Join(r.imageCache, strings.TrimPrefix(volName, baseVolumePrefix))
+	file, err := fetchImage(ctx, cacheDir, name, img, digest)
+	if err != nil {
+		return nil, err
+	}
+	image, format, err := prepareImage(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	if digest, err = cachedDigest(file); err != nil {
+		return nil, err
+	}
+	meta := &imageMeta{
+		Source:  ref,
+		Name:    name,
+		Digest:  digest,
+		Fetched: fi.ModTime(),
+	}
+	vols = make(map[imageKey]*libvirt.StorageVol)
+	for _, d := range devs {
+		vol, err := importImage(r.conn(d), pools[d.host.URI],
+			volName, image, format, meta)
+		if err != nil {
+			for _, v := range vols {
+				v.Free()
+			}
+			return nil, err
+		}
+		vols[imageKey{uri: d.host.URI, url: ref}] = vol
+	}
+	return vols, nil
+}
+
 func (r *Runner) createVolumes(ctx context.Context, t *topology.T) (err error) {
 	var created []*libvirt.StorageVol
 	defer func() {
@@ -527,18 +877,30 @@ func (r *Runner) createVolumes(ctx context.Context, t *topology.T) (err error) {
 			err = fmt.Errorf("createVolumes: %w", err)
 		}
 	}()
-	pool, err := r.conn.LookupStoragePoolByName(r.storagePool)
-	if err != nil {
-		return err
-	}
-	defer pool.Free()
+	pools := make(map[string]*libvirt.StoragePool) // by host URI
+	defer func() {
+		for _, p := range pools {
+			p.Free()
+		}
+	}()
 
 	for _, d := range r.devices {
+		if !r.needsDisk(d) {
+			continue
+		}
+		pool := pools[d.host.URI]
+		if pool == nil {
+			pool, err = r.conn(d).LookupStoragePoolByName(d.host.Pool)
+			if err != nil {
+				return err
+			}
+			pools[d.host.URI] = pool
+		}
 		var backing *libvirtxml.StorageVolumeBackingStore
 		capacity := d.DiskSize()
 
 		if osImage := d.OSImage(); osImage != "" {
-			base := r.baseImages[osImage]
+			base := r.baseImages[imageKey{uri: d.host.URI, url: osImage}]
 			if base == nil {
 				// we should've failed earlier already
 				panic("unexpected missing base image: " +
@@ -571,33 +933,39 @@ func (r *Runner) createVolumes(ctx context.Context, t *topology.T) (err error) {
 			return fmt.Errorf("vol-create: %w", err)
 		}
 		created = append(created, vol)
-		d.pool = r.storagePool
+		d.pool = d.host.Pool
 	}
 
 	return nil
 }
 
-// DeleteVolumes deletes any created volumes from the libvirt storage pool
-// r.storagePool.
+// DeleteVolumes deletes any created volumes from the storage pools of the
+// devices' hosts.
 func (r *Runner) deleteVolumes(ctx context.Context, t *topology.T) (err error) {
 	defer func() {
 		if err != nil {
 			err = fmt.Errorf("deleteVolumes: %w", err)
 		}
 	}()
-	pool, err := r.conn.LookupStoragePoolByName(r.storagePool)
-	if err != nil {
-		return err
-	}
-	defer pool.Free()
 
 	for _, d := range r.devices {
+		if !r.needsDisk(d) {
+			continue
+		}
+		pool, err := r.conn(d).LookupStoragePoolByName(d.host.Pool)
+		if err != nil {
+			return err
+		}
 		v, lerr := pool.LookupStorageVolByName(d.name)
+		pool.Free()
 		if lerr != nil {
 			continue
 		}
-		_ = v.Delete(0)
+		err = v.Delete(0)
 		v.Free()
+		if err != nil {
+			return fmt.Errorf("delete volume %s: %w", d.name, err)
+		}
 	}
 
 	return nil
@@ -624,12 +992,15 @@ func (r *Runner) defineDomains(ctx context.Context, t *topology.T) (err error) {
 
 	var buf bytes.Buffer
 	for _, d := range r.devices {
+		if !r.isTarget(d) {
+			continue
+		}
 		if err := tmpl.Execute(&buf, d.templateArgs()); err != nil {
 			return fmt.Errorf("domain %s: %w", d.name, err)
 		}
 		domXML := buf.String()
 		buf.Reset()
-		dom, err := r.conn.DomainDefineXMLFlags(
+		dom, err := r.conn(d).DomainDefineXMLFlags(
 			domXML, libvirt.DOMAIN_DEFINE_VALIDATE)
 		if err != nil {
 			return fmt.Errorf("define domain %s: %w", d.name, err)
@@ -649,13 +1020,19 @@ func (r *Runner) undefineDomains(ctx context.Context, t *topology.T) (err error)
 		}
 	}()
 	for _, d := range r.devices {
-		dom, lerr := r.conn.LookupDomainByName(d.name)
+		if !r.isTarget(d) {
+			continue
+		}
+		dom, lerr := r.conn(d).LookupDomainByName(d.name)
 		if lerr != nil {
 			continue
 		}
-		_ = dom.Destroy()
-		_ = dom.Undefine()
+		_ = dom.Destroy() // fails if it isn't running
+		err := dom.Undefine()
 		dom.Free()
+		if err != nil {
+			return fmt.Errorf("undefine %s: %w", d.name, err)
+		}
 	}
 
 	return nil
@@ -668,45 +1045,31 @@ func (r *Runner) customizeDomains(ctx context.Context, t *topology.T) (err error
 		}
 	}()
 
-	var buf bytes.Buffer
+	// PTM gets to see the effective topology, including the
+	// management network.
+	ptmDOT, err := t.MarshalDOT()
+	if err != nil {
+		return err
+	}
+
+	fabric, err := fabricConfig(t, r.fabricMode)
+	if err != nil {
+		return err
+	}
+
 	ch := make(chan error)
 	numStarted := 0
 	customizeCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	for _, d := range r.devices {
-		if d.OSImage() == "" {
+		if d.OSImage() == "" || !r.needsDisk(d) {
 			// Cannot customize blank disk image.
 			continue
 		}
-		user := "root"
-		if hasCumulusFunction(d) {
-			user = "cumulus"
-			fmt.Fprintf(&buf, "write /etc/ptm.d/topology.dot:%s\n",
-				bytes.Replace(t.DOT(), []byte("\n"),
-					[]byte("\\\n"), -1))
-		}
-		for _, k := range r.authorizedKeys {
-			fmt.Fprintf(&buf, "ssh-inject %s:string:%s\n", user, k)
-			if user != "root" {
-				fmt.Fprintf(&buf, "ssh-inject root:string:%s\n", k)
-			}
-		}
-		if d.Function() == topology.OOBServer {
-			hosts := gatherHosts(ctx, r, t)
-			for _, h := range hosts {
-				fmt.Fprintf(&buf, "append-line /etc/hosts:%s %s\n",
-					h.ip, h.name)
-			}
-			dnsmasqHosts := generateDnsmasqHostsFile(hosts)
-			fmt.Fprintf(&buf, "write /etc/dnsmasq.hostsfile:%s\n",
-				bytes.Replace(dnsmasqHosts, []byte("\n"),
-					[]byte("\\\n"), -1))
-		}
-		extra := strings.NewReader(buf.String())
-		buf.Reset()
+		extra := bytes.NewReader(r.customizeCommands(ctx, t, d, ptmDOT, fabric))
 		d := d
 		go func() {
-			ch <- customizeDomain(customizeCtx, r.uri, d, extra)
+			ch <- customizeDomain(customizeCtx, d.host.URI, d, extra)
 		}()
 		numStarted++
 	}
@@ -723,16 +1086,48 @@ func (r *Runner) customizeDomains(ctx context.Context, t *topology.T) (err error
 	return err
 }
 
+// CustomizeCommands returns the virt-customize commands specific to d and
+// the topology, to be run before those from the config attribute and
+// commandsForFunction.
+func (r *Runner) customizeCommands(ctx context.Context, t *topology.T, d *device, ptmDOT []byte, fabric map[string][]fabricFile) []byte {
+	var buf bytes.Buffer
+	user := "root"
+	if hasCumulusFunction(d) {
+		user = "cumulus"
+		fmt.Fprintf(&buf, "write /etc/ptm.d/topology.dot:%s\n",
+			bytes.Replace(ptmDOT, []byte("\n"),
+				[]byte("\\\n"), -1))
+	}
+	for _, k := range r.authorizedKeys {
+		fmt.Fprintf(&buf, "ssh-inject %s:string:%s\n", user, k)
+		if user != "root" {
+			fmt.Fprintf(&buf, "ssh-inject root:string:%s\n", k)
+		}
+	}
+	if d.Function() == topology.OOBServer {
+		hosts := gatherHosts(ctx, r, t)
+		for _, h := range hosts {
+			for _, ip := range h.ips {
+				fmt.Fprintf(&buf, "append-line /etc/hosts:%s %s%s\n",
+					ip, h.name, hostsMarker)
+			}
+		}
+		dnsmasqHosts := generateDnsmasqHostsFile(hosts)
+		fmt.Fprintf(&buf, "write /etc/dnsmasq.hostsfile:%s\n",
+			bytes.Replace(dnsmasqHosts, []byte("\n"),
+				[]byte("\\\n"), -1))
+	}
+	writeFabricCommands(&buf, d, fabric[d.Name])
+	return buf.Bytes()
+}
+
 func (r *Runner) startDomains(ctx context.Context, t *topology.T) (err error) {
 	defer func() {
 		if err != nil {
 			err = fmt.Errorf("startDomains: %w", err)
 		}
 	}()
-	ds := t.Devices()
-	sort.Slice(ds, func(i, j int) bool {
-		return ds[i].Function() < ds[j].Function()
-	})
+	ds := r.startSequence(t)
 
 	var started []*libvirt.Domain
 	defer func() {
@@ -746,7 +1141,7 @@ func (r *Runner) startDomains(ctx context.Context, t *topology.T) (err error) {
 		if d.Function() == topology.Fake {
 			continue
 		}
-		if d.OSImage() == "" {
+		if d.OSImage() == "" || !r.isTarget(r.devices[d.Name]) {
 			continue
 		}
 		dom := r.domains[r.namePrefix+d.Name]
@@ -756,13 +1151,62 @@ func (r *Runner) startDomains(ctx context.Context, t *topology.T) (err error) {
 		}
 		started = append(started, dom)
 	}
-	if err := r.bmcMan.startAll(ctx); err != nil {
+	var bmcDomains []string
+	for _, b := range r.bmcs {
+		if r.isTarget(r.devices[b.Name]) {
+			bmcDomains = append(bmcDomains, r.namePrefix+b.Name)
+		}
+	}
+	if err := r.bmcMan.start(ctx, bmcDomains...); err != nil {
 		return fmt.Errorf("bmc-start: %w", err)
 	}
 
 	return nil
 }
 
+// IsTarget reports whether d is to be created, which is true for all devices
+// unless Apply restricted the set.
+func (r *Runner) isTarget(d *device) bool {
+	return r.targets == nil || r.targets[d.Name]
+}
+
+// NeedsDisk reports whether the volume of d is to be created and customized,
+// which is true for all targets except those Apply redefines.
+func (r *Runner) needsDisk(d *device) bool {
+	return r.isTarget(d) && !r.keepDisks[d.Name]
+}
+
+// StartSequence returns the devices of t in the order they are to be started,
+// honoring the WithStartOrder and WithStartOnly options.
+func (r *Runner) startSequence(t *topology.T) []topology.Device {
+	batch := func(d *topology.Device) int {
+		for i, g := range r.startOrder {
+			if d.InGroup(g) {
+				return i
+			}
+		}
+		return len(r.startOrder)
+	}
+	var ds []topology.Device
+	for _, d := range t.Devices() {
+		if len(r.startOnly) > 0 && !d.InGroup(r.startOnly...) &&
+			!topology.HasFunction(&d, topology.OOBServer, topology.OOBSwitch) {
+			continue
+		}
+		ds = append(ds, d)
+	}
+	sort.Slice(ds, func(i, j int) bool {
+		if bi, bj := batch(&ds[i]), batch(&ds[j]); bi != bj {
+			return bi < bj
+		}
+		if fi, fj := ds[i].Function(), ds[j].Function(); fi != fj {
+			return fi < fj
+		}
+		return ds[i].Name < ds[j].Name
+	})
+	return ds
+}
+
 // WriteSSHConfig genererates an OpenSSH client config and writes it to r.sshConfigOut.
 func (r *Runner) writeSSHConfig(ctx context.Context, t *topology.T) (err error) {
 	defer func() {
@@ -801,12 +1245,62 @@ func (r *Runner) writeSSHConfig(ctx context.Context, t *topology.T) (err error)
   UserKnownHostsFile /dev/null
   StrictHostKeyChecking no
 `, d.Name, user)
+		// Connect by address rather than relying on name resolution
+		// on the jump host. Works for IPv4 as well as IPv6 literals,
+		// the latter being all IPv6-only devices have.
+		if ips := d.MgmtIPs(); len(ips) > 0 {
+			fmt.Fprintf(w, "  Hostname %s\n", ips[0].IP)
+		}
 
 	}
 
 	return w.Flush()
 }
 
+// WriteInventory writes an Ansible inventory listing the topology's devices
+// grouped by topology group and device function to r.inventoryOut.
+func (r *Runner) writeInventory(ctx context.Context, t *topology.T) (err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("writeInventory: %w", err)
+		}
+	}()
+
+	byFunction := make(map[string][]string)
+	for _, d := range t.Devices() {
+		if d.Function() == topology.Fake || d.OSImage() == "" {
+			continue
+		}
+		f := strings.ReplaceAll(d.Function().String(), "-", "_")
+		byFunction[f] = append(byFunction[f], d.Name)
+	}
+	var sections []string
+	for f := range byFunction {
+		sections = append(sections, f)
+	}
+	sort.Strings(sections)
+
+	w := bufio.NewWriter(r.inventoryOut)
+	for _, g := range t.Groups() {
+		fmt.Fprintf(w, "[%s]\n", g.Name)
+		for _, name := range g.Devices {
+			fmt.Fprintln(w, name)
+		}
+		fmt.Fprintln(w)
+	}
+	for _, f := range sections {
+		names := byFunction[f]
+		sort.Strings(names)
+		fmt.Fprintf(w, "[%s]\n", f)
+		for _, name := range names {
+			fmt.Fprintln(w, name)
+		}
+		fmt.Fprintln(w)
+	}
+
+	return w.Flush()
+}
+
 func (r *Runner) writeBMCConfig(ctx context.Context, t *topology.T) (err error) {
 	defer func() {
 		if err != nil {
@@ -827,6 +1321,7 @@ func (r *Runner) writeBMCConfig(ctx context.Context, t *topology.T) (err error)
 type device struct {
 	topology.Device
 	name       string
+	host       *Host
 	tunnelIP   net.IP
 	interfaces []iface
 	pool       string
@@ -874,6 +1369,7 @@ func (d *device) templateArgs() *domainTemplateArgs {
 type iface struct {
 	name           string
 	mac            net.HardwareAddr
+	peer           string // remote device:port of UDP tunnels
 	network        string
 	port           uint
 	localPort      uint
@@ -113,7 +113,7 @@ func TestRuntopo(t *testing.T) {
 			reload = nil
 		}
 		err = withBackoff(nretries, func() error {
-			c, err := proxyJump(oob, hostname, sshConfig)
+			c, err := proxyJump(ctx, oob, hostname, sshConfig)
 			if err != nil {
 				return err
 			}
@@ -151,7 +151,7 @@ func TestRuntopo(t *testing.T) {
 			}
 			var fileData []byte
 			err := withBackoff(nretries, func() error {
-				c, err := proxyJump(oob, hostname, sshConfig)
+				c, err := proxyJump(ctx, oob, hostname, sshConfig)
 				if err != nil {
 					return err
 				}
@@ -182,7 +182,7 @@ func TestRuntopo(t *testing.T) {
 				continue
 			}
 			err := withBackoff(nretries, func() error {
-				c, err := proxyJump(oob, hostname, sshConfig)
+				c, err := proxyJump(ctx, oob, hostname, sshConfig)
 				if err != nil {
 					return err
 				}
@@ -0,0 +1,430 @@
+package libvirt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// WithImageDir makes the Runner take base images from dir instead of
+// downloading them, looking them up by the file name of their URL (see
+// imageName). Images missing from dir are an error, no network access is
+// attempted. Images given as local files are unaffected.
+func WithImageDir(dir string) RunnerOption {
+	return func(r *Runner) {
+		r.imageDir = dir
+	}
+}
+
+// A sourceImage is a base image as provided by its source.
+type sourceImage struct {
+	digest string // hex-encoded SHA-256 digest, if known by the source
+
+	// Open returns a reader for the image data. If offset is positive,
+	// the reader may start there instead of at the beginning, which is
+	// reported by setting resumed. A non-empty validator, as returned by
+	// an earlier call, makes resuming conditional on the image being
+	// unchanged since. The returned validator identifies the version of
+	// the image being read, it's empty if the source doesn't provide one.
+	open func(ctx context.Context, offset int64, validator string) (rc io.ReadCloser, resumed bool, newValidator string, err error)
+
+	// Stat, if set, returns the current validator without reading the
+	// image. Cached copies of such images are checked against it.
+	stat func() (validator string, err error)
+}
+
+// ImageName returns the file name for the base image referred to by the os
+// attribute value ref. It's the last element of the URL path or, for OCI
+// artifacts, the repository's last element followed by the tag or digest.
+func imageName(ref string) string {
+	u, err := url.Parse(ref)
+	if err != nil {
+		return path.Base(ref)
+	}
+	if u.Scheme == "oci" {
+		if _, repo, reference, err := parseOCIRef(ref); err == nil {
+			return path.Base(repo) + "_" + strings.ReplaceAll(reference, ":", "-")
+		}
+	}
+	p := u.Path
+	if p == "" {
+		p = u.Opaque
+	}
+	return path.Base(p)
+}
+
+// ResolveImage returns the source of the base image referred to by the os
+// attribute value ref, which is one of
+//
+//   - an HTTP or HTTPS URL,
+//   - a file URL or plain path, with relative ones taken relative to the
+//     topology file (see WithConfigFS); file URLs naming a host other than
+//     localhost are rejected,
+//   - an OCI artifact reference (oci://registry/repository:tag or
+//     oci://registry/repository@sha256:digest).
+//
+// If WithImageDir was given, remote images are taken from there.
+func (r *Runner) resolveImage(ctx context.Context, ref string) (*sourceImage, error) {
+	u, err := url.Parse(ref)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "", "file":
+		if u.Host != "" && u.Host != "localhost" {
+			return nil, fmt.Errorf("%s: file URL with host %s, "+
+				"use file:%s for a relative path", ref, u.Host,
+				path.Join(u.Host, u.Path))
+		}
+		p := u.Path
+		if p == "" {
+			p = u.Opaque
+		}
+		if filepath.IsAbs(p) {
+			return fileImage(os.DirFS("/"), strings.TrimPrefix(p, "/")), nil
+		}
+		fsys := r.configFS
+		if fsys == nil {
+			fsys = os.DirFS(".")
+		}
+		return fileImage(fsys, path.Clean(p)), nil
+	}
+	if r.imageDir != "" {
+		name := imageName(ref)
+		if _, err := os.Stat(filepath.Join(r.imageDir, name)); err != nil {
+			return nil, fmt.Errorf("%s not in image directory: %w", ref, err)
+		}
+		return fileImage(os.DirFS(r.imageDir), name), nil
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return httpImage(ref), nil
+	case "oci":
+		return ociImage(ctx, ref)
+	}
+	return nil, fmt.Errorf("%s: unsupported image source", ref)
+}
+
+// FileImage returns the image stored in file name of fsys. Its validator is
+// made up of the file's size and modification time.
+func fileImage(fsys fs.FS, name string) *sourceImage {
+	return &sourceImage{
+		open: func(ctx context.Context, offset int64, validator string) (io.ReadCloser, bool, string, error) {
+			f, err := fsys.Open(name)
+			if err != nil {
+				return nil, false, "", err
+			}
+			fi, err := f.Stat()
+			if err != nil {
+				f.Close()
+				return nil, false, "", err
+			}
+			current := fileValidator(fi)
+			if s, ok := f.(io.Seeker); ok && offset > 0 &&
+				(validator == "" || validator == current) {
+				if _, err := s.Seek(offset, io.SeekStart); err == nil {
+					return f, true, current, nil
+				}
+			}
+			return f, false, current, nil
+		},
+		stat: func() (string, error) {
+			fi, err := fs.Stat(fsys, name)
+			if err != nil {
+				return "", err
+			}
+			return fileValidator(fi), nil
+		},
+	}
+}
+
+func fileValidator(fi fs.FileInfo) string {
+	return fmt.Sprintf("%d-%d", fi.Size(), fi.ModTime().UnixNano())
+}
+
+// HTTPImage returns the image found at imageURL.
+func httpImage(imageURL string) *sourceImage {
+	return &sourceImage{
+		open: func(ctx context.Context, offset int64, validator string) (io.ReadCloser, bool, string, error) {
+			return openRange(ctx, offset, validator, func(ctx context.Context, header http.Header) (*http.Response, error) {
+				req, err := http.NewRequestWithContext(ctx, "GET", imageURL, nil)
+				if err != nil {
+					return nil, err
+				}
+				for k, v := range header {
+					req.Header[k] = v
+				}
+				return http.DefaultClient.Do(req)
+			})
+		},
+	}
+}
+
+// OpenRange issues a GET request using do, asking for the data starting at
+// offset if positive. A non-empty validator (an entity tag or Last-Modified
+// value) is sent as If-Range, having the server return the full resource if
+// it changed. It falls back to fetching everything if the server can't
+// satisfy the range. The returned validator is taken from the response.
+func openRange(ctx context.Context, offset int64, validator string, do func(context.Context, http.Header) (*http.Response, error)) (rc io.ReadCloser, resumed bool, newValidator string, err error) {
+	header := make(http.Header)
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		if validator != "" {
+			header.Set("If-Range", validator)
+		}
+	}
+	resp, err := do(ctx, header)
+	if err != nil {
+		return nil, false, "", err
+	}
+	// Weak entity tags are not allowed in If-Range.
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		newValidator = etag
+	} else {
+		newValidator = resp.Header.Get("Last-Modified")
+	}
+	switch {
+	case offset > 0 && resp.StatusCode == http.StatusPartialContent:
+		return resp.Body, true, newValidator, nil
+	case offset > 0 && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// We're either done already or the partial file is bogus,
+		// start over.
+		resp.Body.Close()
+		return openRange(ctx, 0, "", do)
+	case statusOK(resp) && resp.StatusCode != http.StatusPartialContent:
+		return resp.Body, false, newValidator, nil
+	}
+	resp.Body.Close()
+	return nil, false, "", fmt.Errorf("status %s", resp.Status)
+}
+
+// Media types of the manifests we accept from registries.
+const (
+	ociManifestType    = "application/vnd.oci.image.manifest.v1+json"
+	dockerManifestType = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Layers    []ociDescriptor `json:"layers"`
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// OCIImage returns the disk image stored as OCI artifact ref (see
+// resolveImage). The artifact's manifest must either have a single layer or a
+// layer titled like a disk image (org.opencontainers.image.title annotation,
+// as set by oras push). Registries are accessed anonymously, using HTTP for
+// those on the loopback interface and HTTPS otherwise.
+func ociImage(ctx context.Context, ref string) (img *sourceImage, err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("ociImage %s: %w", ref, err)
+		}
+	}()
+	registry, repo, reference, err := parseOCIRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	scheme := "https"
+	if host, _, err := net.SplitHostPort(registry); err == nil && isLoopback(host) ||
+		isLoopback(registry) {
+		scheme = "http"
+	}
+	c := &registryClient{base: scheme + "://" + registry + "/v2/" + repo}
+
+	header := make(http.Header)
+	header.Set("Accept", ociManifestType+", "+dockerManifestType)
+	resp, err := c.do(ctx, "/manifests/"+reference, header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if !statusOK(resp) {
+		return nil, fmt.Errorf("manifest: status %s", resp.Status)
+	}
+	var m ociManifest
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&m); err != nil {
+		return nil, fmt.Errorf("manifest: %w", err)
+	}
+	var layer *ociDescriptor
+	for i, l := range m.Layers {
+		if len(m.Layers) == 1 || isDiskImageName(l.Annotations["org.opencontainers.image.title"]) {
+			layer = &m.Layers[i]
+			break
+		}
+	}
+	if layer == nil {
+		return nil, errors.New("no disk image layer in manifest")
+	}
+	digest := strings.TrimPrefix(layer.Digest, "sha256:")
+	if !isSHA256(digest) {
+		return nil, fmt.Errorf("unsupported layer digest %s", layer.Digest)
+	}
+	return &sourceImage{
+		digest: digest,
+		open: func(ctx context.Context, offset int64, validator string) (io.ReadCloser, bool, string, error) {
+			return openRange(ctx, offset, validator, func(ctx context.Context, header http.Header) (*http.Response, error) {
+				return c.do(ctx, "/blobs/"+layer.Digest, header)
+			})
+		},
+	}, nil
+}
+
+// ParseOCIRef splits the OCI artifact reference ref into registry,
+// repository and tag or digest. The tag defaults to latest.
+func parseOCIRef(ref string) (registry, repo, reference string, err error) {
+	s := strings.TrimPrefix(ref, "oci://")
+	i := strings.Index(s, "/")
+	if s == ref || i <= 0 {
+		return "", "", "", fmt.Errorf("malformed OCI reference %q", ref)
+	}
+	registry, repo = s[:i], s[i+1:]
+	if i := strings.Index(repo, "@"); i >= 0 {
+		repo, reference = repo[:i], repo[i+1:]
+	} else if i := strings.LastIndex(repo, ":"); i > strings.LastIndex(repo, "/") {
+		repo, reference = repo[:i], repo[i+1:]
+	} else {
+		reference = "latest"
+	}
+	if repo == "" || reference == "" {
+		return "", "", "", fmt.Errorf("malformed OCI reference %q", ref)
+	}
+	return registry, repo, reference, nil
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// A registryClient talks to a repository of an OCI distribution registry,
+// obtaining an anonymous bearer token if requested by the registry.
+type registryClient struct {
+	base  string // URL of the repository's API endpoint
+	token string
+}
+
+func (c *registryClient) do(ctx context.Context, p string, header http.Header) (*http.Response, error) {
+	for {
+		req, err := http.NewRequestWithContext(ctx, "GET", c.base+p, nil)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusUnauthorized || c.token != "" {
+			return resp, nil
+		}
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		if err := c.authenticate(ctx, challenge); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Authenticate obtains a token as requested by the WWW-Authenticate header
+// value challenge.
+func (c *registryClient) authenticate(ctx context.Context, challenge string) error {
+	params, ok := parseBearerChallenge(challenge)
+	if !ok || params["realm"] == "" {
+		return fmt.Errorf("unsupported authentication challenge %q", challenge)
+	}
+	u, err := url.Parse(params["realm"])
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	for _, k := range []string{"service", "scope"} {
+		if v := params[k]; v != "" {
+			q.Set(k, v)
+		}
+	}
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if !statusOK(resp) {
+		return fmt.Errorf("token: status %s", resp.Status)
+	}
+	var tok struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tok); err != nil {
+		return fmt.Errorf("token: %w", err)
+	}
+	if c.token = tok.Token; c.token == "" {
+		c.token = tok.AccessToken
+	}
+	if c.token == "" {
+		return errors.New("token: empty response")
+	}
+	return nil
+}
+
+// ParseBearerChallenge parses a WWW-Authenticate header value like
+// `Bearer realm="https://auth.example.org/token",service="registry"`.
+func parseBearerChallenge(s string) (map[string]string, bool) {
+	rest := strings.TrimPrefix(s, "Bearer ")
+	if rest == s {
+		return nil, false
+	}
+	params := make(map[string]string)
+	for rest != "" {
+		i := strings.Index(rest, "=")
+		if i < 0 {
+			return nil, false
+		}
+		k := strings.TrimSpace(rest[:i])
+		rest = rest[i+1:]
+		var v string
+		if strings.HasPrefix(rest, `"`) {
+			j := strings.Index(rest[1:], `"`)
+			if j < 0 {
+				return nil, false
+			}
+			v, rest = rest[1:j+1], rest[j+2:]
+		} else if j := strings.Index(rest, ","); j >= 0 {
+			v, rest = rest[:j], rest[j:]
+		} else {
+			v, rest = rest, ""
+		}
+		params[k] = v
+		rest = strings.TrimPrefix(strings.TrimSpace(rest), ",")
+	}
+	return params, true
+}
@@ -0,0 +1,99 @@
+package libvirt
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"go4.org/writerutil"
+	"golang.org/x/crypto/ssh"
+)
+
+// ProxyJump connects to the SSH server at addr through the existing
+// connection c, like OpenSSH's ProxyJump option. Like dialSSH, it gives up
+// after a few seconds, closing the connection if the handshake stalls.
+func proxyJump(ctx context.Context, c *ssh.Client, addr string, config *ssh.ClientConfig) (cc *ssh.Client, err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("proxyJump %s: %w", addr, err)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, sshTimeout)
+	defer cancel()
+	conn, err := c.Dial("tcp", net.JoinHostPort(addr, "22"))
+	if err != nil {
+		return nil, err
+	}
+	// Channels don't support deadlines, close it instead.
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	close(stop)
+	<-stopped
+	if ctx.Err() != nil {
+		if err == nil {
+			sshConn.Close()
+		}
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// RunCommand runs the named program with args on the remote host and returns
+// its standard output.
+func runCommand(c *ssh.Client, name string, args ...string) ([]byte, error) {
+	var b strings.Builder
+
+	b.WriteString(shellQuote(name))
+	for _, a := range args {
+		b.WriteByte(' ')
+		b.WriteString(shellQuote(a))
+	}
+	cmd := b.String()
+
+	sess, err := c.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer sess.Close()
+
+	var stdout bytes.Buffer
+	stderr := &writerutil.PrefixSuffixSaver{N: 1024}
+	sess.Stdout = &stdout
+	sess.Stderr = stderr
+
+	if err := sess.Run(cmd); err != nil {
+		if msg := stderr.Bytes(); len(msg) > 0 {
+			return nil, fmt.Errorf("runCommand: %w | %s |", err, msg)
+		}
+		return nil, fmt.Errorf("runCommand: %w", err)
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// ShellQuote returns s in a form suitable to pass it to the shell as an
+// argument. Obviously, it works for Bourne-like shells only.  The way this
+// works is that first the whole string is enclosed in single quotes. Now the
+// only character that needs special handling is the single quote itself.  We
+// replace it by '\'' (the outer quotes are part of the replacement) and make
+// use of the fact that the shell concatenates adjacent strings.
+func shellQuote(s string) string {
+	t := strings.Replace(s, "'", `'\''`, -1)
+	return "'" + t + "'"
+}
@@ -0,0 +1,108 @@
+package libvirt
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestProxyJumpTimeout(t *testing.T) {
+	// A device accepting connections without ever speaking SSH.
+	stalled, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+	go func() {
+		for {
+			c, err := stalled.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	// A jump host forwarding direct-tcpip channels.
+	hostKey, _, err := sshKeygen(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(hostKey)
+	jump, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jump.Close()
+	go func() {
+		c, err := jump.Accept()
+		if err != nil {
+			return
+		}
+		_, chans, reqs, err := ssh.NewServerConn(c, config)
+		if err != nil {
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+		// Whatever is asked for, connect to the stalled device.
+		for nc := range chans {
+			tc, err := net.Dial("tcp", stalled.Addr().String())
+			if err != nil {
+				nc.Reject(ssh.ConnectionFailed, err.Error())
+				continue
+			}
+			ch, creqs, err := nc.Accept()
+			if err != nil {
+				tc.Close()
+				continue
+			}
+			go ssh.DiscardRequests(creqs)
+			go func() {
+				io.Copy(tc, ch)
+				tc.Close()
+			}()
+			go func() {
+				io.Copy(ch, tc)
+				ch.Close()
+			}()
+		}
+	}()
+
+	oob, err := ssh.Dial("tcp", jump.Addr().String(), &ssh.ClientConfig{
+		User:            "root",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer oob.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		c, err := proxyJump(ctx, oob, "127.0.0.1", &ssh.ClientConfig{
+			User:            "root",
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		if c != nil {
+			c.Close()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("got err=%v, want deadline exceeded", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("proxyJump hangs on a stalled handshake")
+	}
+}
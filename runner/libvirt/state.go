@@ -0,0 +1,297 @@
+package libvirt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"libvirt.org/libvirt-go"
+	"slrz.net/runtopo/topology"
+)
+
+// WithStateDir makes Run record the resources it creates in a state file
+// within dir, named after the name prefix (e.g. runtopo-state.json). Destroy
+// then cleans up based on the state file instead of the topology and options
+// passed to it. See also LoadState and DestroyState.
+func WithStateDir(dir string) RunnerOption {
+	return func(r *Runner) {
+		r.stateDir = dir
+	}
+}
+
+// A State records the resources created by Run, allowing later invocations to
+// operate on a running topology without needing the original topology file
+// and RunnerOptions.
+type State struct {
+	URI        string        `json:"uri"`
+	NamePrefix string        `json:"name_prefix"`
+	Pool       string        `json:"pool"`
+	Created    time.Time     `json:"created"`
+	Devices    []StateDevice `json:"devices"`
+}
+
+// A StateDevice describes the libvirt resources belonging to a device.
+type StateDevice struct {
+	Name       string           `json:"name"` // topology device name
+	Function   string           `json:"function,omitempty"`
+	Domain     string           `json:"domain"`
+	Volume     string           `json:"volume"`
+	Host       string           `json:"host,omitempty"` // see WithHosts
+	URI        string           `json:"uri,omitempty"`  // if not State.URI
+	Pool       string           `json:"pool,omitempty"` // if not State.Pool
+	MgmtIPs    []string         `json:"mgmt_ips,omitempty"`
+	Interfaces []StateInterface `json:"interfaces"`
+	BMC        *StateBMC        `json:"bmc,omitempty"`
+
+	// Digest summarizes the domain definition, Disk the disk contents,
+	// see Apply. They're empty if the device wasn't completely set up.
+	Digest string `json:"digest,omitempty"`
+	Disk   string `json:"disk_digest,omitempty"`
+
+	// Live summarizes what Apply changes on the running device instead of
+	// recreating it: the DHCP reservations of the management server and
+	// the ports of management switches.
+	Live string `json:"live_digest,omitempty"`
+}
+
+// A StateInterface describes a device's network interface.
+type StateInterface struct {
+	Name           string `json:"name"`
+	MAC            string `json:"mac"`
+	Network        string `json:"network,omitempty"` // libvirt network
+	Peer           string `json:"peer,omitempty"`    // device:port at the remote end
+	Port           uint   `json:"port,omitempty"`    // UDP tunnel ports
+	LocalPort      uint   `json:"local_port,omitempty"`
+	RemoteTunnelIP string `json:"remote_tunnel_ip,omitempty"`
+}
+
+// A StateBMC describes the virtual BMC of a device.
+type StateBMC struct {
+	Addr     string `json:"addr"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
+
+// Location returns the connection URI and storage pool of the host d is
+// placed on.
+func (s *State) location(d *StateDevice) (uri, pool string) {
+	uri, pool = s.URI, s.Pool
+	if d.URI != "" {
+		uri = d.URI
+	}
+	if d.Pool != "" {
+		pool = d.Pool
+	}
+	return uri, pool
+}
+
+// StateFile returns the path of the state file for resources named using
+// prefix within dir.
+func StateFile(dir, prefix string) string {
+	return filepath.Join(dir, prefix+"state.json")
+}
+
+// LoadState reads the state file for resources named using prefix from dir.
+// The returned error wraps fs.ErrNotExist if there is no such file.
+func LoadState(dir, prefix string) (*State, error) {
+	p, err := os.ReadFile(StateFile(dir, prefix))
+	if err != nil {
+		return nil, fmt.Errorf("LoadState: %w", err)
+	}
+	s := new(State)
+	if err := json.Unmarshal(p, s); err != nil {
+		return nil, fmt.Errorf("LoadState: %w", err)
+	}
+	return s, nil
+}
+
+// State returns the state describing the resources for t. It must be called
+// after buildInventory.
+func (r *Runner) state(t *topology.T) *State {
+	s := &State{
+		URI:        r.uri,
+		NamePrefix: r.namePrefix,
+		Pool:       r.storagePool,
+		Created:    time.Now().UTC().Truncate(time.Second),
+	}
+	bmcs := make(map[string]*bmc)
+	for _, b := range r.bmcs {
+		bmcs[b.Name] = b.BMC
+	}
+	for _, d := range r.devices {
+		sd := StateDevice{
+			Name:     d.Name,
+			Function: d.Attr("function"),
+			Domain:   d.name,
+			Volume:   d.name,
+			Host:     d.host.Name,
+		}
+		if d.host.URI != r.uri {
+			sd.URI = d.host.URI
+		}
+		if d.host.Pool != r.storagePool {
+			sd.Pool = d.host.Pool
+		}
+		for _, ip := range d.MgmtIPs() {
+			sd.MgmtIPs = append(sd.MgmtIPs, ip.String())
+		}
+		for _, intf := range d.interfaces {
+			si := StateInterface{
+				Name:      intf.name,
+				MAC:       intf.mac.String(),
+				Network:   intf.network,
+				Peer:      intf.peer,
+				Port:      intf.port,
+				LocalPort: intf.localPort,
+			}
+			if intf.network == "" && intf.remoteTunnelIP != nil {
+				si.RemoteTunnelIP = intf.remoteTunnelIP.String()
+			}
+			sd.Interfaces = append(sd.Interfaces, si)
+		}
+		if b := bmcs[d.Name]; b != nil {
+			sd.BMC = &StateBMC{
+				Addr:     b.Addr,
+				User:     b.User,
+				Password: b.Password,
+			}
+		}
+		s.Devices = append(s.Devices, sd)
+	}
+	sort.Slice(s.Devices, func(i, j int) bool {
+		return s.Devices[i].Name < s.Devices[j].Name
+	})
+	return s
+}
+
+// WriteState writes s to the Runner's state directory, replacing any
+// existing state file atomically.
+func (r *Runner) writeState(s *State) (err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("writeState: %w", err)
+		}
+	}()
+	p, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(r.stateDir, 0o755); err != nil {
+		return err
+	}
+	// The temporary file is created with mode 0600, keeping the BMC
+	// passwords private.
+	tmp, err := writeTempFile(r.stateDir, ".state-", append(p, '\n'))
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, StateFile(r.stateDir, s.NamePrefix)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// RemoveState removes the state file for s from the Runner's state
+// directory, if any.
+func (r *Runner) removeState(s *State) error {
+	if r.stateDir == "" {
+		return nil
+	}
+	err := os.Remove(StateFile(r.stateDir, s.NamePrefix))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("removeState: %w", err)
+	}
+	return nil
+}
+
+// DestroyState destroys the resources recorded in s: virtual BMCs, guest
+// domains and their volumes. Only the connection URIs, pools and names stored
+// in s are used, the Runner's options are ignored apart from WithStateDir. If
+// configured, the state file is removed afterwards.
+func (r *Runner) DestroyState(ctx context.Context, s *State) (err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("libvirt.(*Runner).DestroyState: %w", err)
+		}
+	}()
+
+	if err := destroyDevices(ctx, s, s.Devices, true); err != nil {
+		return err
+	}
+	return r.removeState(s)
+}
+
+// DestroyDevices destroys the virtual BMCs, domains (along with their UEFI
+// variable stores) and, if volumes is set, volumes of devs, which are recorded
+// in s.
+func destroyDevices(ctx context.Context, s *State, devs []StateDevice, volumes bool) error {
+	var bmcDomains []string
+	for _, d := range devs {
+		if d.BMC != nil {
+			bmcDomains = append(bmcDomains, d.Domain)
+		}
+	}
+	if len(bmcDomains) > 0 {
+		m := newBMCMan(&bmcConfig{connect: s.URI})
+		if err := m.vbmcStop(ctx, bmcDomains...); err != nil {
+			return fmt.Errorf("bmc-stop: %w", err)
+		}
+		if err := m.vbmcDelete(ctx, bmcDomains...); err != nil {
+			return fmt.Errorf("bmc-delete: %w", err)
+		}
+	}
+
+	conns := make(map[string]*libvirt.Connect)
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	for _, d := range devs {
+		uri, poolName := s.location(&d)
+		conn := conns[uri]
+		if conn == nil {
+			c, err := libvirt.NewConnect(uri)
+			if err != nil {
+				return err
+			}
+			conns[uri], conn = c, c
+		}
+
+		dom, lerr := conn.LookupDomainByName(d.Domain)
+		if lerr == nil {
+			_ = dom.Destroy() // fails if it isn't running
+			err := dom.UndefineFlags(libvirt.DOMAIN_UNDEFINE_NVRAM)
+			dom.Free()
+			if err != nil {
+				return fmt.Errorf("undefine %s: %w", d.Domain, err)
+			}
+		}
+		if !volumes {
+			continue
+		}
+
+		pool, err := conn.LookupStoragePoolByName(poolName)
+		if err != nil {
+			return err
+		}
+		v, lerr := pool.LookupStorageVolByName(d.Volume)
+		pool.Free()
+		if lerr != nil {
+			continue
+		}
+		err = v.Delete(0)
+		v.Free()
+		if err != nil {
+			return fmt.Errorf("delete volume %s: %w", d.Volume, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,286 @@
+package libvirt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"libvirt.org/libvirt-go"
+	"slrz.net/runtopo/topology"
+)
+
+// A DeviceStatus describes the current state of a device's domain.
+type DeviceStatus struct {
+	Name   string `json:"name"` // topology device name
+	Domain string `json:"domain"`
+
+	// State is the libvirt domain state (e.g. "running" or "shutoff"),
+	// or "undefined" if there's no such domain.
+	State string `json:"state"`
+
+	// Booted is the time the guest OS booted, as reported by the device
+	// over SSH. It's nil if the device couldn't be reached.
+	Booted *time.Time `json:"booted,omitempty"`
+
+	MgmtIP string `json:"mgmt_ip,omitempty"`
+	BMC    string `json:"bmc,omitempty"` // virtual BMC address
+
+	SSH      bool   `json:"ssh"` // whether logging in over SSH succeeded
+	SSHError string `json:"ssh_error,omitempty"`
+
+	// Unmanaged is set for devices having neither a management address
+	// nor an eth0, like the generated management switches. They aren't
+	// logged into.
+	Unmanaged bool `json:"unmanaged,omitempty"`
+}
+
+// Status reports the state of the devices of the running topology t. The
+// devices are taken from the Runner's state file if there is one, in which
+// case t may be nil.
+//
+// Management IPs are those assigned by the automatic management network,
+// falling back to the DHCP leases handed out by libvirt networks. Devices on
+// the management network are reached through the oob-mgmt-server jump host
+// using the SSH credentials given with WithSSHAuth. Without credentials, SSH
+// reachability isn't checked.
+func (r *Runner) Status(ctx context.Context, t *topology.T) (status []DeviceStatus, err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("libvirt.(*Runner).Status: %w", err)
+		}
+	}()
+
+	var s *State
+	if r.stateDir != "" {
+		s, err = LoadState(r.stateDir, r.namePrefix)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	if s == nil {
+		if t == nil {
+			return nil, errors.New("no state file and no topology")
+		}
+		if len(r.devices) == 0 {
+			if err := r.buildInventory(t); err != nil {
+				return nil, err
+			}
+		}
+		s = r.state(t)
+	}
+
+	conns := make(map[string]*libvirt.Connect)
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+
+	// Management IPs obtained from DHCP leases are directly reachable
+	// from the host, the static ones only through the jump host.
+	direct := make(map[string]bool)
+	for _, d := range s.Devices {
+		st := DeviceStatus{
+			Name:   d.Name,
+			Domain: d.Domain,
+			State:  "undefined",
+		}
+		if len(d.MgmtIPs) > 0 {
+			st.MgmtIP = d.MgmtIPs[0]
+		} else {
+			st.Unmanaged = true
+			for _, intf := range d.Interfaces {
+				if intf.Name == "eth0" {
+					st.Unmanaged = false
+				}
+			}
+		}
+		if d.BMC != nil {
+			st.BMC = d.BMC.Addr
+		}
+		uri, _ := s.location(&d)
+		conn := conns[uri]
+		if conn == nil {
+			c, err := libvirt.NewConnect(uri)
+			if err != nil {
+				return nil, err
+			}
+			conns[uri], conn = c, c
+		}
+		dom, lerr := conn.LookupDomainByName(d.Domain)
+		if lerr == nil {
+			state, _, err := dom.GetState()
+			if err != nil {
+				dom.Free()
+				return nil, fmt.Errorf("domain %s: %w", d.Domain, err)
+			}
+			st.State = domainStateString(state)
+			if st.MgmtIP == "" && state == libvirt.DOMAIN_RUNNING {
+				if ip, err := lookupLease(dom); err == nil && !ip.IsZero() {
+					st.MgmtIP = ip.String()
+					direct[d.Name] = true
+				}
+			}
+			dom.Free()
+		}
+		status = append(status, st)
+	}
+
+	if len(r.sshAuth) > 0 {
+		r.checkSSH(ctx, s, status, direct)
+	}
+	return status, nil
+}
+
+// CheckSSH logs into the running devices in status, recording whether it
+// succeeded and the boot time they report.
+func (r *Runner) checkSSH(ctx context.Context, s *State, status []DeviceStatus, direct map[string]bool) {
+	var oob *ssh.Client
+	var oobErr error
+	for _, st := range status {
+		if st.Name == "oob-mgmt-server" && st.State == "running" && st.MgmtIP != "" {
+			oob, oobErr = r.dialSSH(ctx, st.MgmtIP, "root")
+			break
+		}
+	}
+	if oob != nil {
+		defer oob.Close()
+	} else if oobErr == nil {
+		oobErr = errors.New("no jump host")
+	}
+
+	functions := make(map[string]string)
+	for _, d := range s.Devices {
+		functions[d.Name] = d.Function
+	}
+	done := make(chan struct{})
+	n := 0
+	for i := range status {
+		st := &status[i]
+		if st.State != "running" || st.MgmtIP == "" {
+			continue
+		}
+		n++
+		go func() {
+			defer func() { done <- struct{}{} }()
+			user := sshUser(functions[st.Name])
+			var c *ssh.Client
+			var err error
+			switch {
+			case st.Name == "oob-mgmt-server":
+				c, err = oob, oobErr
+			case direct[st.Name]:
+				c, err = r.dialSSH(ctx, st.MgmtIP, user)
+			case oob != nil:
+				c, err = proxyJump(ctx, oob, st.MgmtIP, r.sshClientConfig(user))
+			default:
+				err = oobErr
+			}
+			if err != nil {
+				st.SSHError = err.Error()
+				return
+			}
+			if c != oob {
+				defer c.Close()
+			}
+			st.SSH = true
+			out, err := runCommand(c, "cat", "/proc/uptime")
+			if err != nil {
+				return
+			}
+			if uptime, err := parseUptime(out); err == nil {
+				booted := time.Now().Add(-uptime).Truncate(time.Second)
+				st.Booted = &booted
+			}
+		}()
+	}
+	for ; n > 0; n-- {
+		<-done
+	}
+}
+
+// SSHTimeout bounds connecting to a device over SSH, see dialSSH.
+const sshTimeout = 10 * time.Second
+
+// DialSSH connects to the SSH server at ip as user, giving up after a few
+// seconds.
+func (r *Runner) dialSSH(ctx context.Context, ip, user string) (*ssh.Client, error) {
+	ctx, cancel := context.WithTimeout(ctx, sshTimeout)
+	defer cancel()
+	addr := net.JoinHostPort(ip, "22")
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr,
+		r.sshClientConfig(user))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// SSHUser returns the user to log in as on devices with the named function.
+func sshUser(function string) string {
+	for _, f := range []topology.DeviceFunction{
+		topology.OOBSwitch,
+		topology.Exit,
+		topology.SuperSpine,
+		topology.Spine,
+		topology.Leaf,
+		topology.TOR,
+	} {
+		if f.String() == function {
+			return "cumulus"
+		}
+	}
+	return "root"
+}
+
+// ParseUptime parses the contents of /proc/uptime, which has a resolution of
+// hundredths of a second.
+func parseUptime(p []byte) (time.Duration, error) {
+	fields := strings.Fields(string(p))
+	if len(fields) == 0 {
+		return 0, errors.New("parseUptime: empty input")
+	}
+	secs, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, fmt.Errorf("parseUptime: %w", err)
+	}
+	return time.Duration(secs * float64(time.Second)).Round(10 * time.Millisecond), nil
+}
+
+func domainStateString(s libvirt.DomainState) string {
+	switch s {
+	case libvirt.DOMAIN_NOSTATE:
+		return "nostate"
+	case libvirt.DOMAIN_RUNNING:
+		return "running"
+	case libvirt.DOMAIN_BLOCKED:
+		return "blocked"
+	case libvirt.DOMAIN_PAUSED:
+		return "paused"
+	case libvirt.DOMAIN_SHUTDOWN:
+		return "shutdown"
+	case libvirt.DOMAIN_SHUTOFF:
+		return "shutoff"
+	case libvirt.DOMAIN_CRASHED:
+		return "crashed"
+	case libvirt.DOMAIN_PMSUSPENDED:
+		return "pmsuspended"
+	}
+	return fmt.Sprintf("DomainState(%d)", int(s))
+}
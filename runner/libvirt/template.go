@@ -41,41 +41,44 @@ type udpSource struct {
 }
 
 var templateFuncs = template.FuncMap{
-	"marshalInterface": func(in domainInterface) string {
-		src := new(libvirtxml.DomainInterfaceSource)
-		switch in.Type {
-		case "network":
-			src.Network = &libvirtxml.DomainInterfaceSourceNetwork{
-				Network: in.NetworkSource,
-			}
-		case "udp":
-			src.UDP = &libvirtxml.DomainInterfaceSourceUDP{
-				Address: in.UDPSource.Address,
-				Port:    in.UDPSource.Port,
-				Local: &libvirtxml.DomainInterfaceSourceLocal{
-					Address: in.UDPSource.LocalAddress,
-					Port:    in.UDPSource.LocalPort,
-				},
-			}
+	"marshalInterface": marshalInterface,
+}
+
+// MarshalInterface returns the libvirt XML for in.
+func marshalInterface(in domainInterface) string {
+	src := new(libvirtxml.DomainInterfaceSource)
+	switch in.Type {
+	case "network":
+		src.Network = &libvirtxml.DomainInterfaceSourceNetwork{
+			Network: in.NetworkSource,
 		}
-		intf := &libvirtxml.DomainInterface{
-			MAC: &libvirtxml.DomainInterfaceMAC{
-				Address: in.MACAddr,
-			},
-			Source: src,
-			Model: &libvirtxml.DomainInterfaceModel{
-				Type: in.Model,
+	case "udp":
+		src.UDP = &libvirtxml.DomainInterfaceSourceUDP{
+			Address: in.UDPSource.Address,
+			Port:    in.UDPSource.Port,
+			Local: &libvirtxml.DomainInterfaceSourceLocal{
+				Address: in.UDPSource.LocalAddress,
+				Port:    in.UDPSource.LocalPort,
 			},
 		}
-		if in.PXE {
-			intf.Boot = &libvirtxml.DomainDeviceBoot{Order: 1}
-		}
-		theXML, err := intf.Marshal()
-		if err != nil {
-			panic(err)
-		}
-		return theXML
-	},
+	}
+	intf := &libvirtxml.DomainInterface{
+		MAC: &libvirtxml.DomainInterfaceMAC{
+			Address: in.MACAddr,
+		},
+		Source: src,
+		Model: &libvirtxml.DomainInterfaceModel{
+			Type: in.Model,
+		},
+	}
+	if in.PXE {
+		intf.Boot = &libvirtxml.DomainDeviceBoot{Order: 1}
+	}
+	theXML, err := intf.Marshal()
+	if err != nil {
+		panic(err)
+	}
+	return theXML
 }
 
 const udevRulesTemplateText = `{{ range . }}
@@ -0,0 +1,270 @@
+package libvirt
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// Magic numbers of the container and compression formats understood by
+// unpackImage.
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	xzMagic    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	zipMagic   = []byte("PK\x03\x04")
+	qcow2Magic = []byte("QFI\xfb")
+)
+
+// PrepareImage turns the downloaded file into a disk image usable as backing
+// file, returning its path and format (qcow2 or raw). Compressed files and
+// archives are unpacked into a file with the suffix ".unpacked", which is
+// reused if present. Other files are used as is.
+func prepareImage(ctx context.Context, file string) (image, format string, err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("prepareImage %s: %w", file, err)
+		}
+	}()
+	f, err := os.Open(file)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", "", err
+	}
+	head = head[:n]
+	if !isPacked(head) {
+		return file, diskFormat(head), nil
+	}
+
+	image = file + ".unpacked"
+	if _, err := os.Stat(image); err != nil {
+		part := image + ".part"
+		if err := unpackImage(ctx, part, file); err != nil {
+			os.Remove(part)
+			return "", "", err
+		}
+		if err := os.Rename(part, image); err != nil {
+			return "", "", err
+		}
+	}
+	g, err := os.Open(image)
+	if err != nil {
+		return "", "", err
+	}
+	defer g.Close()
+	n, err = io.ReadFull(g, head[:cap(head)])
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", "", err
+	}
+	return image, diskFormat(head[:n]), nil
+}
+
+// IsPacked reports whether a file starting with head is compressed or an
+// archive.
+func isPacked(head []byte) bool {
+	for _, m := range [][]byte{gzipMagic, bzip2Magic, xzMagic, zstdMagic, zipMagic} {
+		if bytes.HasPrefix(head, m) {
+			return true
+		}
+	}
+	return isTar(head)
+}
+
+func isTar(head []byte) bool {
+	return len(head) >= 262 && string(head[257:262]) == "ustar"
+}
+
+// DiskFormat returns the libvirt volume format of a disk image starting with
+// head. Anything not qcow2 is taken to be a raw image.
+func diskFormat(head []byte) string {
+	if bytes.HasPrefix(head, qcow2Magic) {
+		return "qcow2"
+	}
+	return "raw"
+}
+
+// UnpackImage writes the disk image contained in the file src to dst,
+// decompressing it while streaming. Compression formats may be stacked on top
+// of each other and of tar archives (e.g. .tar.xz). Zip archives are only
+// supported as the outermost layer. Archives must contain a member named like
+// a disk image (.qcow2, .img or .raw, possibly compressed).
+func unpackImage(ctx context.Context, dst, src string) (err error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	br := bufio.NewReaderSize(f, 1<<16)
+	if head, _ := br.Peek(len(zipMagic)); bytes.HasPrefix(head, zipMagic) {
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		zr, err := zip.NewReader(f, fi.Size())
+		if err != nil {
+			return err
+		}
+		var member *zip.File
+		for _, zf := range zr.File {
+			if isDiskImageName(zf.Name) {
+				member = zf
+				break
+			}
+		}
+		if member == nil {
+			return errors.New("no disk image in zip archive")
+		}
+		rc, err := member.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		br = bufio.NewReaderSize(rc, 1<<16)
+	}
+
+	var cmds []*exec.Cmd
+	defer func() {
+		for _, cmd := range cmds {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}
+	}()
+	for {
+		head, err := br.Peek(512)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		var next io.Reader
+		switch {
+		case bytes.HasPrefix(head, gzipMagic):
+			zr, err := gzip.NewReader(br)
+			if err != nil {
+				return err
+			}
+			next = zr
+		case bytes.HasPrefix(head, bzip2Magic):
+			next = bzip2.NewReader(br)
+		case bytes.HasPrefix(head, xzMagic):
+			cmd, stdout, err := decompressCommand(ctx, br, "xz", "-dc")
+			if err != nil {
+				return err
+			}
+			cmds = append(cmds, cmd)
+			next = stdout
+		case bytes.HasPrefix(head, zstdMagic):
+			cmd, stdout, err := decompressCommand(ctx, br, "zstd", "-dc")
+			if err != nil {
+				return err
+			}
+			cmds = append(cmds, cmd)
+			next = stdout
+		case bytes.HasPrefix(head, zipMagic):
+			return errors.New("nested zip archives are not supported")
+		case isTar(head):
+			tr := tar.NewReader(br)
+			for {
+				h, err := tr.Next()
+				if err == io.EOF {
+					return errors.New("no disk image in tar archive")
+				}
+				if err != nil {
+					return err
+				}
+				if h.Typeflag == tar.TypeReg && isDiskImageName(h.Name) {
+					break
+				}
+			}
+			next = tr
+		default:
+			if _, err := io.Copy(out, br); err != nil {
+				return err
+			}
+			// Catch decompressors complaining about corrupt input.
+			for i := len(cmds) - 1; i >= 0; i-- {
+				if err := cmds[i].Wait(); err != nil {
+					return fmt.Errorf("%s: %w", cmds[i].Path, err)
+				}
+			}
+			cmds = nil
+			return nil
+		}
+		br = bufio.NewReaderSize(next, 1<<16)
+	}
+}
+
+// DecompressCommand starts the named decompressor reading from r, returning
+// it along with a reader for the decompressed data. The caller must Wait for
+// the command after reading everything.
+func decompressCommand(ctx context.Context, r io.Reader, name string, args ...string) (*exec.Cmd, io.Reader, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin = r
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+	return cmd, stdout, nil
+}
+
+// IsDiskImageName reports whether name looks like a disk image, possibly
+// compressed.
+func isDiskImageName(name string) bool {
+	switch path.Ext(trimCompressionExt(name)) {
+	case ".qcow2", ".img", ".raw":
+		return true
+	}
+	return false
+}
+
+// FormatFromName returns the libvirt volume format of a disk image named
+// name, possibly compressed, or the empty string if the name doesn't tell.
+// Unlike diskFormat, it doesn't look at the contents, so .img files are of
+// unknown format.
+func formatFromName(name string) string {
+	switch path.Ext(trimCompressionExt(name)) {
+	case ".qcow2":
+		return "qcow2"
+	case ".raw":
+		return "raw"
+	}
+	return ""
+}
+
+// TrimCompressionExt returns the base of name, lower-cased and without the
+// extensions of the compression formats understood by unpackImage.
+func trimCompressionExt(name string) string {
+	name = strings.ToLower(path.Base(name))
+	for _, ext := range []string{".gz", ".bz2", ".xz", ".zst"} {
+		name = strings.TrimSuffix(name, ext)
+	}
+	return name
+}
@@ -0,0 +1,209 @@
+package libvirt
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"libvirt.org/libvirt-go"
+	libvirtxml "libvirt.org/libvirt-go-xml"
+	"slrz.net/runtopo/topology"
+)
+
+// CanUpdate reports whether Apply is able to update d in place, see Apply.
+// The management server and switch are reached using their DHCP lease, other
+// devices through the management server.
+func (r *Runner) canUpdate(d *device) bool {
+	if d == nil || len(r.sshAuth) == 0 {
+		return false
+	}
+	switch d.Name {
+	case "oob-mgmt-server", "oob-mgmt-switch":
+		return true
+	}
+	return r.devices["oob-mgmt-server"] != nil && d.MgmtIP() != nil
+}
+
+// UpdateDevices updates the running devices in updates from their state in
+// prev to the one in next.
+func (r *Runner) updateDevices(ctx context.Context, t *topology.T, prev, next *State, updates []DeviceChange) (err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("updateDevices: %w", err)
+		}
+	}()
+	prevDevs := make(map[string]StateDevice)
+	for _, d := range prev.Devices {
+		prevDevs[d.Name] = d
+	}
+	nextDevs := make(map[string]StateDevice)
+	for _, d := range next.Devices {
+		nextDevs[d.Name] = d
+	}
+
+	var oob *ssh.Client
+	defer func() {
+		if oob != nil {
+			oob.Close()
+		}
+	}()
+	for _, c := range updates {
+		d := r.devices[c.Device]
+		user := sshUser(d.Function().String())
+		var sc *ssh.Client
+		if d.Name == "oob-mgmt-server" || d.Name == "oob-mgmt-switch" {
+			sc, err = r.dialLease(ctx, d, user)
+		} else {
+			if oob == nil {
+				oob, err = r.dialLease(ctx,
+					r.devices["oob-mgmt-server"], "root")
+			}
+			if err == nil {
+				sc, err = proxyJump(ctx, oob, d.MgmtIP().IP.String(),
+					r.sshClientConfig(user))
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", d.Name, err)
+		}
+		p, n := prevDevs[d.Name], nextDevs[d.Name]
+		if !sameInterfaces(p.Interfaces, n.Interfaces) {
+			err = r.updateInterfaces(sc, d, user, p, n)
+		}
+		if err == nil {
+			switch d.Function() {
+			case topology.OOBServer:
+				err = r.updateMgmtServer(ctx, sc, t)
+			case topology.OOBSwitch:
+				err = r.updateMgmtBridge(sc, d)
+			}
+		}
+		sc.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", d.Name, err)
+		}
+	}
+	return nil
+}
+
+// DialLease connects to d as user using the address of its DHCP lease from
+// a libvirt network.
+func (r *Runner) dialLease(ctx context.Context, d *device, user string) (*ssh.Client, error) {
+	dom := r.domains[d.name]
+	if dom == nil {
+		return nil, fmt.Errorf("domain %s not found", d.name)
+	}
+	ip, err := waitForLease(ctx, dom)
+	if err != nil {
+		return nil, err
+	}
+	return r.dialSSH(ctx, ip.String(), user)
+}
+
+// UpdateMgmtServer rewrites the DHCP reservations and /etc/hosts entries of
+// the management server connected to by c and has dnsmasq reread them.
+func (r *Runner) updateMgmtServer(ctx context.Context, c *ssh.Client, t *topology.T) error {
+	hosts := gatherHosts(ctx, r, t)
+	script := "printf %s " +
+		shellQuote(string(generateDnsmasqHostsFile(hosts))) +
+		" >/etc/dnsmasq.hostsfile && " +
+		"sed -i " + shellQuote("/"+hostsMarker+"$/d") + " /etc/hosts && " +
+		"printf %s " + shellQuote(string(generateEtcHosts(hosts))) +
+		" >>/etc/hosts && " +
+		// SIGHUP has dnsmasq reread its hostsfiles and /etc/hosts.
+		"systemctl kill -s HUP dnsmasq.service"
+	_, err := runCommand(c, "sh", "-c", script)
+	return err
+}
+
+// UpdateInterfaces brings the network interfaces of the running device d,
+// connected to by c as user, from those in prev to those in next. The udev
+// rules naming the ports are put in place before hot-plugging them.
+func (r *Runner) updateInterfaces(c *ssh.Client, d *device, user string, prev, next StateDevice) error {
+	rules, err := renderUdevRules(d)
+	if err != nil {
+		return err
+	}
+	script := "printf %s " + shellQuote(string(rules)) +
+		" >/etc/udev/rules.d/70-persistent-net.rules && " +
+		"udevadm control --reload"
+	args := []string{"sh", "-c", script}
+	if user != "root" {
+		args = append([]string{"sudo"}, args...)
+	}
+	if _, err := runCommand(c, args[0], args[1:]...); err != nil {
+		return err
+	}
+
+	dom := r.domains[d.name]
+	if dom == nil {
+		return fmt.Errorf("domain %s not found", d.name)
+	}
+	xmlStr, err := dom.GetXMLDesc(0)
+	if err != nil {
+		return err
+	}
+	xmlDom := new(libvirtxml.Domain)
+	if err := xmlDom.Unmarshal(xmlStr); err != nil {
+		return err
+	}
+	current := make(map[string]libvirtxml.DomainInterface)
+	if xmlDom.Devices != nil {
+		for _, intf := range xmlDom.Devices.Interfaces {
+			if intf.MAC != nil {
+				current[strings.ToLower(intf.MAC.Address)] = intf
+			}
+		}
+	}
+	prevIntfs := make(map[string]StateInterface)
+	for _, intf := range prev.Interfaces {
+		prevIntfs[intf.Name] = intf
+	}
+	nextIntfs := make(map[string]StateInterface)
+	for _, intf := range next.Interfaces {
+		nextIntfs[intf.Name] = intf
+	}
+	same := func(x, y StateInterface) bool {
+		x.Peer, y.Peer = "", ""
+		return x == y
+	}
+
+	flags := libvirt.DOMAIN_DEVICE_MODIFY_LIVE |
+		libvirt.DOMAIN_DEVICE_MODIFY_CONFIG
+	for _, p := range prev.Interfaces {
+		if n, ok := nextIntfs[p.Name]; ok && same(p, n) {
+			continue
+		}
+		intf, ok := current[strings.ToLower(p.MAC)]
+		if !ok {
+			continue
+		}
+		intfXML, err := intf.Marshal()
+		if err != nil {
+			return err
+		}
+		if err := dom.DetachDeviceFlags(intfXML, flags); err != nil {
+			return fmt.Errorf("detach %s: %w", p.Name, err)
+		}
+	}
+	for _, intf := range d.templateArgs().Interfaces {
+		if p, ok := prevIntfs[intf.TargetDev]; ok &&
+			same(p, nextIntfs[intf.TargetDev]) {
+			continue
+		}
+		if err := dom.AttachDeviceFlags(marshalInterface(intf), flags); err != nil {
+			return fmt.Errorf("attach %s: %w", intf.TargetDev, err)
+		}
+	}
+	return nil
+}
+
+// UpdateMgmtBridge reconfigures the bridge of the management switch d,
+// connected to by c, for its current ports.
+func (r *Runner) updateMgmtBridge(c *ssh.Client, d *device) error {
+	script := "printf %s " + shellQuote(mgmtSwitchBridgeConf(d)) +
+		" >/etc/network/interfaces.d/bridge.intf && ifreload -a"
+	_, err := runCommand(c, "sudo", "sh", "-c", script)
+	return err
+}
@@ -12,6 +12,8 @@ type bmc struct {
 	Addr     string `json:"addr" yaml:"addr"`
 	User     string `json:"user" yaml:"user"`
 	Password string `json:"password" yaml:"password"`
+
+	uri string // libvirt connection URI of the domain's host, if not the default
 }
 
 type bmcConfig struct {
@@ -24,6 +26,7 @@ type bmcConfig struct {
 
 type bmcMan struct {
 	all      map[string]*bmc
+	reserved map[string]bool // addresses not to hand out
 	nextPort int
 
 	// immutable after initialization
@@ -36,6 +39,7 @@ type bmcMan struct {
 func newBMCMan(c *bmcConfig) *bmcMan {
 	m := &bmcMan{
 		all:      make(map[string]*bmc),
+		reserved: make(map[string]bool),
 		nextPort: 6230,
 		connect:  "qemu:///system",
 		addr:     "::",
@@ -66,10 +70,13 @@ func (m *bmcMan) add(domName string) (*bmc, error) {
 		return x, fmt.Errorf("add bmc for %s: already exists", domName)
 	}
 
-	port := m.nextPort
-	m.nextPort++
+	var addr string
+	for addr == "" || m.reserved[addr] {
+		addr = net.JoinHostPort(m.addr, strconv.Itoa(m.nextPort))
+		m.nextPort++
+	}
 	x := &bmc{
-		Addr:     net.JoinHostPort(m.addr, strconv.Itoa(port)),
+		Addr:     addr,
 		User:     m.user,
 		Password: m.password,
 	}
@@ -78,14 +85,36 @@ func (m *bmcMan) add(domName string) (*bmc, error) {
 	return x, nil
 }
 
-func (m *bmcMan) startAll(ctx context.Context) (err error) {
+// Reserve keeps add from handing out addr.
+func (m *bmcMan) reserve(addr string) {
+	m.reserved[addr] = true
+}
+
+// Restore registers a previously created BMC for domName.
+func (m *bmcMan) restore(domName, addr, user, password string) *bmc {
+	x := &bmc{
+		Addr:     addr,
+		User:     user,
+		Password: password,
+	}
+	m.all[domName] = x
+	m.reserved[addr] = true
+	return x
+}
+
+// Start adds and starts the virtual BMCs for the named domains.
+func (m *bmcMan) start(ctx context.Context, domNames ...string) (err error) {
 	var added []string
 	defer func() {
 		if err != nil && len(added) > 0 {
 			m.vbmcDelete(ctx, added...)
 		}
 	}()
-	for k, v := range m.all {
+	for _, k := range domNames {
+		v := m.all[k]
+		if v == nil {
+			continue
+		}
 		if err := m.vbmcAdd(ctx, k, v); err != nil {
 			return fmt.Errorf("vbmcAdd %s: %v", k, err)
 		}
@@ -118,8 +147,12 @@ func (m *bmcMan) vbmcAdd(ctx context.Context, domName string, bmc *bmc) error {
 	if err != nil {
 		return err
 	}
+	uri := m.connect
+	if bmc.uri != "" {
+		uri = bmc.uri
+	}
 	cmd := exec.CommandContext(ctx, "vbmc", "add",
-		"--libvirt-uri", m.connect,
+		"--libvirt-uri", uri,
 		"--address", host,
 		"--port", port,
 		"--username", bmc.User,
@@ -0,0 +1,322 @@
+package libvirt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"libvirt.org/libvirt-go"
+	"slrz.net/runtopo/topology"
+)
+
+// WithSSHAuth sets the authentication methods used when the Runner logs into
+// devices, e.g. for Verify. The public keys passed to WithAuthorizedKeys are
+// installed on all devices, so methods should offer one of the corresponding
+// private keys.
+func WithSSHAuth(methods ...ssh.AuthMethod) RunnerOption {
+	return func(r *Runner) {
+		r.sshAuth = methods
+	}
+}
+
+// A LinkStatus describes the outcome of verifying one end of a link.
+type LinkStatus int
+
+// Possible LinkStatus values.
+const (
+	LinkOK LinkStatus = iota
+	LinkMissing
+	LinkMismatch
+	LinkWrongPort
+	LinkUnreachable
+)
+
+func (s LinkStatus) String() string {
+	switch s {
+	case LinkOK:
+		return "ok"
+	case LinkMissing:
+		return "missing neighbor"
+	case LinkMismatch:
+		return "wrong neighbor"
+	case LinkWrongPort:
+		return "wrong port"
+	case LinkUnreachable:
+		return "unreachable"
+	}
+	return fmt.Sprintf("LinkStatus(%d)", int(s))
+}
+
+// A LinkCheck holds the result of comparing the LLDP neighbor seen on a
+// device port to the one expected from the topology.
+type LinkCheck struct {
+	Device, Port string
+	Want         string // expected neighbor as device:port
+	Got          string // observed neighbor as device:port, if any
+	Status       LinkStatus
+	Err          error // reason for LinkUnreachable
+}
+
+func (c *LinkCheck) String() string {
+	s := fmt.Sprintf("%s:%s: %s (want %s", c.Device, c.Port, c.Status, c.Want)
+	if c.Got != "" {
+		s += ", got " + c.Got
+	}
+	if c.Err != nil {
+		s += ", " + c.Err.Error()
+	}
+	return s + ")"
+}
+
+// An lldpNeighbor is a remote system seen on a local port.
+type lldpNeighbor struct {
+	device, port string
+}
+
+// Verify checks that the cabling of the running topology t matches its
+// description. It logs into every device through the oob-mgmt-server jump
+// host, collects the LLDP neighbors of each port and compares them to t's
+// links. Both ends of a link are checked independently. Links attached to
+// fake devices, devices without an operating system image or devices
+// unreachable over the management network (like the generated management
+// switches) are skipped.
+//
+// Verify requires the automatic management network and the SSH credentials
+// given using WithSSHAuth. The returned error is non-nil only if the
+// verification as a whole failed, problems with individual links are reported
+// using the returned LinkChecks.
+func (r *Runner) Verify(ctx context.Context, t *topology.T) (checks []LinkCheck, err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("libvirt.(*Runner).Verify: %w", err)
+		}
+	}()
+
+	uri, err := r.deviceURI(t, "oob-mgmt-server")
+	if err != nil {
+		return nil, err
+	}
+	c, err := libvirt.NewConnect(uri)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	dom, err := c.LookupDomainByName(r.namePrefix + "oob-mgmt-server")
+	if err != nil {
+		return nil, err
+	}
+	defer dom.Free()
+	ip, err := waitForLease(ctx, dom)
+	if err != nil {
+		return nil, err
+	}
+	oob, err := ssh.Dial("tcp", net.JoinHostPort(ip.String(), "22"),
+		r.sshClientConfig("root"))
+	if err != nil {
+		return nil, err
+	}
+	defer oob.Close()
+
+	type result struct {
+		name      string
+		neighbors map[string]lldpNeighbor
+		err       error
+	}
+	devs := verifiableDevices(t)
+	ch := make(chan result)
+	for _, d := range devs {
+		d := d
+		go func() {
+			ns, err := r.lldpNeighbors(ctx, oob, d)
+			ch <- result{d.Name, ns, err}
+		}()
+	}
+	neighbors := make(map[string]map[string]lldpNeighbor)
+	errs := make(map[string]error)
+	for range devs {
+		res := <-ch
+		neighbors[res.name] = res.neighbors
+		if res.err != nil {
+			errs[res.name] = res.err
+		}
+	}
+
+	return checkCabling(t, neighbors, errs), nil
+}
+
+func (r *Runner) sshClientConfig(user string) *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User: user,
+		Auth: r.sshAuth,
+		// Like the generated ssh_config, don't bother with host keys
+		// of freshly created VMs.
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+}
+
+// LLDPNeighbors returns the LLDP neighbors of d, keyed by local port.
+func (r *Runner) lldpNeighbors(ctx context.Context, oob *ssh.Client, d *topology.Device) (ns map[string]lldpNeighbor, err error) {
+	addr := d.Name
+	if ip := d.MgmtIP(); ip != nil {
+		addr = ip.String()
+	}
+	user, cmd := "root", []string{"lldpctl", "-f", "keyvalue"}
+	if hasCumulusFunction(&device{Device: *d}) {
+		user, cmd = "cumulus", append([]string{"sudo"}, cmd...)
+	}
+	c, err := proxyJump(ctx, oob, addr, r.sshClientConfig(user))
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	out, err := runCommand(c, cmd[0], cmd[1:]...)
+	if err != nil {
+		return nil, err
+	}
+	return parseLLDPKeyValue(out), nil
+}
+
+// ParseLLDPKeyValue parses the output of lldpctl -f keyvalue. The remote port
+// is taken from its interface name (as advertised with portidsubtype ifname),
+// falling back to the locally assigned port ID and the port description.
+func parseLLDPKeyValue(p []byte) map[string]lldpNeighbor {
+	type entry struct {
+		name, ifname, local, descr string
+	}
+	entries := make(map[string]*entry)
+	sc := bufio.NewScanner(bytes.NewReader(p))
+	for sc.Scan() {
+		kv := strings.SplitN(sc.Text(), "=", 2)
+		if len(kv) != 2 || !strings.HasPrefix(kv[0], "lldp.") {
+			continue
+		}
+		key := strings.TrimPrefix(kv[0], "lldp.")
+		i := strings.IndexByte(key, '.')
+		if i < 0 {
+			continue
+		}
+		port, field := key[:i], key[i+1:]
+		e := entries[port]
+		if e == nil {
+			e = new(entry)
+			entries[port] = e
+		}
+		switch field {
+		case "chassis.name":
+			// Device names never contain dots, strip the domain
+			// if lldpd advertises an FQDN.
+			e.name = strings.SplitN(kv[1], ".", 2)[0]
+		case "port.ifname":
+			e.ifname = kv[1]
+		case "port.local":
+			e.local = kv[1]
+		case "port.descr":
+			e.descr = kv[1]
+		}
+	}
+
+	ns := make(map[string]lldpNeighbor)
+	for port, e := range entries {
+		n := lldpNeighbor{device: e.name, port: e.ifname}
+		if n.port == "" {
+			n.port = e.local
+		}
+		if n.port == "" {
+			n.port = e.descr
+		}
+		ns[port] = n
+	}
+	return ns
+}
+
+// VerifiableDevices returns the devices of t running an LLDP agent and
+// reachable over the management network, sorted by name. Devices having
+// neither a management address nor an eth0, like the management switches
+// generated by topology.WithMgmtSwitchPorts, are left out.
+func verifiableDevices(t *topology.T) []*topology.Device {
+	hasEth0 := make(map[string]bool)
+	for _, l := range t.Links() {
+		if l.FromPort == "eth0" {
+			hasEth0[l.From] = true
+		}
+		if l.To != "" && l.ToPort == "eth0" {
+			hasEth0[l.To] = true
+		}
+	}
+	var ds []*topology.Device
+	for _, d := range t.Devices() {
+		d := d
+		if d.Function() == topology.Fake || d.OSImage() == "" {
+			continue
+		}
+		if d.MgmtIP() == nil && !hasEth0[d.Name] {
+			continue
+		}
+		ds = append(ds, &d)
+	}
+	sort.Slice(ds, func(i, j int) bool {
+		return ds[i].Name < ds[j].Name
+	})
+	return ds
+}
+
+// CheckCabling compares the observed LLDP neighbors (keyed by device and local
+// port) to the links of t. Devices whose neighbors could not be retrieved are
+// given in errs. The result is sorted by device and port.
+func checkCabling(t *topology.T, neighbors map[string]map[string]lldpNeighbor, errs map[string]error) []LinkCheck {
+	verifiable := make(map[string]bool)
+	for _, d := range verifiableDevices(t) {
+		verifiable[d.Name] = true
+	}
+
+	var checks []LinkCheck
+	check := func(dev, port, peer, peerPort string) {
+		c := LinkCheck{
+			Device: dev,
+			Port:   port,
+			Want:   peer + ":" + peerPort,
+		}
+		n, seen := neighbors[dev][port]
+		if seen {
+			c.Got = n.device + ":" + n.port
+		}
+		switch {
+		case errs[dev] != nil:
+			c.Status, c.Err = LinkUnreachable, errs[dev]
+		case !seen:
+			c.Status = LinkMissing
+		case n.device != peer:
+			c.Status = LinkMismatch
+		case n.port != peerPort:
+			c.Status = LinkWrongPort
+		default:
+			c.Status = LinkOK
+		}
+		checks = append(checks, c)
+	}
+	for _, l := range t.Links() {
+		if l.To == "" || l.Attr("libvirt_type") == "network" {
+			continue
+		}
+		// Without an LLDP agent on both ends, there's nothing to see.
+		if !verifiable[l.From] || !verifiable[l.To] {
+			continue
+		}
+		check(l.From, l.FromPort, l.To, l.ToPort)
+		check(l.To, l.ToPort, l.From, l.FromPort)
+	}
+
+	sort.Slice(checks, func(i, j int) bool {
+		if checks[i].Device != checks[j].Device {
+			return checks[i].Device < checks[j].Device
+		}
+		return natCompare(checks[i].Port, checks[j].Port) < 0
+	})
+	return checks
+}
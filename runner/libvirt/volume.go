@@ -1,11 +1,7 @@
 package libvirt
 
 import (
-	"context"
-	"fmt"
 	"io"
-	"net/url"
-	"path"
 
 	"libvirt.org/libvirt-go"
 	libvirtxml "libvirt.org/libvirt-go-xml"
@@ -25,6 +21,20 @@ func (w *streamWriter) Close() error {
 
 var _ io.WriteCloser = &streamWriter{}
 
+type streamReader struct {
+	stream *libvirt.Stream
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	n, err := r.stream.Recv(p)
+	if err == nil && n == 0 && len(p) > 0 {
+		return 0, io.EOF
+	}
+	return n, err
+}
+
+var _ io.Reader = &streamReader{}
+
 func newVolume(name string, size int64) *libvirtxml.StorageVolume {
 	return &libvirtxml.StorageVolume{
 		Name: name,
@@ -52,76 +62,24 @@ func newBackingStoreFromVol(vol *libvirt.StorageVol) (*libvirtxml.StorageVolumeB
 	if err != nil {
 		return nil, err
 	}
+	xmlStr, err := vol.GetXMLDesc(0)
+	if err != nil {
+		return nil, err
+	}
+	xmlVol := new(libvirtxml.StorageVolume)
+	if err := xmlVol.Unmarshal(xmlStr); err != nil {
+		return nil, err
+	}
+	// Base images are either qcow2 or raw, see prepareImage.
+	format := "qcow2"
+	if t := xmlVol.Target; t != nil && t.Format != nil && t.Format.Type != "" {
+		format = t.Format.Type
+	}
 
 	return &libvirtxml.StorageVolumeBackingStore{
 		Path: path,
 		Format: &libvirtxml.StorageVolumeTargetFormat{
-			// BUG(ls): We only support QCOW2 backing files in
-			// QCOW2 format. There's no reason we couldn't work
-			// with QCOW2 volumes backed by RAW images.
-			Type: "qcow2",
+			Type: format,
 		},
 	}, nil
 }
-
-func createVolumeFromURL(
-	ctx context.Context,
-	conn *libvirt.Connect,
-	pool *libvirt.StoragePool,
-	sourceURL string,
-) (vol *libvirt.StorageVol, err error) {
-
-	defer func() {
-		if err != nil {
-			err = fmt.Errorf("createVolumeFromURL: %w", err)
-		}
-	}()
-	u, err := url.Parse(sourceURL)
-	if err != nil {
-		return nil, fmt.Errorf("parse-url: %w", err)
-	}
-	imageName := path.Base(u.Path)
-
-	size, err := fetchImageContentLength(ctx, sourceURL)
-	if err != nil {
-		return nil, fmt.Errorf("fetch-length: %w", err)
-	}
-
-	volXML := newVolume(imageName, size)
-	xmlStr, err := volXML.Marshal()
-	if err != nil {
-		return nil, fmt.Errorf("marshal: %w", err)
-	}
-
-	vol, err = pool.StorageVolCreateXML(xmlStr, 0)
-	if err != nil {
-		return nil, fmt.Errorf("vol-create: %w", err)
-	}
-
-	stream, err := conn.NewStream(0)
-	if err != nil {
-		vol.Free()
-		return nil, fmt.Errorf("new-stream: %w", err)
-	}
-	defer stream.Free()
-
-	if err := vol.Upload(stream, 0, uint64(size), 0); err != nil {
-		vol.Free()
-		stream.Abort()
-		return nil, fmt.Errorf("vol-upload: %w", err)
-	}
-
-	sw := &streamWriter{stream: stream}
-	if err := fetchImage(ctx, sw, sourceURL); err != nil {
-		vol.Free()
-		stream.Abort()
-		return nil, fmt.Errorf("fetch: %w", err)
-	}
-
-	if err := stream.Finish(); err != nil {
-		vol.Free()
-		return nil, fmt.Errorf("stream-finish: %w", err)
-	}
-
-	return vol, nil
-}
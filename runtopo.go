@@ -1,5 +1,25 @@
 // Command runtopo starts up a network topology as described by the DOT file
 // provided as a positional argument.
+//
+// Resources created for a topology are recorded in a state file, allowing
+// "runtopo -destroy" to clean up without the topology file and "runtopo
+// -apply" to update a running topology after editing the topology file.
+// Passing -dryrun writes the would-be domain definitions, disk customizations
+// and address allocations to a directory instead.
+//
+// Additional modes of operation are selected by passing a command name before
+// the topology file:
+//
+//	runtopo [options…] lint topology.dot
+//	runtopo [options…] dump topology.dot
+//	runtopo [options…] diff old.dot new.dot
+//	runtopo [options…] plan [-yaml] topology.dot
+//	runtopo [options…] verify topology.dot
+//	runtopo [options…] status [-json] [topology.dot]
+//	runtopo [options…] images pull topology.dot
+//	runtopo [options…] images list [-json]
+//	runtopo [options…] images prune [-n]
+//	runtopo gen clos [-spines n] [-leaves n] [-hosts-per-leaf n] [-superspines n] [-oob]
 package main
 
 import (
@@ -13,6 +33,7 @@ import (
 	"os/user"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"syscall"
 
 	"slrz.net/runtopo/runner/libvirt"
@@ -36,6 +57,16 @@ var (
 		"leave `num` ports between local and remote side")
 	autoMgmt = flag.Bool("automgmt", os.Getenv("RUNTOPO_AUTO_MGMT") != "",
 		"create automagic management network")
+	mgmtPorts = flag.Int("mgmtports", atoi(getEnvOrDefault("RUNTOPO_MGMT_PORTS", "0")),
+		"attach at most `n` devices to each management switch")
+	mgmtGroup = flag.String("mgmtgroup", os.Getenv("RUNTOPO_MGMT_GROUP"),
+		"use a management switch per value of node `attribute`")
+	linkPool = flag.String("linkpool", os.Getenv("RUNTOPO_LINK_POOL"),
+		"assign point-to-point addresses to fabric links from comma-separated `prefixes`")
+	loopbackPool = flag.String("loopbackpool", os.Getenv("RUNTOPO_LOOPBACK_POOL"),
+		"assign loopback addresses from comma-separated `prefixes`")
+	fabricMode = flag.String("fabric", os.Getenv("RUNTOPO_FABRIC"),
+		"generate BGP fabric configuration (`mode` unnumbered or numbered)")
 	storagePool = flag.String("pool",
 		getEnvOrDefault("RUNTOPO_LIBVIRT_POOL", "default"),
 		"store downloaded base and created diff images in libvirt storage `pool`")
@@ -45,22 +76,52 @@ var (
 	writeBMCConfig = flag.String("writebmcconfig",
 		os.Getenv("RUNTOPO_WRITE_BMC_CONFIG"),
 		"write JSON `file` containing virtual BMC addresses")
+	writeInventory = flag.String("writeinventory",
+		os.Getenv("RUNTOPO_WRITE_INVENTORY"),
+		"write Ansible inventory to `file`")
+	startOrder = flag.String("startorder", os.Getenv("RUNTOPO_START_ORDER"),
+		"start devices in comma-separated `groups` first, in order")
+	startOnly = flag.String("only", os.Getenv("RUNTOPO_ONLY"),
+		"start only devices in comma-separated `groups`")
 	bmcAddr = flag.String("bmcaddr",
 		os.Getenv("RUNTOPO_BMC_ADDR"),
 		"make virtual BMCs bind to `address`")
 	destroy = flag.Bool("destroy", os.Getenv("RUNTOPO_DESTROY") != "",
 		"destroy resources created by previous invocation")
+	dryRun = flag.String("dryrun", os.Getenv("RUNTOPO_DRYRUN"),
+		"write the artifacts to `directory` instead of creating them")
+	apply = flag.Bool("apply", os.Getenv("RUNTOPO_APPLY") != "",
+		"reconcile the running topology with the topology file")
+	stateDir = flag.String("statedir",
+		getEnvOrDefault("RUNTOPO_STATE_DIR", defaultStateDir()),
+		"record created resources in `directory`")
+	defaultsFile = flag.String("defaults", os.Getenv("RUNTOPO_DEFAULTS"),
+		"read device defaults from YAML `file`")
+	hostsFile = flag.String("hosts", os.Getenv("RUNTOPO_HOSTS"),
+		"spread devices across the hypervisors listed in YAML `file`")
+	imageCache = flag.String("imagecache", os.Getenv("RUNTOPO_IMAGE_CACHE"),
+		"keep downloaded base images in `directory`")
+	imageDir = flag.String("imagedir", os.Getenv("RUNTOPO_IMAGE_DIR"),
+		"take base images from `directory` instead of downloading them")
 )
 
 func main() {
 	log.SetFlags(0)
 	log.SetPrefix(filepath.Base(os.Args[0]) + ": ")
-	if flag.Parse(); flag.NArg() != 1 {
-		log.Fatalf("usage: runtopo [options…] topology.dot")
+	flag.Parse()
+	if flag.NArg() > 0 {
+		if cmd := commands[flag.Arg(0)]; cmd != nil {
+			cmd(flag.Args()[1:])
+			return
+		}
 	}
-	var topoOpts []topology.Option
-	if *autoMgmt {
-		topoOpts = append(topoOpts, topology.WithAutoMgmtNetwork)
+	if *destroy && flag.NArg() == 0 {
+		// Topology not needed, destroy what's recorded in the state.
+		destroyFromState()
+		return
+	}
+	if flag.NArg() != 1 {
+		log.Fatalf("usage: runtopo [options…] [command] topology.dot")
 	}
 
 	keys, err := loadSSHPublicKeys()
@@ -72,6 +133,17 @@ func main() {
 		log.Fatalf("cannot parse tunnelip %q", *tunnelIP)
 	}
 
+	topoOpts := topologyOptions(flag.Arg(0))
+	if *apply && *stateDir != "" {
+		// Keep the management addresses of the running topology.
+		if s, err := libvirt.LoadState(*stateDir, *namePrefix); err == nil {
+			ips := make(map[string][]string)
+			for _, d := range s.Devices {
+				ips[d.Name] = d.MgmtIPs
+			}
+			topoOpts = append(topoOpts, topology.WithPreferredMgmtIPs(ips))
+		}
+	}
 	topo, err := topology.ParseFile(flag.Arg(0), topoOpts...)
 	if err != nil {
 		log.Fatal(err)
@@ -86,9 +158,19 @@ func main() {
 		libvirt.WithAuthorizedKeys(keys...),
 		libvirt.WithConfigFS(os.DirFS(filepath.Dir(flag.Arg(0)))),
 	}
+	if s := *stateDir; s != "" {
+		runnerOpts = append(runnerOpts, libvirt.WithStateDir(s))
+	}
 	if s := *libvirtURI; s != "" {
 		runnerOpts = append(runnerOpts, libvirt.WithConnectionURI(s))
 	}
+	runnerOpts = append(runnerOpts, hostsOptions()...)
+	if s := *imageCache; s != "" {
+		runnerOpts = append(runnerOpts, libvirt.WithImageCache(s))
+	}
+	if s := *imageDir; s != "" {
+		runnerOpts = append(runnerOpts, libvirt.WithImageDir(s))
+	}
 	if s := *macAddrBase; s != "" {
 		base, err := net.ParseMAC(s)
 		if err != nil {
@@ -120,9 +202,44 @@ func main() {
 		}()
 		runnerOpts = append(runnerOpts, libvirt.WriteBMCConfig(fd))
 	}
+	if s := *writeInventory; s != "" {
+		fd, err := os.Create(s)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer func() {
+			if err := fd.Close(); err != nil {
+				log.Printf("writeinventory: %v", err)
+			}
+		}()
+		runnerOpts = append(runnerOpts, libvirt.WriteInventory(fd))
+	}
 	if s := *bmcAddr; s != "" {
 		runnerOpts = append(runnerOpts, libvirt.WithBMCAddr(s))
 	}
+	if s := *fabricMode; s != "" {
+		mode, err := libvirt.ParseFabricMode(s)
+		if err != nil {
+			log.Fatal(err)
+		}
+		runnerOpts = append(runnerOpts, libvirt.WithFabric(mode))
+	}
+	if s := *startOrder; s != "" {
+		runnerOpts = append(runnerOpts,
+			libvirt.WithStartOrder(strings.Split(s, ",")...))
+	}
+	if s := *startOnly; s != "" {
+		runnerOpts = append(runnerOpts,
+			libvirt.WithStartOnly(strings.Split(s, ",")...))
+	}
+	if *apply {
+		// Used for updating the management devices in place.
+		if auth, err := sshAuthMethods(); err == nil {
+			runnerOpts = append(runnerOpts, libvirt.WithSSHAuth(auth...))
+		} else {
+			log.Printf("not updating management devices in place: %v", err)
+		}
+	}
 	r := libvirt.NewRunner(runnerOpts...)
 
 	ctx, cancel := signal.NotifyContext(context.Background(),
@@ -131,29 +248,144 @@ func main() {
 	// TODO(ls): revert to default signal disposition a couple of seconds
 	// after ctx gets canceled?
 
+	if dir := *dryRun; dir != "" {
+		if err := r.DryRun(ctx, topo, dir); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	if *destroy {
 		if err := r.Destroy(ctx, topo); err != nil {
 			log.Fatal(err)
 		}
 		return
 	}
+	if *apply {
+		changes, err := r.Apply(ctx, topo)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, c := range changes {
+			log.Print(c)
+		}
+		if len(changes) == 0 {
+			log.Print("running topology is up to date")
+		}
+		return
+	}
 
 	if err := r.Run(ctx, topo); err != nil {
 		log.Fatal(err)
 	}
 }
 
-func loadSSHPublicKeys() ([]string, error) {
-	home := os.Getenv("HOME")
-	if home == "" {
-		u, err := user.Current()
-		if err != nil {
-			return nil, err
+// Commands maps command names to their implementation. Each function is
+// passed the remaining positional arguments.
+var commands = map[string]func(args []string){
+	"lint":   lintMain,
+	"gen":    genMain,
+	"dump":   dumpMain,
+	"diff":   diffMain,
+	"plan":   planMain,
+	"verify": verifyMain,
+	"status": statusMain,
+	"images": imagesMain,
+}
+
+// TopologyOptions returns the topology.Options requested on the command line
+// for parsing the topology file at path.
+//
+// Device defaults are loaded from, in order of increasing precedence, the
+// per-user file $XDG_CONFIG_HOME/runtopo/defaults.yaml, a file named like the
+// topology but with extension .defaults.yaml and the file given by -defaults.
+func topologyOptions(path string) []topology.Option {
+	var opts []topology.Option
+	if *autoMgmt {
+		opts = append(opts, topology.WithAutoMgmtNetwork)
+	}
+	if *mgmtPorts > 0 {
+		opts = append(opts, topology.WithMgmtSwitchPorts(*mgmtPorts))
+	}
+	if *mgmtGroup != "" {
+		opts = append(opts, topology.WithMgmtGroupAttr(*mgmtGroup))
+	}
+	if s := *linkPool; s != "" {
+		for _, p := range strings.Split(s, ",") {
+			opts = append(opts, topology.WithLinkAddressPool(p))
 		}
-		home = u.HomeDir
 	}
-	dotSSH := filepath.Join(home, ".ssh")
-	files, err := filepath.Glob(dotSSH + "/id_*.pub")
+	if s := *loopbackPool; s != "" {
+		for _, p := range strings.Split(s, ",") {
+			opts = append(opts, topology.WithLoopbackPool(p))
+		}
+	}
+	if dir, err := os.UserConfigDir(); err == nil {
+		file := filepath.Join(dir, "runtopo", "defaults.yaml")
+		if fileExists(file) {
+			opts = append(opts, topology.WithDefaultsFile(file))
+		}
+	}
+	file := strings.TrimSuffix(path, filepath.Ext(path)) + ".defaults.yaml"
+	if fileExists(file) {
+		opts = append(opts, topology.WithDefaultsFile(file))
+	}
+	if s := *defaultsFile; s != "" {
+		opts = append(opts, topology.WithDefaultsFile(s))
+	}
+	return opts
+}
+
+// HostsOptions returns the Runner options for the hosts file given using
+// -hosts, if any.
+func hostsOptions() []libvirt.RunnerOption {
+	if *hostsFile == "" {
+		return nil
+	}
+	hosts, err := libvirt.LoadHosts(*hostsFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return []libvirt.RunnerOption{libvirt.WithHosts(hosts...)}
+}
+
+// DestroyFromState destroys the resources recorded in the state file for
+// the configured name prefix.
+func destroyFromState() {
+	if *stateDir == "" {
+		log.Fatalf("-destroy without topology requires -statedir")
+	}
+	s, err := libvirt.LoadState(*stateDir, *namePrefix)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(),
+		os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	r := libvirt.NewRunner(libvirt.WithStateDir(*stateDir))
+	if err := r.DestroyState(ctx, s); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// DefaultStateDir returns the directory for state files, following the XDG
+// base directory specification ($XDG_STATE_HOME/runtopo).
+func defaultStateDir() string {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "runtopo")
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".local", "state", "runtopo")
+	}
+	return ""
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func loadSSHPublicKeys() ([]string, error) {
+	files, err := sshPublicKeyFiles()
 	if err != nil {
 		return nil, err
 	}
@@ -170,6 +402,21 @@ func loadSSHPublicKeys() ([]string, error) {
 	return keys, nil
 }
 
+// SSHPublicKeyFiles returns the names of the user's public key files
+// (~/.ssh/id_*.pub).
+func sshPublicKeyFiles() ([]string, error) {
+	home := os.Getenv("HOME")
+	if home == "" {
+		u, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		home = u.HomeDir
+	}
+	dotSSH := filepath.Join(home, ".ssh")
+	return filepath.Glob(dotSSH + "/id_*.pub")
+}
+
 func getEnvOrDefault(key, def string) string {
 	if v := os.Getenv(key); v != "" {
 		return v
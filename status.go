@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"slrz.net/runtopo/runner/libvirt"
+	"slrz.net/runtopo/topology"
+)
+
+// StatusMain implements the status command. It prints the state of each
+// device of a running topology as a table or, with -json, as a JSON array.
+// The topology file may be omitted if there's a state file.
+func statusMain(args []string) {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "write JSON instead of a table")
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		log.Fatalf("usage: runtopo [options…] status [-json] [topology.dot]")
+	}
+
+	var topo *topology.T
+	if fs.NArg() == 1 {
+		var err error
+		topo, err = topology.ParseFile(fs.Arg(0), topologyOptions(fs.Arg(0))...)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	runnerOpts := []libvirt.RunnerOption{
+		libvirt.WithNamePrefix(*namePrefix),
+	}
+	if s := *libvirtURI; s != "" {
+		runnerOpts = append(runnerOpts, libvirt.WithConnectionURI(s))
+	}
+	if s := *stateDir; s != "" {
+		runnerOpts = append(runnerOpts, libvirt.WithStateDir(s))
+	}
+	runnerOpts = append(runnerOpts, hostsOptions()...)
+	if auth, err := sshAuthMethods(); err == nil {
+		runnerOpts = append(runnerOpts, libvirt.WithSSHAuth(auth...))
+	} else {
+		log.Printf("not checking SSH reachability: %v", err)
+	}
+	r := libvirt.NewRunner(runnerOpts...)
+
+	ctx, cancel := signal.NotifyContext(context.Background(),
+		os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	status, err := r.Status(ctx, topo)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *asJSON {
+		p, err := json.MarshalIndent(status, "", "\t")
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Stdout.Write(append(p, '\n'))
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "DEVICE\tSTATE\tUPTIME\tMGMT IP\tBMC\tSSH")
+	for _, st := range status {
+		uptime := "-"
+		if st.Booted != nil {
+			uptime = time.Since(*st.Booted).Truncate(time.Second).String()
+		}
+		ssh := "no"
+		switch {
+		case st.SSH:
+			ssh = "yes"
+		case st.Unmanaged:
+			ssh = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", st.Name, st.State,
+			uptime, orDash(st.MgmtIP), orDash(st.BMC), ssh)
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,231 @@
+package topology
+
+import (
+	"fmt"
+	"sort"
+
+	"inet.af/netaddr"
+)
+
+// WithLinkAddressPool enables automatic addressing of fabric links. Each link
+// not belonging to the management network is assigned a point-to-point prefix
+// (/31 for IPv4, /127 for IPv6) allocated from prefix. Passing an IPv4 and an
+// IPv6 pool results in dual-stack links. Pools given later replace earlier
+// ones of the same address family. The result is available from AddressPlan.
+func WithLinkAddressPool(prefix string) Option {
+	return func(t *T) {
+		t.linkPools = append(t.linkPools, prefix)
+	}
+}
+
+// WithLoopbackPool enables automatic assignment of loopback addresses (/32
+// for IPv4, /128 for IPv6) from prefix to all simulated devices except the
+// management server and switches. The network and broadcast addresses of
+// prefix are skipped unless it's too small to have them (/31 or /32, /127 or
+// /128). Like with WithLinkAddressPool, an IPv4 and an IPv6 pool may be
+// combined.
+func WithLoopbackPool(prefix string) Option {
+	return func(t *T) {
+		t.loopbackPools = append(t.loopbackPools, prefix)
+	}
+}
+
+// An AddressPlan holds the addresses assigned to device loopbacks and
+// fabric links. Addresses are given in CIDR notation (e.g. 10.0.0.1/32 or
+// 10.1.0.0/31). It may be marshaled to JSON or YAML for consumption by
+// configuration templates.
+type AddressPlan struct {
+	Loopbacks []LoopbackAddress `json:"loopbacks,omitempty" yaml:"loopbacks,omitempty"`
+	Links     []LinkAddress     `json:"links,omitempty" yaml:"links,omitempty"`
+}
+
+// A LoopbackAddress lists the loopback addresses of a device.
+type LoopbackAddress struct {
+	Device string   `json:"device" yaml:"device"`
+	Addrs  []string `json:"addrs" yaml:"addrs"`
+}
+
+// A LinkAddress lists the addresses of both sides of a link.
+type LinkAddress struct {
+	From      string   `json:"from" yaml:"from"`
+	FromPort  string   `json:"from_port" yaml:"from_port"`
+	FromAddrs []string `json:"from_addrs" yaml:"from_addrs"`
+	To        string   `json:"to" yaml:"to"`
+	ToPort    string   `json:"to_port" yaml:"to_port"`
+	ToAddrs   []string `json:"to_addrs" yaml:"to_addrs"`
+}
+
+// AddressPlan returns the addresses allocated for loopbacks and links, or nil
+// if neither WithLinkAddressPool nor WithLoopbackPool were given.
+func (t *T) AddressPlan() *AddressPlan {
+	return t.plan
+}
+
+// Loopback returns the loopback addresses assigned to the named device.
+func (p *AddressPlan) Loopback(device string) []string {
+	for _, lo := range p.Loopbacks {
+		if lo.Device == device {
+			return append([]string(nil), lo.Addrs...)
+		}
+	}
+	return nil
+}
+
+// Interface returns the addresses assigned to the named device's port.
+func (p *AddressPlan) Interface(device, port string) []string {
+	for _, l := range p.Links {
+		switch {
+		case l.From == device && l.FromPort == port:
+			return append([]string(nil), l.FromAddrs...)
+		case l.To == device && l.ToPort == port:
+			return append([]string(nil), l.ToAddrs...)
+		}
+	}
+	return nil
+}
+
+// ParsePools parses the pool prefixes ps, keeping the last one given for each
+// address family. The IPv4 pool, if any, comes first.
+func parsePools(ps []string, maxBits4, maxBits6 uint8) ([]netaddr.IPPrefix, error) {
+	var v4, v6 netaddr.IPPrefix
+	for _, s := range ps {
+		p, err := netaddr.ParseIPPrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		p = p.Masked()
+		switch {
+		case p.IP.Is4() && p.Bits <= maxBits4:
+			v4 = p
+		case p.IP.Is6() && p.Bits <= maxBits6:
+			v6 = p
+		default:
+			return nil, fmt.Errorf("pool %s: prefix too long", s)
+		}
+	}
+	var pools []netaddr.IPPrefix
+	for _, p := range []netaddr.IPPrefix{v4, v6} {
+		if !p.IsZero() {
+			pools = append(pools, p)
+		}
+	}
+	return pools, nil
+}
+
+// PlanAddresses allocates the address plan as requested by the
+// WithLinkAddressPool and WithLoopbackPool options. Devices and links are
+// visited in sorted order, so the result only depends on the topology and not
+// on the order of its description.
+func (t *T) planAddresses() (err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("address plan: %w", err)
+		}
+	}()
+	if len(t.linkPools) == 0 && len(t.loopbackPools) == 0 {
+		return nil
+	}
+	linkPools, err := parsePools(t.linkPools, 31, 127)
+	if err != nil {
+		return err
+	}
+	loopbackPools, err := parsePools(t.loopbackPools, 32, 128)
+	if err != nil {
+		return err
+	}
+
+	plan := new(AddressPlan)
+	if len(loopbackPools) > 0 {
+		var allocs []*ipAllocator
+		for _, p := range loopbackPools {
+			allocs = append(allocs, newHostAllocator(p))
+		}
+		names := make([]string, 0, len(t.devs))
+		for name := range t.devs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			switch t.devs[name].Function() {
+			case Fake, OOBServer, OOBSwitch:
+				continue
+			}
+			lo := LoopbackAddress{Device: name}
+			for i, a := range allocs {
+				ip, ok := a.allocate()
+				if !ok {
+					return fmt.Errorf("loopback pool %s exhausted",
+						loopbackPools[i])
+				}
+				lo.Addrs = append(lo.Addrs,
+					netaddr.IPPrefix{IP: ip, Bits: ip.BitLen()}.String())
+			}
+			plan.Loopbacks = append(plan.Loopbacks, lo)
+		}
+	}
+
+	if len(linkPools) > 0 {
+		var allocs []*ipAllocator
+		for _, p := range linkPools {
+			allocs = append(allocs, newPrefixAllocator(p))
+		}
+		for _, l := range t.fabricLinks() {
+			la := LinkAddress{
+				From:     l.From,
+				FromPort: l.FromPort,
+				To:       l.To,
+				ToPort:   l.ToPort,
+			}
+			for i, a := range allocs {
+				bits := linkPools[i].IP.BitLen() - 1
+				p, ok := a.allocatePrefix(bits)
+				if !ok {
+					return fmt.Errorf("link pool %s exhausted",
+						linkPools[i])
+				}
+				la.FromAddrs = append(la.FromAddrs,
+					netaddr.IPPrefix{IP: p.IP, Bits: bits}.String())
+				la.ToAddrs = append(la.ToAddrs,
+					netaddr.IPPrefix{IP: p.IP.Next(), Bits: bits}.String())
+			}
+			plan.Links = append(plan.Links, la)
+		}
+	}
+
+	t.plan = plan
+	return nil
+}
+
+// FabricLinks returns the links eligible for point-to-point addressing, with
+// the lesser endpoint first and sorted by endpoints. Links to libvirt networks
+// and those attached to the management server or switches are excluded.
+func (t *T) fabricLinks() []Link {
+	var ls []Link
+	for _, l := range t.links() {
+		if l.To == "" || l.Attr("libvirt_type") == "network" {
+			continue
+		}
+		if isMgmtDevice(t.devs[l.From]) || isMgmtDevice(t.devs[l.To]) {
+			continue
+		}
+		if l.To+":"+l.ToPort < l.From+":"+l.FromPort {
+			l = Link{
+				From:     l.To,
+				FromPort: l.ToPort,
+				To:       l.From,
+				ToPort:   l.FromPort,
+				attrs:    swapSides(l.attrs),
+			}
+		}
+		ls = append(ls, l)
+	}
+	sort.Slice(ls, func(i, j int) bool {
+		return ls[i].String() < ls[j].String()
+	})
+	return ls
+}
+
+func isMgmtDevice(d *Device) bool {
+	f := d.Function()
+	return f == OOBServer || f == OOBSwitch
+}
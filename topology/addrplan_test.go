@@ -0,0 +1,125 @@
+package topology
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAddressPlan(t *testing.T) {
+	topo, err := ParseFile("testdata/leafspine.dot",
+		WithAutoMgmtNetwork,
+		WithLinkAddressPool("10.1.0.0/24"),
+		WithLinkAddressPool("fd00:1::/64"),
+		WithLoopbackPool("10.0.0.0/24"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan := topo.AddressPlan()
+	if plan == nil {
+		t.Fatal("got nil address plan")
+	}
+
+	// The links of host0 (a fake device) are included but those of the
+	// management network are not.
+	if got, want := len(plan.Links), 7; got != want {
+		t.Errorf("got %d links, want %d", got, want)
+	}
+	for _, test := range []struct {
+		device, port string
+		want         []string
+	}{
+		{"host0", "eno1", []string{"10.1.0.0/31", "fd00:1::/127"}},
+		{"leaf2", "swp3", []string{"10.1.0.1/31", "fd00:1::1/127"}},
+		{"leaf0", "swp1", []string{"10.1.0.2/31", "fd00:1::2/127"}},
+		{"spine0", "swp1", []string{"10.1.0.3/31", "fd00:1::3/127"}},
+		{"leaf0", "eth0", nil},
+	} {
+		got := plan.Interface(test.device, test.port)
+		if strings.Join(got, " ") != strings.Join(test.want, " ") {
+			t.Errorf("%s:%s: got %v, want %v",
+				test.device, test.port, got, test.want)
+		}
+	}
+
+	var loopbacks []string
+	for _, lo := range plan.Loopbacks {
+		loopbacks = append(loopbacks, lo.Device+"="+strings.Join(lo.Addrs, ","))
+	}
+	want := "leaf0=10.0.0.1/32 leaf1=10.0.0.2/32 leaf2=10.0.0.3/32 " +
+		"spine0=10.0.0.4/32 spine1=10.0.0.5/32"
+	if got := strings.Join(loopbacks, " "); got != want {
+		t.Errorf("got loopbacks %s, want %s", got, want)
+	}
+}
+
+func TestAddressPlanSmallLoopbackPools(t *testing.T) {
+	const G = `graph G {
+		"leaf0" [function=leaf]
+		"spine0" [function=spine]
+		"leaf0":swp1 -- "spine0":swp1
+	}`
+	for _, test := range []struct {
+		pools []string
+		want  string
+	}{
+		{[]string{"10.0.0.7/31"}, "leaf0=10.0.0.6/32 spine0=10.0.0.7/32"},
+		{[]string{"fd00::/127"}, "leaf0=fd00::/128 spine0=fd00::1/128"},
+		{[]string{"10.0.0.0/30"}, "leaf0=10.0.0.1/32 spine0=10.0.0.2/32"},
+		{[]string{"10.0.0.7/32"}, "exhausted"},
+		{[]string{"fd00::1/128"}, "exhausted"},
+	} {
+		var opts []Option
+		for _, p := range test.pools {
+			opts = append(opts, WithLoopbackPool(p))
+		}
+		topo, err := Parse([]byte(G), opts...)
+		if err != nil {
+			if !strings.Contains(err.Error(), test.want) {
+				t.Errorf("%v: got err=%v, want %q", test.pools, err, test.want)
+			}
+			continue
+		}
+		var loopbacks []string
+		for _, lo := range topo.AddressPlan().Loopbacks {
+			loopbacks = append(loopbacks, lo.Device+"="+strings.Join(lo.Addrs, ","))
+		}
+		if got := strings.Join(loopbacks, " "); got != test.want {
+			t.Errorf("%v: got loopbacks %s, want %s", test.pools, got, test.want)
+		}
+	}
+
+	// A single device fits into a /32.
+	topo, err := Parse([]byte(`graph G { "leaf0" [function=leaf] }`),
+		WithLoopbackPool("10.0.0.7/32"), WithLoopbackPool("fd00::1/128"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := topo.AddressPlan().Loopback("leaf0")
+	if want := "10.0.0.7/32 fd00::1/128"; strings.Join(got, " ") != want {
+		t.Errorf("got loopback %v, want %s", got, want)
+	}
+}
+
+func TestAddressPlanErrors(t *testing.T) {
+	for _, test := range []struct {
+		opt  Option
+		want string
+	}{
+		{WithLinkAddressPool("10.1.0.0/30"), "exhausted"},
+		{WithLinkAddressPool("10.1.0.0/32"), "too long"},
+		{WithLoopbackPool("fd00::/129"), "fd00::/129"},
+	} {
+		_, err := ParseFile("testdata/leafspine.dot", test.opt)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("got err=%v, want %q", err, test.want)
+		}
+	}
+
+	topo, err := ParseFile("testdata/leafspine.dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan := topo.AddressPlan(); plan != nil {
+		t.Errorf("got address plan %v without pools", plan)
+	}
+}
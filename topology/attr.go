@@ -0,0 +1,200 @@
+package topology
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"inet.af/netaddr"
+)
+
+// An attrType determines the accepted syntax of an attribute value.
+type attrType int
+
+const (
+	attrString   attrType = iota
+	attrInt               // positive decimal integer
+	attrSize              // size with optional unit suffix (e.g. 2GiB)
+	attrFlag              // enabled by presence, value must be truthy
+	attrIP                // IPv4 or IPv6 address
+	attrIPOrCIDR          // address, optionally with prefix length
+	attrMAC               // EUI-48 MAC address
+	attrEnum              // one of attrSpec.allowed
+)
+
+// An attrSpec declares a node or edge attribute understood by runtopo.
+type attrSpec struct {
+	name    string
+	typ     attrType
+	unit    int64    // attrSize: unit assumed for bare numbers
+	nonZero bool     // attrSize: reject zero sizes
+	allowed []string // attrEnum: permitted values
+}
+
+var nodeAttrSpecs = []attrSpec{
+	{name: "os", typ: attrString},
+	{name: "os_sha256", typ: attrString},
+	{name: "config", typ: attrString},
+	{name: "cpu", typ: attrInt},
+	{name: "memory", typ: attrSize, unit: 1 << 20, nonZero: true},
+	{name: "disk", typ: attrSize, unit: 1 << 30},
+	{name: "tunnelip", typ: attrIP},
+	{name: "host", typ: attrString},
+	{name: "mgmt_ip", typ: attrIPOrCIDR},
+	{name: "mgmt_ip6", typ: attrIPOrCIDR},
+	{name: "rack", typ: attrString},
+	{name: "no_mgmt", typ: attrFlag},
+	{name: "bmc", typ: attrFlag},
+	{name: "efi", typ: attrFlag},
+	{name: "bgp_asn", typ: attrInt},
+	{name: "function", typ: attrEnum, allowed: deviceFunctionNames()},
+}
+
+var edgeAttrSpecs = []attrSpec{
+	{name: "left_mac", typ: attrMAC},
+	{name: "right_mac", typ: attrMAC},
+	{name: "left_pxe", typ: attrFlag},
+	{name: "right_pxe", typ: attrFlag},
+	{name: "libvirt_type", typ: attrEnum, allowed: []string{"network"}},
+}
+
+func deviceFunctionNames() []string {
+	var names []string
+	for f := DeviceFunction(0); f < NoFunction; f++ {
+		names = append(names, f.String())
+	}
+	return names
+}
+
+func lookupAttrSpec(specs []attrSpec, name string) *attrSpec {
+	for i := range specs {
+		if specs[i].name == name {
+			return &specs[i]
+		}
+	}
+	return nil
+}
+
+// CheckAttrs validates attrs against specs, returning a description for each
+// unknown or malformed attribute. The result is sorted by attribute name.
+func checkAttrs(specs []attrSpec, attrs map[string]string) []string {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var problems []string
+	for _, k := range keys {
+		spec := lookupAttrSpec(specs, k)
+		if spec == nil {
+			problems = append(problems,
+				fmt.Sprintf("unknown attribute %s", k))
+			continue
+		}
+		if err := spec.check(attrs[k]); err != nil {
+			problems = append(problems,
+				fmt.Sprintf("attribute %s: %v", k, err))
+		}
+	}
+	return problems
+}
+
+func (s *attrSpec) check(v string) error {
+	switch s.typ {
+	case attrInt:
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("want positive integer, got %q", v)
+		}
+	case attrSize:
+		n, err := ParseSize(v, s.unit)
+		if err != nil {
+			return err
+		}
+		if n == 0 && s.nonZero {
+			return fmt.Errorf("want non-zero size, got %q", v)
+		}
+	case attrFlag:
+		if !isTruthy(v) {
+			return fmt.Errorf("flag attributes are enabled by "+
+				"presence, remove it instead of setting %q", v)
+		}
+	case attrIP:
+		if _, err := netaddr.ParseIP(v); err != nil {
+			return fmt.Errorf("want IP address, got %q", v)
+		}
+	case attrIPOrCIDR:
+		if _, err := netaddr.ParseIP(v); err == nil {
+			return nil
+		}
+		if _, err := netaddr.ParseIPPrefix(v); err != nil {
+			return fmt.Errorf("want IP address or prefix, got %q", v)
+		}
+	case attrMAC:
+		if mac, err := net.ParseMAC(v); err != nil || len(mac) != 6 {
+			return fmt.Errorf("want EUI-48 MAC address, got %q", v)
+		}
+	case attrEnum:
+		for _, a := range s.allowed {
+			if v == a {
+				return nil
+			}
+		}
+		return fmt.Errorf("got %q, want one of [%s]",
+			v, strings.Join(s.allowed, ", "))
+	}
+	return nil
+}
+
+func isTruthy(v string) bool {
+	switch strings.ToLower(v) {
+	case "1", "t", "true", "y", "yes", "on":
+		return true
+	}
+	return false
+}
+
+var sizeSuffixes = []struct {
+	suffix string
+	mult   int64
+}{
+	// Longest suffixes first so that "KiB" isn't taken for "B".
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+	{"B", 1},
+}
+
+// ParseSize parses a size as used for the memory and disk attributes and
+// returns it in bytes. Bare numbers are multiplied by unit. A unit suffix may
+// be given following libvirt's conventions: K, M, G and T (as well as KiB,
+// MiB, …) are powers of 1024, while KB, MB, GB and TB are powers of 1000.
+// Numbers are decimal, leading zeros don't make them octal. Only bare numbers
+// may also be given in hex (e.g. 0x400), so 0x1B is an error rather than 27
+// bytes or units.
+func ParseSize(s string, unit int64) (int64, error) {
+	num, mult := strings.TrimSpace(s), unit
+	suffixed := false
+	for _, x := range sizeSuffixes {
+		if strings.HasSuffix(num, x.suffix) {
+			num = strings.TrimSpace(strings.TrimSuffix(num, x.suffix))
+			mult, suffixed = x.mult, true
+			break
+		}
+	}
+	base := 10
+	if !suffixed && (strings.HasPrefix(num, "0x") || strings.HasPrefix(num, "0X")) {
+		num, base = num[2:], 16
+	}
+	n, err := strconv.ParseInt(num, base, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	if n > (1<<63-1)/mult {
+		return 0, fmt.Errorf("invalid size %q: overflow", s)
+	}
+	return n * mult, nil
+}
@@ -0,0 +1,106 @@
+package topology
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		unit int64
+		want int64
+	}{
+		{"768", 1 << 20, 768 << 20},
+		{"2GiB", 1 << 20, 2 << 30},
+		{"2G", 1 << 20, 2 << 30},
+		{"2 GiB", 1 << 20, 2 << 30},
+		{"512MiB", 1 << 30, 512 << 20},
+		{"1GB", 1 << 20, 1e9},
+		{"4096B", 1 << 20, 4096},
+		{"10", 1 << 30, 10 << 30},
+		{"0x400", 1 << 20, 1 << 30},
+		{"010G", 1 << 20, 10 << 30},
+		{"0400", 1 << 20, 400 << 20},
+		{"0", 1 << 20, 0},
+	} {
+		got, err := ParseSize(test.in, test.unit)
+		if err != nil {
+			t.Errorf("ParseSize(%q): %v", test.in, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("ParseSize(%q): got %d, want %d",
+				test.in, got, test.want)
+		}
+	}
+
+	for _, in := range []string{"", "2X", "GiB", "-1", "1.5G", "0xZ", "0x1B", "0x10G", "0x-1", "99999999999T"} {
+		if n, err := ParseSize(in, 1<<20); err == nil {
+			t.Errorf("ParseSize(%q): got %d, want error", in, n)
+		}
+	}
+}
+
+func TestStrictAttributes(t *testing.T) {
+	const G = `graph G {
+		"leaf0" [function=leaf memory="2GiB" cpu=2 disk=8]
+		"spine0" [function=spnie memory="lots" cpu=0 color=red efi=no]
+		"host0" [function=host memory=0]
+		"host1" [function=host memory="0G" disk=0]
+		"leaf0":swp1 -- "spine0":swp1 [left_pxe=1 speed="100G"]
+	}`
+
+	_, err := Parse([]byte(G))
+	if err == nil {
+		t.Fatal("got nil error, want validation failure")
+	}
+	msg := err.Error()
+	for _, w := range []string{
+		`node "spine0": attribute function: got "spnie"`,
+		`node "spine0": attribute memory: invalid size "lots"`,
+		`node "spine0": attribute cpu: want positive integer`,
+		`node "spine0": unknown attribute color`,
+		`node "spine0": attribute efi: flag attributes`,
+		`unknown attribute speed`,
+		`node "host0": attribute memory: want non-zero size, got "0"`,
+		`node "host1": attribute memory: want non-zero size, got "0G"`,
+	} {
+		if !strings.Contains(msg, w) {
+			t.Errorf("missing problem %q in:\n%s", w, msg)
+		}
+	}
+	if strings.Contains(msg, `node "leaf0"`) {
+		t.Errorf("unexpected problem with leaf0:\n%s", msg)
+	}
+	if strings.Contains(msg, "attribute disk") {
+		t.Errorf("unexpected problem with disk=0:\n%s", msg)
+	}
+}
+
+func TestDeviceSizes(t *testing.T) {
+	const G = `graph G {
+		"a" [function=host memory="2GiB" disk=16]
+		"b" [function=host memory=1024 disk="512MiB"]
+		"a":eth1 -- "b":eth1
+	}`
+
+	topo, err := Parse([]byte(G))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range topo.Devices() {
+		var wantMem, wantDisk int64 = 2 << 30, 16 << 30
+		if d.Name == "b" {
+			wantMem, wantDisk = 1<<30, 512<<20
+		}
+		if got := d.Memory(); got != wantMem {
+			t.Errorf("device %s: got memory %d, want %d",
+				d.Name, got, wantMem)
+		}
+		if got := d.DiskSize(); got != wantDisk {
+			t.Errorf("device %s: got disk size %d, want %d",
+				d.Name, got, wantDisk)
+		}
+	}
+}
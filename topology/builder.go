@@ -0,0 +1,158 @@
+package topology
+
+import "sort"
+
+// A Builder constructs a topology programmatically, without going through
+// an intermediate DOT representation. Its methods mirror DOT semantics: adding
+// a device more than once merges attributes and links may refer to devices not
+// added explicitly.
+type Builder struct {
+	devices []builderDevice
+	links   []builderLink
+	groups  []builderGroup
+	index   map[string]int // device name → index into devices
+}
+
+type builderGroup struct {
+	name    string
+	attrs   map[string]string
+	members []string
+}
+
+type builderDevice struct {
+	name  string
+	attrs map[string]string
+}
+
+type builderLink struct {
+	from, fromPort string
+	to, toPort     string
+	attrs          map[string]string
+}
+
+// NewBuilder returns an empty Builder.
+func NewBuilder() *Builder {
+	return &Builder{index: make(map[string]int)}
+}
+
+// AddDevice adds the named device with the provided node attributes. If the
+// device exists already, attrs are merged into its existing attributes.
+func (b *Builder) AddDevice(name string, attrs map[string]string) *Builder {
+	i, ok := b.index[name]
+	if !ok {
+		i = len(b.devices)
+		b.index[name] = i
+		b.devices = append(b.devices, builderDevice{name: name})
+	}
+	d := &b.devices[i]
+	for k, v := range attrs {
+		if d.attrs == nil {
+			d.attrs = make(map[string]string)
+		}
+		d.attrs[k] = v
+	}
+	return b
+}
+
+// AddLink adds a link between from:fromPort and to:toPort with the provided
+// edge attributes. Devices not added before are created without attributes.
+func (b *Builder) AddLink(from, fromPort, to, toPort string, attrs map[string]string) *Builder {
+	b.AddDevice(from, nil)
+	b.AddDevice(to, nil)
+	var m map[string]string
+	if len(attrs) > 0 {
+		m = make(map[string]string, len(attrs))
+		for k, v := range attrs {
+			m[k] = v
+		}
+	}
+	b.links = append(b.links, builderLink{
+		from:     from,
+		fromPort: fromPort,
+		to:       to,
+		toPort:   toPort,
+		attrs:    m,
+	})
+	return b
+}
+
+// AddGroup adds the named devices to group name. Devices not added before are
+// created without attributes. Unless set explicitly, group members inherit
+// the attributes given in attrs, with groups added later taking precedence.
+// AddGroup may be called multiple times for the same group.
+func (b *Builder) AddGroup(name string, attrs map[string]string, devices ...string) *Builder {
+	bg := builderGroup{name: name, members: devices}
+	if len(attrs) > 0 {
+		bg.attrs = make(map[string]string, len(attrs))
+		for k, v := range attrs {
+			bg.attrs[k] = v
+		}
+	}
+	for _, d := range devices {
+		b.AddDevice(d, nil)
+	}
+	b.groups = append(b.groups, bg)
+	return b
+}
+
+// HasDevice reports whether a device called name was added to b.
+func (b *Builder) HasDevice(name string) bool {
+	_, ok := b.index[name]
+	return ok
+}
+
+// Build returns the topology described by the devices and links added so
+// far. Like Parse, it applies opts and validates the result. The Builder may
+// be used further after calling Build.
+func (b *Builder) Build(opts ...Option) (*T, error) {
+	inherited := make(map[string]map[string]string)
+	groupSet := make(map[string]map[string]bool)
+	for _, bg := range b.groups {
+		if groupSet[bg.name] == nil {
+			groupSet[bg.name] = make(map[string]bool)
+		}
+		for _, d := range bg.members {
+			groupSet[bg.name][d] = true
+			if len(bg.attrs) == 0 {
+				continue
+			}
+			if inherited[d] == nil {
+				inherited[d] = make(map[string]string)
+			}
+			for k, v := range bg.attrs {
+				inherited[d][k] = v
+			}
+		}
+	}
+	groups := make(map[string][]string, len(groupSet))
+	for name, set := range groupSet {
+		members := make([]string, 0, len(set))
+		for d := range set {
+			members = append(members, d)
+		}
+		sort.Strings(members)
+		groups[name] = members
+	}
+
+	g := newDotGraph()
+	for _, d := range b.devices {
+		n := g.addNamedNode(d.name)
+		if d.attrs != nil {
+			n.attrs = make(map[string]string, len(d.attrs))
+			for k, v := range d.attrs {
+				n.attrs[k] = v
+			}
+		}
+	}
+	g.inheritAttrs(inherited)
+	for _, l := range b.links {
+		g.addLink(l.from, l.fromPort, l.to, l.toPort, l.attrs)
+	}
+
+	dotBytes, err := marshalDOT(g)
+	if err != nil {
+		return nil, err
+	}
+	dotBytes = appendDOTGroups(dotBytes, groups)
+	return newT(g, dotBytes, groups, opts...)
+}
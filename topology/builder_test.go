@@ -0,0 +1,65 @@
+package topology
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestBuilder(t *testing.T) {
+	want, err := ParseFile("testdata/leafspine.dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := NewBuilder()
+	b.AddDevice("oob-mgmt-server", map[string]string{
+		"function": "oob-server",
+		"mgmt_ip":  "10.100.68.254/24",
+	})
+	for i := 0; i < 2; i++ {
+		b.AddDevice(fmt.Sprintf("spine%d", i),
+			map[string]string{"function": "spine"})
+	}
+	for i := 0; i < 3; i++ {
+		leaf := fmt.Sprintf("leaf%d", i)
+		b.AddDevice(leaf, map[string]string{"function": "leaf"})
+		for j := 0; j < 2; j++ {
+			b.AddLink(leaf, fmt.Sprintf("swp%d", j+1),
+				fmt.Sprintf("spine%d", j), fmt.Sprintf("swp%d", i+1),
+				nil)
+		}
+	}
+	b.AddLink("leaf2", "swp3", "host0", "eno1", nil)
+	b.AddDevice("host0", map[string]string{"function": "fake"})
+
+	topo, err := b.Build(WithAutoMgmtNetwork)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := linkStrings(topo), linkStrings(want); got != want {
+		t.Errorf("got links\n%s\nwant\n%s", got, want)
+	}
+	if n := len(topo.Devices()); n != 8 {
+		t.Errorf("got %d devices, want 8", n)
+	}
+	if n := len(topo.Links()); n != 15 {
+		t.Errorf("got %d links, want 15", n)
+	}
+	for _, d := range topo.Devices() {
+		if d.Name == "host0" && d.Function() != Fake {
+			t.Errorf("host0: got function %s, want fake", d.Function())
+		}
+	}
+}
+
+func TestBuilderValidates(t *testing.T) {
+	b := NewBuilder().
+		AddLink("a", "swp1", "b", "swp1", nil).
+		AddLink("a", "swp1", "b", "swp2", nil)
+	_, err := b.Build()
+	var errs ValidationErrors
+	if !errors.As(err, &errs) || len(errs) != 1 {
+		t.Errorf("got err=%v, want one validation error", err)
+	}
+}
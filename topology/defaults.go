@@ -1,9 +1,18 @@
 package topology
 
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v2"
+)
+
 type deviceDefaults struct {
-	OS     string `yaml:"os"`
-	VCPUs  int    `yaml:"vcpus"`
-	Memory int64  `yaml:"memory"`
+	OS     string     `yaml:"os" json:"os"`
+	VCPUs  int        `yaml:"vcpus" json:"vcpus"`
+	Memory memorySize `yaml:"memory" json:"memory"`
+	Disk   diskSize   `yaml:"disk" json:"disk"`
 }
 
 const (
@@ -22,3 +31,152 @@ var builtinDefaults = [...]deviceDefaults{
 	Host:       {OS: fedoraQCOW2, VCPUs: 1, Memory: 768 << 20},
 	NoFunction: {OS: fedoraQCOW2, VCPUs: 1, Memory: 768 << 20},
 }
+
+// A defaultsSource is a YAML document overriding builtinDefaults. It is
+// either provided inline (data), read from a file (name) or already decoded
+// (doc).
+type defaultsSource struct {
+	name string
+	data []byte
+	doc  map[string]deviceDefaults
+}
+
+// WithDefaults overrides the builtin device defaults with those from the YAML
+// document p. The document maps device functions (as used for the function
+// node attribute) to default settings for os, vcpus, memory and disk. The
+// special key "default" applies to devices of any function:
+//
+//	default:
+//	  memory: 1GiB
+//	leaf:
+//	  os: https://example.org/cumulus-linux-5.0.0-vx-amd64-qemu.qcow2
+//	  vcpus: 2
+//
+// Bare numbers for memory and disk are taken as MiB and GiB, respectively, like
+// the corresponding node attributes. WithDefaults may be given multiple times,
+// with later documents taking precedence over earlier ones.
+func WithDefaults(p []byte) Option {
+	return func(t *T) {
+		t.defaultsSrc = append(t.defaultsSrc, defaultsSource{
+			name: "WithDefaults",
+			data: append([]byte(nil), p...),
+		})
+	}
+}
+
+// WithDefaultsFile is like WithDefaults but reads the YAML document from the
+// file located by path.
+func WithDefaultsFile(path string) Option {
+	return func(t *T) {
+		t.defaultsSrc = append(t.defaultsSrc, defaultsSource{
+			name: path,
+		})
+	}
+}
+
+// LoadDefaults computes the effective per-function defaults by layering the
+// provided sources on top of builtinDefaults.
+func loadDefaults(srcs []defaultsSource) (defs *[NoFunction + 1]deviceDefaults, err error) {
+	defs = new([NoFunction + 1]deviceDefaults)
+	*defs = builtinDefaults
+	for _, src := range srcs {
+		doc := src.doc
+		if doc == nil {
+			p := src.data
+			if p == nil {
+				if p, err = ioutil.ReadFile(src.name); err != nil {
+					return nil, fmt.Errorf("load defaults: %w", err)
+				}
+			}
+			if err := yaml.UnmarshalStrict(p, &doc); err != nil {
+				return nil, fmt.Errorf("load defaults %s: %w",
+					src.name, err)
+			}
+		}
+		if x, ok := doc["default"]; ok {
+			for f := range defs {
+				defs[f].merge(&x)
+			}
+		}
+		for k, x := range doc {
+			if k == "default" {
+				continue
+			}
+			f := deviceFunctionFromString(k)
+			if f == NoFunction {
+				return nil, fmt.Errorf("load defaults %s: "+
+					"unknown device function %q", src.name, k)
+			}
+			defs[f].merge(&x)
+		}
+	}
+	return defs, nil
+}
+
+// Merge overwrites fields in dd with the non-zero fields of x.
+func (dd *deviceDefaults) merge(x *deviceDefaults) {
+	if x.OS != "" {
+		dd.OS = x.OS
+	}
+	if x.VCPUs != 0 {
+		dd.VCPUs = x.VCPUs
+	}
+	if x.Memory != 0 {
+		dd.Memory = x.Memory
+	}
+	if x.Disk != 0 {
+		dd.Disk = x.Disk
+	}
+}
+
+// MemorySize is a size in bytes, unmarshaled from YAML like the memory node
+// attribute.
+type memorySize int64
+
+func (s *memorySize) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	n, err := unmarshalSize(unmarshal, 1<<20)
+	*s = memorySize(n)
+	return err
+}
+
+// DiskSize is a size in bytes, unmarshaled from YAML like the disk node
+// attribute.
+type diskSize int64
+
+func (s *diskSize) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	n, err := unmarshalSize(unmarshal, 1<<30)
+	*s = diskSize(n)
+	return err
+}
+
+func (s *memorySize) UnmarshalJSON(p []byte) error {
+	n, err := unmarshalJSONSize(p, 1<<20)
+	*s = memorySize(n)
+	return err
+}
+
+func (s *diskSize) UnmarshalJSON(p []byte) error {
+	n, err := unmarshalJSONSize(p, 1<<30)
+	*s = diskSize(n)
+	return err
+}
+
+func unmarshalJSONSize(p []byte, unit int64) (int64, error) {
+	var v interface{}
+	if err := json.Unmarshal(p, &v); err != nil {
+		return 0, err
+	}
+	s, ok := v.(string)
+	if !ok {
+		s = string(p)
+	}
+	return ParseSize(s, unit)
+}
+
+func unmarshalSize(unmarshal func(interface{}) error, unit int64) (int64, error) {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return 0, err
+	}
+	return ParseSize(s, unit)
+}
@@ -0,0 +1,71 @@
+package topology
+
+import (
+	"strings"
+	"testing"
+)
+
+const testDefaultsYAML = `
+default:
+  memory: 1GiB
+leaf:
+  os: https://example.org/leaf.qcow2
+  vcpus: 2
+  disk: 16
+host:
+  memory: 2048
+`
+
+func TestWithDefaults(t *testing.T) {
+	topo, err := ParseFile("testdata/leafspine.dot",
+		WithAutoMgmtNetwork,
+		WithDefaults([]byte(testDefaultsYAML)),
+		WithDefaults([]byte("spine:\n  os: none\n")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range topo.Devices() {
+		d := d
+		switch {
+		case HasFunction(&d, Leaf):
+			if got, want := d.OSImage(), "https://example.org/leaf.qcow2"; got != want {
+				t.Errorf("device %s: got os %q, want %q", d.Name, got, want)
+			}
+			if got, want := d.VCPUs(), 2; got != want {
+				t.Errorf("device %s: got %d vcpus, want %d", d.Name, got, want)
+			}
+			if got, want := d.DiskSize(), int64(16<<30); got != want {
+				t.Errorf("device %s: got disk %d, want %d", d.Name, got, want)
+			}
+			if got, want := d.Memory(), int64(1<<30); got != want {
+				t.Errorf("device %s: got memory %d, want %d", d.Name, got, want)
+			}
+		case HasFunction(&d, Spine):
+			if got := d.OSImage(); got != "" {
+				t.Errorf("device %s: got os %q, want none", d.Name, got)
+			}
+		case HasFunction(&d, OOBServer):
+			if got, want := d.OSImage(), builtinDefaults[OOBServer].OS; got != want {
+				t.Errorf("device %s: got os %q, want %q", d.Name, got, want)
+			}
+			if got, want := d.Memory(), int64(1<<30); got != want {
+				t.Errorf("device %s: got memory %d, want %d", d.Name, got, want)
+			}
+		}
+	}
+}
+
+func TestWithDefaultsInvalid(t *testing.T) {
+	for _, doc := range []string{
+		"lief:\n  vcpus: 2\n",
+		"leaf:\n  cpus: 2\n",
+		"leaf:\n  memory: lots\n",
+	} {
+		_, err := Parse([]byte(`graph G { "a" [function=leaf] }`),
+			WithDefaults([]byte(doc)))
+		if err == nil || !strings.Contains(err.Error(), "load defaults") {
+			t.Errorf("defaults %q: got err=%v, want load error", doc, err)
+		}
+	}
+}
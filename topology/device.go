@@ -9,10 +9,13 @@ import (
 
 // A Device corresponds to a node in the parsed topology.
 type Device struct {
-	Name   string
-	attrs  map[string]string
-	links  []Link
-	mgmtIP netaddr.IP
+	Name     string
+	attrs    map[string]string
+	links    []Link
+	mgmtIP   netaddr.IP
+	mgmtIP6  netaddr.IP // IPv6 address on dual-stack mgmt networks
+	groups   []string
+	defaults *deviceDefaults
 }
 
 // Function returns the DeviceFunction associated with d.
@@ -29,43 +32,52 @@ func (d *Device) VCPUs() int {
 			return n
 		}
 	}
-	return builtinDefaults[d.Function()].VCPUs
+	return d.getDefaults().VCPUs
 }
 
 // Memory returns the device's memory size in bytes.
 func (d *Device) Memory() int64 {
 	if s := d.Attr("memory"); s != "" {
-		n, err := strconv.ParseInt(s, 0, 64)
+		// node attribute "memory" defaults to MiB, we want bytes.
+		n, err := ParseSize(s, 1<<20)
 		if err == nil {
-			// node attribute "memory" is in MiB, we want bytes.
-			return n << 20
+			return n
 		}
 	}
-	return builtinDefaults[d.Function()].Memory
+	return int64(d.getDefaults().Memory)
 }
 
-// DiskSize returns the device's disk size in bytes.
+// DiskSize returns the device's disk size in bytes. A return value of zero
+// means that the size of the OS image should be used.
 func (d *Device) DiskSize() int64 {
 	if s := d.Attr("disk"); s != "" {
-		n, err := strconv.ParseInt(s, 0, 64)
+		// node attribute "disk" defaults to GiB, we want bytes.
+		n, err := ParseSize(s, 1<<30)
 		if err == nil {
-			// node attribute "disk" is in GiB, we want bytes.
-			return n << 30
+			return n
 		}
 	}
-	return 0
+	return int64(d.getDefaults().Disk)
 }
 
 // OSImage returns the URL to an operating system image from the 'os' node
-// attribute, falling back to a builtin default if necessary.
+// attribute, falling back to a (possibly configured) default if necessary.
 func (d *Device) OSImage() string {
-	if s := d.Attr("os"); s != "" {
-		if s == "none" {
-			return ""
-		}
-		return s
+	s := d.Attr("os")
+	if s == "" {
+		s = d.getDefaults().OS
 	}
-	return builtinDefaults[d.Function()].OS
+	if s == "none" {
+		return ""
+	}
+	return s
+}
+
+func (d *Device) getDefaults() *deviceDefaults {
+	if d.defaults == nil {
+		return &builtinDefaults[d.Function()]
+	}
+	return d.defaults
 }
 
 // MgmtIP returns the management IP address assigned to d (only when
@@ -77,6 +89,19 @@ func (d *Device) MgmtIP() *net.IPAddr {
 	return d.mgmtIP.IPAddr()
 }
 
+// MgmtIPs returns all management addresses assigned to d, starting with the
+// one returned by MgmtIP. On dual-stack management networks, this includes
+// an IPv6 address in addition to the IPv4 one.
+func (d *Device) MgmtIPs() []*net.IPAddr {
+	var ips []*net.IPAddr
+	for _, ip := range []netaddr.IP{d.mgmtIP, d.mgmtIP6} {
+		if !ip.IsZero() {
+			ips = append(ips, ip.IPAddr())
+		}
+	}
+	return ips
+}
+
 // Links returns all connections involving d as an endpoint.
 func (d *Device) Links() []Link {
 	ls := make([]Link, len(d.links))
@@ -0,0 +1,165 @@
+package topology
+
+import "sort"
+
+// A Delta describes the differences between two topologies, as computed by
+// Diff. All slices are sorted by device name or link, respectively.
+type Delta struct {
+	AddedDevices   []Device
+	RemovedDevices []Device
+	ChangedDevices []DeviceChange
+
+	AddedLinks   []Link
+	RemovedLinks []Link
+	ChangedLinks []LinkChange
+}
+
+// A DeviceChange lists the node attributes that differ between two versions of
+// the same device.
+type DeviceChange struct {
+	Name  string
+	Attrs []AttrChange
+}
+
+// A LinkChange lists the edge attributes that differ between two versions of
+// the same link. Link is the new version.
+type LinkChange struct {
+	Link  Link
+	Attrs []AttrChange
+}
+
+// An AttrChange describes a single attribute that was added, removed or
+// changed. Added and Removed distinguish missing attributes from those
+// present with an empty value.
+type AttrChange struct {
+	Key      string
+	Old, New string
+	Added    bool
+	Removed  bool
+}
+
+// Empty reports whether the delta contains no differences.
+func (d *Delta) Empty() bool {
+	return len(d.AddedDevices) == 0 && len(d.RemovedDevices) == 0 &&
+		len(d.ChangedDevices) == 0 && len(d.AddedLinks) == 0 &&
+		len(d.RemovedLinks) == 0 && len(d.ChangedLinks) == 0
+}
+
+// Diff computes the differences between topologies a and b. Devices are
+// matched by name and links by their end points (device and port) regardless
+// of their orientation or position within the input, so that reordering
+// parallel edges between the same pair of devices is not reported as a change.
+// Attributes are compared as given in the input, without resolving defaults.
+func Diff(a, b *T) *Delta {
+	var d Delta
+
+	devsA, devsB := a.devs, b.devs
+	for _, name := range sortedUnion(deviceNames(devsA), deviceNames(devsB)) {
+		x, y := devsA[name], devsB[name]
+		switch {
+		case x == nil:
+			d.AddedDevices = append(d.AddedDevices, *y)
+		case y == nil:
+			d.RemovedDevices = append(d.RemovedDevices, *x)
+		default:
+			if c := diffAttrs(x.attrs, y.attrs); c != nil {
+				d.ChangedDevices = append(d.ChangedDevices,
+					DeviceChange{Name: name, Attrs: c})
+			}
+		}
+	}
+
+	linksA, linksB := linksByEndpoints(a), linksByEndpoints(b)
+	for _, k := range sortedUnion(linkKeys(linksA), linkKeys(linksB)) {
+		x, y := linksA[k], linksB[k]
+		switch {
+		case x == nil:
+			d.AddedLinks = append(d.AddedLinks, *y)
+		case y == nil:
+			d.RemovedLinks = append(d.RemovedLinks, *x)
+		default:
+			if c := diffAttrs(x.attrs, y.attrs); c != nil {
+				d.ChangedLinks = append(d.ChangedLinks,
+					LinkChange{Link: *y, Attrs: c})
+			}
+		}
+	}
+
+	return &d
+}
+
+// LinksByEndpoints indexes t's links by their canonical string
+// representation. Links are oriented so that the lexically smaller end point
+// comes first, with side-specific attributes adjusted accordingly.
+func linksByEndpoints(t *T) map[string]*Link {
+	m := make(map[string]*Link)
+	for _, l := range t.Links() {
+		l := l
+		if l.To+":"+l.ToPort < l.From+":"+l.FromPort && l.To != "" {
+			l = Link{
+				From:     l.To,
+				FromPort: l.ToPort,
+				To:       l.From,
+				ToPort:   l.FromPort,
+				attrs:    swapSides(l.attrs),
+			}
+		}
+		m[l.String()] = &l
+	}
+	return m
+}
+
+func diffAttrs(a, b map[string]string) []AttrChange {
+	var cs []AttrChange
+	for _, k := range sortedUnion(attrKeys(a), attrKeys(b)) {
+		x, inA := a[k]
+		y, inB := b[k]
+		switch {
+		case !inA:
+			cs = append(cs, AttrChange{Key: k, New: y, Added: true})
+		case !inB:
+			cs = append(cs, AttrChange{Key: k, Old: x, Removed: true})
+		case x != y:
+			cs = append(cs, AttrChange{Key: k, Old: x, New: y})
+		}
+	}
+	return cs
+}
+
+// SortedUnion returns the sorted set of strings contained in a or b.
+func sortedUnion(a, b []string) []string {
+	seen := make(map[string]bool, len(a)+len(b))
+	var r []string
+	for _, s := range append(a, b...) {
+		if !seen[s] {
+			seen[s] = true
+			r = append(r, s)
+		}
+	}
+	sort.Strings(r)
+	return r
+}
+
+func deviceNames(m map[string]*Device) []string {
+	var r []string
+	for k := range m {
+		r = append(r, k)
+	}
+	return r
+}
+
+func linkKeys(m map[string]*Link) []string {
+	var r []string
+	for k := range m {
+		r = append(r, k)
+	}
+	return r
+}
+
+func attrKeys(m map[string]string) []string {
+	var r []string
+	for k := range m {
+		r = append(r, k)
+	}
+	return r
+}
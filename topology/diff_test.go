@@ -0,0 +1,102 @@
+package topology
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	const old = `graph G {
+		"leaf0" [function=leaf memory=1024]
+		"leaf1" [function=leaf]
+		"spine0" [function=spine]
+		"host0" [function=host]
+		"leaf0":swp1 -- "spine0":swp1
+		"leaf0":swp2 -- "spine0":swp2 [left_mac="44:38:39:00:00:01"]
+		"leaf1":swp1 -- "spine0":swp3
+		"host0":eth1 -- "leaf1":swp3
+	}`
+	// Parallel edges reordered and one of them reversed, leaf1 replaced
+	// by leaf2, attribute changes on leaf0 and a link.
+	const new = `graph G {
+		"leaf0" [function=leaf bmc=1]
+		"leaf2" [function=leaf]
+		"spine0" [function=spine]
+		"host0" [function=host]
+		"spine0":swp2 -- "leaf0":swp2 [right_mac="44:38:39:00:00:01"]
+		"leaf0":swp1 -- "spine0":swp1 [left_pxe=1]
+		"leaf2":swp1 -- "spine0":swp3
+		"host0":eth1 -- "leaf2":swp3
+	}`
+
+	a, err := Parse([]byte(old))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Parse([]byte(new))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := Diff(a, b)
+	if got := deviceNamesOf(d.AddedDevices); !reflect.DeepEqual(got, []string{"leaf2"}) {
+		t.Errorf("added devices: got %v", got)
+	}
+	if got := deviceNamesOf(d.RemovedDevices); !reflect.DeepEqual(got, []string{"leaf1"}) {
+		t.Errorf("removed devices: got %v", got)
+	}
+	wantDev := []DeviceChange{{
+		Name: "leaf0",
+		Attrs: []AttrChange{
+			{Key: "bmc", New: "1", Added: true},
+			{Key: "memory", Old: "1024", Removed: true},
+		},
+	}}
+	if !reflect.DeepEqual(d.ChangedDevices, wantDev) {
+		t.Errorf("changed devices: got %+v, want %+v", d.ChangedDevices, wantDev)
+	}
+
+	if got, want := linkStringsOf(d.AddedLinks), []string{
+		"host0:eth1 -- leaf2:swp3",
+		"leaf2:swp1 -- spine0:swp3",
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("added links: got %v, want %v", got, want)
+	}
+	if got, want := linkStringsOf(d.RemovedLinks), []string{
+		"host0:eth1 -- leaf1:swp3",
+		"leaf1:swp1 -- spine0:swp3",
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("removed links: got %v, want %v", got, want)
+	}
+	if len(d.ChangedLinks) != 1 {
+		t.Fatalf("changed links: got %d, want 1", len(d.ChangedLinks))
+	}
+	c := d.ChangedLinks[0]
+	if got, want := c.Link.String(), "leaf0:swp1 -- spine0:swp1"; got != want {
+		t.Errorf("changed link: got %s, want %s", got, want)
+	}
+	wantAttrs := []AttrChange{{Key: "left_pxe", New: "1", Added: true}}
+	if !reflect.DeepEqual(c.Attrs, wantAttrs) {
+		t.Errorf("changed link attrs: got %+v, want %+v", c.Attrs, wantAttrs)
+	}
+
+	if d := Diff(a, a); !d.Empty() {
+		t.Errorf("Diff(a, a): got %+v, want empty delta", d)
+	}
+}
+
+func deviceNamesOf(ds []Device) []string {
+	var r []string
+	for _, d := range ds {
+		r = append(r, d.Name)
+	}
+	return r
+}
+
+func linkStringsOf(ls []Link) []string {
+	var r []string
+	for _, l := range ls {
+		r = append(r, l.String())
+	}
+	return r
+}
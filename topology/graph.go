@@ -1,14 +1,20 @@
 package topology
 
 import (
+	"sort"
+	"strings"
+
 	"gonum.org/v1/gonum/graph"
 	"gonum.org/v1/gonum/graph/encoding"
+	"gonum.org/v1/gonum/graph/encoding/dot"
 	"gonum.org/v1/gonum/graph/multi"
 )
 
 // dotGraph wraps a multi.UndirectedGraph for DOT unmarshaling.
 type dotGraph struct {
 	*multi.UndirectedGraph
+
+	byName map[string]*dotNode // index used by addNamedNode
 }
 
 func newDotGraph() *dotGraph {
@@ -58,6 +64,38 @@ func (e *dotLine) Attributes() []encoding.Attribute {
 	return toAttributeSlice(e.attrs)
 }
 
+// ReversedLine returns a copy of e with its end points swapped. Port labels
+// and attributes referring to the left and right side (e.g. left_mac) are
+// swapped accordingly.
+func (e *dotLine) ReversedLine() graph.Line {
+	return &dotLine{
+		Line:           e.Line.ReversedLine().(multi.Line),
+		FromPortLabels: e.ToPortLabels,
+		ToPortLabels:   e.FromPortLabels,
+		attrs:          swapSides(e.attrs),
+	}
+}
+
+// SwapSides returns a copy of the edge attributes m with those referring to
+// the left side (left_mac, left_pxe) renamed to refer to the right side and
+// vice versa.
+func swapSides(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	r := make(map[string]string, len(m))
+	for k, v := range m {
+		switch {
+		case strings.HasPrefix(k, "left_"):
+			k = "right_" + strings.TrimPrefix(k, "left_")
+		case strings.HasPrefix(k, "right_"):
+			k = "left_" + strings.TrimPrefix(k, "right_")
+		}
+		r[k] = v
+	}
+	return r
+}
+
 func (e *dotLine) SetFromPort(port, compass string) error {
 	e.FromPortLabels.Port = port
 	e.FromPortLabels.Compass = compass
@@ -88,6 +126,9 @@ type dotNode struct {
 // SetDOTID sets the DOT ID of the dotNode.
 func (n *dotNode) SetDOTID(id string) { n.dotID = id }
 
+// DOTID returns the dotNode's DOT ID.
+func (n *dotNode) DOTID() string { return n.dotID }
+
 func (n *dotNode) String() string { return n.dotID }
 
 // SetAttribute sets a DOT attribute.
@@ -112,5 +153,63 @@ func toAttributeSlice(m map[string]string) []encoding.Attribute {
 			Value: v,
 		})
 	}
+	sort.Slice(as, func(i, j int) bool {
+		return as[i].Key < as[j].Key
+	})
 	return as
 }
+
+// AddNamedNode returns the node identified by name, adding it to g if not
+// already present.
+func (g *dotGraph) addNamedNode(name string) *dotNode {
+	if g.byName == nil {
+		g.byName = make(map[string]*dotNode)
+		for _, n := range graph.NodesOf(g.Nodes()) {
+			n := n.(*dotNode)
+			g.byName[n.dotID] = n
+		}
+	}
+	if n := g.byName[name]; n != nil {
+		return n
+	}
+	n := g.NewNode().(*dotNode)
+	n.dotID = name
+	g.AddNode(n)
+	g.byName[name] = n
+	return n
+}
+
+// InheritAttrs sets attributes inherited by nodes (keyed by name) unless the
+// node carries the attribute already.
+func (g *dotGraph) inheritAttrs(inherited map[string]map[string]string) {
+	for _, n := range graph.NodesOf(g.Nodes()) {
+		n := n.(*dotNode)
+		for k, v := range inherited[n.dotID] {
+			if _, ok := n.attrs[k]; ok {
+				continue
+			}
+			n.SetAttribute(encoding.Attribute{Key: k, Value: v})
+		}
+	}
+}
+
+// AddLink adds a line between the named nodes to g. Nodes are created as
+// needed.
+func (g *dotGraph) addLink(from, fromPort, to, toPort string, attrs map[string]string) {
+	e := g.NewLine(g.addNamedNode(from), g.addNamedNode(to)).(*dotLine)
+	e.FromPortLabels.Port = fromPort
+	e.ToPortLabels.Port = toPort
+	for k, v := range attrs {
+		e.SetAttribute(encoding.Attribute{Key: k, Value: v})
+	}
+	g.SetLine(e)
+}
+
+// MarshalDOT returns the DOT representation of g.
+func marshalDOT(g *dotGraph) ([]byte, error) {
+	p, err := dot.MarshalMulti(g, "G", "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append(p, '\n'), nil
+}
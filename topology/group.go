@@ -0,0 +1,230 @@
+package topology
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gonum.org/v1/gonum/graph/formats/dot"
+	"gonum.org/v1/gonum/graph/formats/dot/ast"
+)
+
+// A Group is a named set of devices. Groups are declared using DOT subgraphs
+// (a "cluster_" prefix is stripped from the subgraph name) or the groups
+// section of structured topology files.
+type Group struct {
+	Name    string
+	Devices []string // sorted by name
+}
+
+// Groups returns the groups defined in the topology, sorted by name.
+func (t *T) Groups() []Group {
+	names := sortedGroupNames(t.groups)
+	gs := make([]Group, 0, len(names))
+	for _, name := range names {
+		gs = append(gs, Group{
+			Name:    name,
+			Devices: append([]string(nil), t.groups[name]...),
+		})
+	}
+	return gs
+}
+
+// Groups returns the names of the groups d is a member of, sorted by name.
+func (d *Device) Groups() []string {
+	return append([]string(nil), d.groups...)
+}
+
+// InGroup reports whether d is a member of at least one of the named groups.
+func (d *Device) InGroup(names ...string) bool {
+	for _, g := range d.groups {
+		for _, name := range names {
+			if g == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// A dotScope holds the default node attributes of a DOT subgraph (or the
+// graph itself) and the nodes mentioned within it.
+type dotScope struct {
+	name    string // group name, empty for anonymous subgraphs and the root
+	depth   int
+	attrs   map[string]string
+	members []string
+	seen    map[string]bool
+}
+
+// DotGroups extracts the information lost by gonum's DOT decoder, which
+// flattens subgraphs and ignores default attribute statements. It returns the
+// named groups (mapping names to sorted member lists) and the attributes each
+// node inherits.
+//
+// Attributes set using node [...] statements apply to the nodes subsequently
+// mentioned for the first time within the enclosing subgraph. Those of nested
+// subgraphs take precedence over outer ones, with the graph's top level being
+// the outermost scope. Only attributes known to runtopo are inherited,
+// rendering attributes like shape or color are left to DOT tools.
+func dotGroups(p []byte) (groups map[string][]string, inherited map[string]map[string]string, err error) {
+	f, err := dot.ParseBytes(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(f.Graphs) != 1 {
+		return nil, nil, fmt.Errorf("got %d graphs, want 1", len(f.Graphs))
+	}
+
+	root := &dotScope{
+		attrs: make(map[string]string),
+		seen:  make(map[string]bool),
+	}
+	scopes := []*dotScope{root}
+	named := make(map[string]*dotScope)
+	// Depth of the scope each inherited attribute was taken from.
+	depths := make(map[string]map[string]int)
+	inherited = make(map[string]map[string]string)
+	var walk func(stack []*dotScope, stmts []ast.Stmt)
+	visit := func(stack []*dotScope, v ast.Vertex) {
+		switch v := v.(type) {
+		case *ast.Node:
+			id := unquoteDOTID(v.ID)
+			for _, s := range stack {
+				if s.seen[id] {
+					continue
+				}
+				s.seen[id] = true
+				s.members = append(s.members, id)
+				if len(s.attrs) == 0 {
+					continue
+				}
+				if inherited[id] == nil {
+					inherited[id] = make(map[string]string)
+					depths[id] = make(map[string]int)
+				}
+				for k, v := range s.attrs {
+					if d, ok := depths[id][k]; ok && d > s.depth {
+						continue
+					}
+					inherited[id][k] = v
+					depths[id][k] = s.depth
+				}
+			}
+		case *ast.Subgraph:
+			walk(stack, []ast.Stmt{v})
+		}
+	}
+	walk = func(stack []*dotScope, stmts []ast.Stmt) {
+		cur := stack[len(stack)-1]
+		for _, stmt := range stmts {
+			switch stmt := stmt.(type) {
+			case *ast.NodeStmt:
+				visit(stack, stmt.Node)
+			case *ast.EdgeStmt:
+				visit(stack, stmt.From)
+				for e := stmt.To; e != nil; e = e.To {
+					visit(stack, e.Vertex)
+				}
+			case *ast.AttrStmt:
+				if stmt.Kind != ast.NodeKind {
+					continue
+				}
+				for _, a := range stmt.Attrs {
+					k := unquoteDOTID(a.Key)
+					if lookupAttrSpec(nodeAttrSpecs, k) == nil {
+						continue
+					}
+					cur.attrs[k] = unquoteDOTID(a.Val)
+				}
+			case *ast.Subgraph:
+				name := strings.TrimPrefix(unquoteDOTID(stmt.ID), "cluster_")
+				s := named[name]
+				if s == nil || name == "" {
+					s = &dotScope{
+						name:  name,
+						depth: len(stack),
+						attrs: make(map[string]string),
+						seen:  make(map[string]bool),
+					}
+					scopes = append(scopes, s)
+					if name != "" {
+						named[name] = s
+					}
+				}
+				walk(append(stack[:len(stack):len(stack)], s), stmt.Stmts)
+			}
+		}
+	}
+	walk([]*dotScope{root}, f.Graphs[0].Stmts)
+
+	groups = make(map[string][]string)
+	for _, s := range scopes {
+		if s.name != "" {
+			members := append([]string(nil), s.members...)
+			sort.Strings(members)
+			groups[s.name] = members
+		}
+	}
+	return groups, inherited, nil
+}
+
+func unquoteDOTID(s string) string {
+	if t, err := strconv.Unquote(s); err == nil {
+		return t
+	}
+	return s
+}
+
+var (
+	dotIdentRE   = regexp.MustCompile(`^[A-Za-z_][A-Za-z_0-9]*$`)
+	dotNumeralRE = regexp.MustCompile(`^-?(\.[0-9]+|[0-9]+(\.[0-9]*)?)$`)
+)
+
+// QuoteDOTID quotes s for use as a DOT ID unless it is a plain identifier or
+// numeral. This matches gonum's marshaler, whose decoder tells nodes apart by
+// their literal (possibly quoted) ID.
+func quoteDOTID(s string) string {
+	switch strings.ToLower(s) {
+	case "graph", "digraph", "subgraph", "node", "edge", "strict":
+		return strconv.Quote(s)
+	}
+	if dotIdentRE.MatchString(s) || dotNumeralRE.MatchString(s) {
+		return s
+	}
+	return strconv.Quote(s)
+}
+
+// AppendDOTGroups appends subgraphs declaring the membership of groups to the
+// DOT graph p, as produced by marshalDOT.
+func appendDOTGroups(p []byte, groups map[string][]string) []byte {
+	if len(groups) == 0 {
+		return p
+	}
+	names := sortedGroupNames(groups)
+
+	var buf bytes.Buffer
+	buf.Write(p[:bytes.LastIndexByte(p, '}')])
+	buf.WriteString("\n\t// Group definitions.\n")
+	for _, name := range names {
+		fmt.Fprintf(&buf, "\tsubgraph %s {\n", quoteDOTID("cluster_"+name))
+		for _, d := range groups[name] {
+			fmt.Fprintf(&buf, "\t\t%s;\n", quoteDOTID(d))
+		}
+		buf.WriteString("\t}\n")
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+func sortedGroupNames(groups map[string][]string) []string {
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
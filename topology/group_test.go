@@ -0,0 +1,152 @@
+package topology
+
+import (
+	"reflect"
+	"testing"
+)
+
+const groupsDOT = `graph G {
+	node [memory=1024]
+	subgraph cluster_pod1 {
+		node [function=leaf cpu=2]
+		"leaf0"
+		"leaf1" [cpu=4]
+		subgraph cluster_pod1_hosts {
+			node [function=host]
+			"host0"
+		}
+	}
+	subgraph "spines" {
+		node [function=spine]
+		"spine0"
+	}
+	"leaf0":swp1 -- "spine0":swp1
+	"leaf1":swp1 -- "spine0":swp2
+	"leaf0":swp2 -- "host0":eth1
+	"exit0" [function=exit]
+	"exit0":swp1 -- "spine0":swp3
+}`
+
+func TestGroups(t *testing.T) {
+	topo, err := Parse([]byte(groupsDOT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGroups(t, topo)
+
+	// Group membership and inherited attributes survive MarshalDOT.
+	p, err := topo.MarshalDOT()
+	if err != nil {
+		t.Fatal(err)
+	}
+	topo, err = Parse(p)
+	if err != nil {
+		t.Fatalf("reparse: %v\n%s", err, p)
+	}
+	checkGroups(t, topo)
+}
+
+func checkGroups(t *testing.T, topo *T) {
+	t.Helper()
+	want := []Group{
+		{Name: "pod1", Devices: []string{"host0", "leaf0", "leaf1"}},
+		{Name: "pod1_hosts", Devices: []string{"host0"}},
+		{Name: "spines", Devices: []string{"spine0"}},
+	}
+	if got := topo.Groups(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got groups %+v, want %+v", got, want)
+	}
+
+	for _, test := range []struct {
+		dev      string
+		function DeviceFunction
+		vcpus    int
+		groups   []string
+	}{
+		{"leaf0", Leaf, 2, []string{"pod1"}},
+		{"leaf1", Leaf, 4, []string{"pod1"}},
+		{"host0", Host, 2, []string{"pod1", "pod1_hosts"}},
+		{"spine0", Spine, 1, []string{"spines"}},
+		{"exit0", Exit, 1, nil},
+	} {
+		var d *Device
+		for _, x := range topo.Devices() {
+			if x.Name == test.dev {
+				x := x
+				d = &x
+			}
+		}
+		if d == nil {
+			t.Errorf("device %s missing", test.dev)
+			continue
+		}
+		if f := d.Function(); f != test.function {
+			t.Errorf("%s: got function %s, want %s",
+				d.Name, f, test.function)
+		}
+		if n := d.VCPUs(); n != test.vcpus {
+			t.Errorf("%s: got %d vcpus, want %d", d.Name, n, test.vcpus)
+		}
+		if n := d.Memory(); n != 1<<30 {
+			t.Errorf("%s: got memory %d, want %d", d.Name, n, 1<<30)
+		}
+		if g := d.Groups(); !reflect.DeepEqual(g, test.groups) {
+			t.Errorf("%s: got groups %v, want %v", d.Name, g, test.groups)
+		}
+	}
+}
+
+func TestGroupDefaultsOrder(t *testing.T) {
+	// Defaults apply to nodes mentioned after them only. Rendering
+	// attributes are not subject to the attribute checks.
+	doc := `graph G {
+		node [shape=box color=red]
+		"leaf0" [function=leaf]
+		subgraph cluster_pod {
+			"leaf0"
+			node [cpu=2 style=filled]
+			"leaf1" [function=leaf]
+		}
+		"leaf0":swp1 -- "leaf1":swp1
+	}`
+	topo, err := Parse([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range topo.Devices() {
+		want := map[string]int{"leaf0": 1, "leaf1": 2}[d.Name]
+		if n := d.VCPUs(); n != want {
+			t.Errorf("%s: got %d vcpus, want %d", d.Name, n, want)
+		}
+	}
+}
+
+func TestBuilderGroups(t *testing.T) {
+	topo, err := NewBuilder().
+		AddDevice("leaf0", map[string]string{"cpu": "4"}).
+		AddLink("leaf0", "swp1", "spine0", "swp1", nil).
+		AddGroup("leaves", map[string]string{"function": "leaf", "cpu": "2"}, "leaf0").
+		AddGroup("fabric", nil, "leaf0", "spine0").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range topo.Devices() {
+		if d.Name != "leaf0" {
+			continue
+		}
+		if d.Function() != Leaf || d.VCPUs() != 4 {
+			t.Errorf("leaf0: got function %s, %d vcpus, want leaf, 4",
+				d.Function(), d.VCPUs())
+		}
+		if !d.InGroup("fabric") || d.InGroup("spines") {
+			t.Errorf("leaf0: unexpected groups %v", d.Groups())
+		}
+	}
+	if _, err := Parse(topo.DOT()); err != nil {
+		t.Errorf("reparse DOT: %v", err)
+	}
+	if n := len(topo.Groups()); n != 2 {
+		t.Errorf("got %d groups, want 2", n)
+	}
+}
@@ -40,6 +40,50 @@ func (a *ipAllocator) allocate() (netaddr.IP, bool) {
 	return netaddr.IP{}, false
 }
 
+// NewHostAllocator constructs an ipAllocator for assigning host routes (e.g.
+// loopback addresses) from p. Like with newIPAllocator, the network and
+// broadcast addresses are skipped, except for prefixes without room for them
+// (/31 and /32 or /127 and /128), where every address is available.
+func newHostAllocator(p netaddr.IPPrefix) *ipAllocator {
+	if int(p.Bits) >= int(p.IP.BitLen())-1 {
+		return newPrefixAllocator(p)
+	}
+	return newIPAllocator(p)
+}
+
+// NewPrefixAllocator constructs an ipAllocator for carving subnets out of p.
+// Unlike with newIPAllocator, the network and broadcast addresses of p are
+// available for allocation.
+func newPrefixAllocator(p netaddr.IPPrefix) *ipAllocator {
+	a := new(ipAllocator)
+	a.builder.AddPrefix(p.Masked())
+	return a
+}
+
+// AllocatePrefix returns the first available prefix of length bits and a
+// boolean indicating success. All addresses within the prefix are marked as
+// allocated.
+func (a *ipAllocator) allocatePrefix(bits uint8) (netaddr.IPPrefix, bool) {
+	for _, r := range a.builder.IPSet().Ranges() {
+		p := netaddr.IPPrefix{IP: r.From, Bits: bits}.Masked()
+		if p.IP.Less(r.From) {
+			// r starts in the middle of a block, try the next one.
+			next := p.Range().To.Next()
+			if next.IsZero() {
+				continue
+			}
+			p = netaddr.IPPrefix{IP: next, Bits: bits}
+		}
+		if r.To.Less(p.Range().To) {
+			continue
+		}
+		a.builder.RemovePrefix(p)
+		return p, true
+	}
+
+	return netaddr.IPPrefix{}, false
+}
+
 func isASCIIAlpha(c rune) bool {
 	return 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z'
 }
@@ -1,6 +1,7 @@
 package topology
 
 import (
+	"strings"
 	"testing"
 
 	"inet.af/netaddr"
@@ -47,3 +48,20 @@ func TestIPReserve(t *testing.T) {
 		t.Errorf("got allocation %s despite exhausted range", ip)
 	}
 }
+
+func TestIPAllocatePrefix(t *testing.T) {
+	a := newPrefixAllocator(testPrefixTestNet2)
+	a.reserve(netaddr.MustParseIP("198.51.100.3"))
+	var got []string
+	for {
+		p, ok := a.allocatePrefix(31)
+		if !ok {
+			break
+		}
+		got = append(got, p.String())
+	}
+	want := []string{"198.51.100.0/31", "198.51.100.4/31", "198.51.100.6/31"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
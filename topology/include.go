@@ -0,0 +1,116 @@
+package topology
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// An includer merges topology fragments into a Builder. Relative paths are
+// resolved against dir, the directory of the including document.
+type includer struct {
+	dir   string
+	stack []string // absolute paths of the including files
+}
+
+// Include adds the devices, links and groups of the fragment described by in
+// to b. The origin map records the fragment each device came from and is used
+// to detect name collisions.
+func (inc *includer) include(b *Builder, origin map[string]string, in structuredInclude) (err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("include %s: %w", in.File, err)
+		}
+	}()
+
+	if in.File == "" {
+		return fmt.Errorf("missing file name")
+	}
+	file := in.File
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(inc.dir, file)
+	}
+	// Fragments are parsed without options, these only apply to the
+	// merged topology.
+	t, err := parseFile(file, inc.stack, nil)
+	if err != nil {
+		return err
+	}
+	// Directory of the fragment relative to the including document, used
+	// for rewriting config attributes.
+	rel, err := filepath.Rel(inc.dir, filepath.Dir(file))
+	if err != nil {
+		rel = filepath.Dir(file)
+	}
+	rel = filepath.ToSlash(rel)
+
+	// The RHS of libvirt_type=network links names a libvirt network, not
+	// a device. Network names are global and left alone.
+	links := t.links()
+	networks := make(map[string]bool)
+	for _, l := range links {
+		if l.Attr("libvirt_type") == "network" {
+			networks[l.To] = true
+		}
+	}
+	prefixed := func(name string) string {
+		if networks[name] {
+			return name
+		}
+		return in.Prefix + name
+	}
+
+	devs := t.devices()
+	sort.Slice(devs, func(i, j int) bool {
+		return devs[i].Name < devs[j].Name
+	})
+	for _, d := range devs {
+		if networks[d.Name] {
+			continue
+		}
+		name := in.Prefix + d.Name
+		if prev, ok := origin[name]; ok {
+			return fmt.Errorf("device %q already defined in %s",
+				name, prev)
+		}
+		origin[name] = in.File
+
+		attrs := make(map[string]string, len(d.attrs))
+		for k, v := range d.attrs {
+			attrs[k] = v
+		}
+		if c := attrs["config"]; c != "" && !path.IsAbs(c) {
+			c = path.Join(rel, c)
+			// Config files are opened through an fs.FS rooted at
+			// the top-level document's directory, which can't
+			// reach above it. Nested includes are checked once
+			// their paths have been rewritten by the outermost
+			// includer.
+			if inc.topLevel() && (c == ".." || strings.HasPrefix(c, "../")) {
+				return fmt.Errorf("device %q: config %q: "+
+					"outside the top-level directory", name, c)
+			}
+			attrs["config"] = c
+		}
+		b.AddDevice(name, attrs)
+	}
+	for _, l := range links {
+		b.AddLink(prefixed(l.From), l.FromPort, prefixed(l.To), l.ToPort, l.attrs)
+	}
+	for _, g := range t.Groups() {
+		members := make([]string, len(g.Devices))
+		for i, d := range g.Devices {
+			members[i] = in.Prefix + d
+		}
+		b.AddGroup(in.Prefix+g.Name, nil, members...)
+	}
+
+	return nil
+}
+
+// TopLevel reports whether inc merges fragments into the outermost document.
+func (inc *includer) topLevel() bool {
+	return len(inc.stack) < 2
+}
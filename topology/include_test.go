@@ -0,0 +1,93 @@
+package topology
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestInclude(t *testing.T) {
+	topo, err := ParseFile("testdata/include/lab.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var links []string
+	for _, l := range topo.Links() {
+		if l.From > l.To {
+			l.From, l.FromPort, l.To, l.ToPort = l.To, l.ToPort, l.From, l.FromPort
+		}
+		links = append(links, l.String())
+	}
+	sort.Strings(links)
+	wantLinks := []string{
+		"default:eth0 -- rack1-leaf:swp3",
+		"default:eth0 -- rack2-leaf:swp3",
+		"rack1-host:eth1 -- rack1-leaf:swp2",
+		"rack1-leaf:swp1 -- spine0:swp1",
+		"rack2-host:eth1 -- rack2-leaf:swp2",
+		"rack2-leaf:swp1 -- spine0:swp2",
+	}
+	if got, want := strings.Join(links, "\n"), strings.Join(wantLinks, "\n"); got != want {
+		t.Errorf("got links\n%s\nwant\n%s", got, want)
+	}
+
+	devs := make(map[string]*Device)
+	ds := topo.Devices()
+	for i := range ds {
+		devs[ds[i].Name] = &ds[i]
+	}
+
+	for name, want := range map[string]string{
+		"spine0":     "spine.sh",
+		"rack1-leaf": "racks/leaf.sh",
+		"rack2-leaf": "racks/leaf.sh",
+		"rack1-host": "/abs/host.sh",
+	} {
+		d, ok := devs[name]
+		if !ok {
+			t.Errorf("device %s missing", name)
+			continue
+		}
+		if got := d.Attr("config"); got != want {
+			t.Errorf("%s: got config=%q, want %q", name, got, want)
+		}
+	}
+	if got := devs["rack2-host"].Attr("rack"); got != "r" {
+		t.Errorf("rack2-host: got rack=%q, want %q", got, "r")
+	}
+
+	groups := topo.Groups()
+	if len(groups) != 2 {
+		t.Fatalf("got %d groups, want 2", len(groups))
+	}
+	if g := groups[1]; g.Name != "rack2-rack" ||
+		strings.Join(g.Devices, " ") != "rack2-host rack2-leaf" {
+		t.Errorf("got group %s %v, want rack2-rack [rack2-host rack2-leaf]",
+			g.Name, g.Devices)
+	}
+}
+
+func TestIncludeErrors(t *testing.T) {
+	for _, test := range []struct {
+		file, want string
+	}{
+		{"testdata/include/cycle.yaml", "include cycle"},
+		{"testdata/include/collision.yaml", `device "host" already defined in racks/rack.dot`},
+		{"testdata/include/missing.yaml", "no such file"},
+		{"testdata/include/sub/escape.yaml", `config "../racks/leaf.sh": outside the top-level directory`},
+	} {
+		_, err := ParseFile(test.file)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got err=%v, want %q", test.file, err, test.want)
+		}
+	}
+
+	doc := "include: [{file: testdata/include/spines.dot}]\n" +
+		"devices: [{name: spine0}]\n"
+	_, err := ParseYAML([]byte(doc))
+	if want := `device "spine0" already defined`; err == nil ||
+		!strings.Contains(err.Error(), want) {
+		t.Errorf("got err=%v, want %q", err, want)
+	}
+}
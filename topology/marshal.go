@@ -0,0 +1,96 @@
+package topology
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// MarshalDOT returns a canonical DOT representation of the effective
+// topology. Unlike DOT, which returns the original input, the result includes
+// the devices and links added by WithAutoMgmtNetwork as well as resolved
+// settings (function, cpu, memory, disk, os, mgmt_ip and mgmt_ip6) for every
+// simulated device. Group membership is expressed using subgraphs, with
+// inherited attributes already applied to the member devices. Devices and
+// links are emitted in sorted order, so equivalent topologies marshal to
+// identical output.
+//
+// Management uplinks without a remote end (eth0 of oob-mgmt-server and
+// oob-mgmt-switch) cannot be expressed in DOT and are omitted. As the result
+// already contains the management network, it should be parsed without
+// WithAutoMgmtNetwork.
+func (t *T) MarshalDOT() ([]byte, error) {
+	g := newDotGraph()
+
+	names := make([]string, 0, len(t.devs))
+	for name := range t.devs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		n := g.addNamedNode(name)
+		n.attrs = t.devs[name].effectiveAttrs()
+	}
+
+	links := t.Links()
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].String() < links[j].String()
+	})
+	for _, l := range links {
+		if l.To == "" {
+			continue
+		}
+		g.addLink(l.From, l.FromPort, l.To, l.ToPort, l.attrs)
+	}
+
+	p, err := marshalDOT(g)
+	if err != nil {
+		return nil, fmt.Errorf("MarshalDOT: %w", err)
+	}
+	return appendDOTGroups(p, t.groups), nil
+}
+
+// EffectiveAttrs returns d's node attributes with defaults resolved.
+func (d *Device) effectiveAttrs() map[string]string {
+	m := make(map[string]string, len(d.attrs)+6)
+	for k, v := range d.attrs {
+		m[k] = v
+	}
+	if d.Function() == Fake {
+		return m
+	}
+	if f := d.Function(); f != NoFunction {
+		m["function"] = f.String()
+	}
+	m["cpu"] = strconv.Itoa(d.VCPUs())
+	m["memory"] = formatSize(d.Memory(), 1<<20)
+	if n := d.DiskSize(); n != 0 {
+		m["disk"] = formatSize(n, 1<<30)
+	} else {
+		delete(m, "disk")
+	}
+	if img := d.OSImage(); img != "" {
+		m["os"] = img
+	} else {
+		m["os"] = "none"
+	}
+	if _, ok := m["mgmt_ip"]; !ok && !d.mgmtIP.IsZero() {
+		m["mgmt_ip"] = d.mgmtIP.String()
+	}
+	if _, ok := m["mgmt_ip6"]; !ok && !d.mgmtIP6.IsZero() {
+		m["mgmt_ip6"] = d.mgmtIP6.String()
+	}
+	return m
+}
+
+// FormatSize is the inverse of ParseSize. It returns n as a bare number of
+// units if possible and falls back to MiB or bytes otherwise.
+func formatSize(n, unit int64) string {
+	switch {
+	case n%unit == 0:
+		return strconv.FormatInt(n/unit, 10)
+	case n%(1<<20) == 0:
+		return strconv.FormatInt(n>>20, 10) + "MiB"
+	}
+	return strconv.FormatInt(n, 10) + "B"
+}
@@ -0,0 +1,66 @@
+package topology
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMarshalDOT(t *testing.T) {
+	const G = `graph G {
+		"leaf0" [function=leaf memory=1024]
+		"spine0" [function=spine os=none]
+		"server0" [function=host disk="512MiB"]
+		"leaf0":swp1 -- "spine0":swp1 [left_mac="44:38:39:00:00:01"]
+		"leaf0":swp2 -- "server0":eth1
+	}`
+
+	topo, err := Parse([]byte(G), WithAutoMgmtNetwork)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := topo.MarshalDOT()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(p)
+	for _, w := range []string{
+		`"oob-mgmt-server"`,
+		`"oob-mgmt-server":eth1 -- "oob-mgmt-switch":swp1`,
+		`memory=1024`,
+		`disk="512MiB"`,
+		`os=none`,
+		`mgmt_ip="192.168.200.254/24"`,
+		`left_mac="44:38:39:00:00:01"`,
+	} {
+		if !strings.Contains(out, w) {
+			t.Errorf("missing %s in:\n%s", w, out)
+		}
+	}
+
+	// The result must parse (without auto mgmt) into an equivalent
+	// topology, which marshals identically.
+	topo2, err := Parse(p)
+	if err != nil {
+		t.Fatalf("reparse: %v\n%s", err, out)
+	}
+	if got, want := len(topo2.Devices()), len(topo.Devices()); got != want {
+		t.Errorf("reparse: got %d devices, want %d", got, want)
+	}
+	// eth0 uplinks of oob-mgmt-server and oob-mgmt-switch are dropped.
+	if got, want := len(topo2.Links()), len(topo.Links())-2; got != want {
+		t.Errorf("reparse: got %d links, want %d", got, want)
+	}
+	p2, err := topo2.MarshalDOT()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, p2) {
+		t.Errorf("output not stable:\n%s\nvs.\n%s", p, p2)
+	}
+	for _, d := range topo2.Devices() {
+		if d.Name == "server0" && d.Attr("mgmt_ip") == "" {
+			t.Errorf("server0: lost management address")
+		}
+	}
+}
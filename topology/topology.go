@@ -3,6 +3,9 @@ package topology
 import (
 	"fmt"
 	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
 
 	"gonum.org/v1/gonum/graph"
 	"gonum.org/v1/gonum/graph/encoding/dot"
@@ -12,12 +15,23 @@ import (
 
 // T represents a parsed network topology graph.
 type T struct {
-	g    *dotGraph
-	devs map[string]*Device
-	dot  []byte
+	g      *dotGraph
+	devs   map[string]*Device
+	dot    []byte
+	groups map[string][]string // group name → sorted device names
 
-	autoMgmt  bool
-	mgmtLinks []Link
+	autoMgmt        bool
+	mgmtSwitchPorts int
+	mgmtGroupAttr   string
+	mgmtLinks       []Link
+	preferredMgmt   map[string][]string
+
+	linkPools     []string
+	loopbackPools []string
+	plan          *AddressPlan
+
+	defaultsSrc []defaultsSource
+	defaults    *[NoFunction + 1]deviceDefaults
 }
 
 // Option may be passed to Parse to customize topology processing.
@@ -27,35 +41,103 @@ type Option func(*T)
 // is augmented with a management switch and server, with the latter running
 // DHCP and DNS services for all devices. Devices are automatically attached to
 // the management switch unless they have the no_mgmt node attribute set.
+//
+// Addresses are assigned from the prefix given by the mgmt_ip attribute of
+// oob-mgmt-server, which may be an IPv4 or IPv6 prefix. For a dual-stack
+// management network, an additional IPv6 prefix is given using mgmt_ip6.
 var WithAutoMgmtNetwork = func(t *T) {
 	t.autoMgmt = true
 }
 
+// WithMgmtSwitchPorts limits the number of devices attached to a single
+// management switch to n. Devices are distributed across as many generated
+// switches (named oob-mgmt-switch-1, oob-mgmt-switch-2, …) as needed, each of
+// them uplinked to oob-mgmt-switch, which becomes the management spine. It
+// only has an effect together with WithAutoMgmtNetwork.
+//
+// The generated switches are unmanaged: they have neither an eth0 nor a
+// management address and just bridge their ports. Thus, they can't be logged
+// into and are left out when checking SSH reachability or cabling.
+func WithMgmtSwitchPorts(n int) Option {
+	return func(t *T) {
+		t.mgmtSwitchPorts = n
+	}
+}
+
+// WithMgmtGroupAttr splits the management network by the value of the node
+// attribute attr (e.g. "rack"). Devices sharing a value are attached to a
+// generated management switch named oob-mgmt-switch-<value>, uplinked to
+// oob-mgmt-switch. Devices lacking the attribute are attached to
+// oob-mgmt-switch directly. Combined with WithMgmtSwitchPorts, groups exceeding
+// the port limit are spread over multiple switches (oob-mgmt-switch-<value>-1,
+// …). Like those of WithMgmtSwitchPorts, the generated switches are
+// unmanaged. It only has an effect together with WithAutoMgmtNetwork.
+func WithMgmtGroupAttr(attr string) Option {
+	return func(t *T) {
+		t.mgmtGroupAttr = attr
+	}
+}
+
+// WithPreferredMgmtIPs makes the automatic management network assign the
+// addresses in ips (keyed by device name) where possible, i.e. if they are
+// within the management prefixes and not claimed by mgmt_ip or mgmt_ip6
+// attributes. It's used to keep the addresses of a running topology stable
+// across edits of the topology file.
+func WithPreferredMgmtIPs(ips map[string][]string) Option {
+	return func(t *T) {
+		t.preferredMgmt = ips
+	}
+}
+
 // Parse unmarshals a DOT graph. It returns the topology described by it or an
-// error, if any.
+// error, if any. The topology is checked using Validate before returning.
 func Parse(dotBytes []byte, opts ...Option) (*T, error) {
 	g := newDotGraph()
 	if err := dot.UnmarshalMulti(dotBytes, g); err != nil {
 		return nil, fmt.Errorf("Parse: %w", err)
 	}
-	t := &T{g: g, devs: make(map[string]*Device)}
+	groups, inherited, err := dotGroups(dotBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Parse: %w", err)
+	}
+	g.inheritAttrs(inherited)
+	return newT(g, dotBytes, groups, opts...)
+}
+
+// NewT constructs a topology from the graph g. The byte slice dotBytes holds
+// g's DOT representation and groups maps group names to their members.
+func newT(g *dotGraph, dotBytes []byte, groups map[string][]string, opts ...Option) (*T, error) {
+	t := &T{g: g, devs: make(map[string]*Device), groups: groups}
 	for _, opt := range opts {
 		opt(t)
 	}
+	defs, err := loadDefaults(t.defaultsSrc)
+	if err != nil {
+		return nil, fmt.Errorf("Parse: %w", err)
+	}
+	t.defaults = defs
 
 	for _, d := range t.devices() {
-		if !isValidHostname(d.Name) && d.Function() != Fake {
-			return nil, fmt.Errorf("invalid hostname: %q", d.Name)
-		}
 		d := d
 		t.devs[d.Name] = &d
 	}
+	for _, name := range sortedGroupNames(groups) {
+		for _, member := range groups[name] {
+			if d := t.devs[member]; d != nil {
+				d.groups = append(d.groups, name)
+			}
+		}
+	}
 	if t.autoMgmt {
 		if err := t.setupAutoMgmtNetwork(); err != nil {
 			return nil, err
 		}
 	}
 
+	for _, d := range t.devs {
+		d.defaults = &t.defaults[d.Function()]
+	}
+
 	// associate links with their endpoints
 	for _, l := range t.Links() {
 		l := l
@@ -75,6 +157,12 @@ func Parse(dotBytes []byte, opts ...Option) (*T, error) {
 		}
 
 	}
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+	if err := t.planAddresses(); err != nil {
+		return nil, err
+	}
 
 	// Stash a copy of the input DOT graph for later use.
 	t.dot = make([]byte, len(dotBytes))
@@ -83,13 +171,44 @@ func Parse(dotBytes []byte, opts ...Option) (*T, error) {
 	return t, nil
 }
 
-// ParseFile is like Parse but reads the DOT graph description from the file
-// located by path.
+// ParseFile is like Parse but reads the topology description from the file
+// located by path. Files with a .yaml or .yml extension are parsed using
+// ParseYAML, those ending in .json using ParseJSON. Anything else is assumed to
+// be in DOT format.
+//
+// Includes in structured topology files are resolved relative to the
+// directory containing path.
 func ParseFile(path string, opts ...Option) (*T, error) {
+	return parseFile(path, nil, opts)
+}
+
+// ParseFile implements ParseFile. The stack holds the absolute paths of the
+// files (transitively) including path and is used to detect include cycles.
+func parseFile(path string, stack []string, opts []Option) (*T, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("ParseFile: %w", err)
+	}
+	for _, s := range stack {
+		if s == abs {
+			return nil, fmt.Errorf("ParseFile: include cycle: %s",
+				strings.Join(append(stack, abs), " -> "))
+		}
+	}
 	p, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("ParseFile: %w", err)
 	}
+	inc := &includer{
+		dir:   filepath.Dir(path),
+		stack: append(stack[:len(stack):len(stack)], abs),
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return parseYAML(p, inc, opts)
+	case ".json":
+		return parseJSON(p, inc, opts)
+	}
 	return Parse(p, opts...)
 }
 
@@ -116,6 +235,12 @@ func (t *T) devices() []Device {
 
 // Links returns the connections between devices, as defined in the topology.
 func (t *T) Links() []Link {
+	return append(t.links(), t.mgmtLinks...)
+}
+
+// Links returns the links defined in the input graph, without those added for
+// the automatic management network.
+func (t *T) links() []Link {
 	var ls []Link
 	for _, e := range graph.EdgesOf(t.g.Edges()) {
 		for _, l := range graph.LinesOf(e.(multi.Edge).Lines) {
@@ -131,10 +256,11 @@ func (t *T) Links() []Link {
 			})
 		}
 	}
-	return append(ls, t.mgmtLinks...)
+	return ls
 }
 
-// DOT returns the original input DOT file.
+// DOT returns the original input DOT file. For topologies not read from DOT,
+// an equivalent DOT graph is returned.
 func (t *T) DOT() []byte {
 	return append([]byte(nil), t.dot...)
 }
@@ -185,57 +311,206 @@ func (t *T) setupAutoMgmtNetwork() error {
 	}
 	a := newIPAllocator(mgmtPrefix)
 	a.reserve(mgmtPrefix.IP) // remove mgmtServer's own address
+
+	// An additional IPv6 prefix makes for a dual-stack management network.
+	var a6 *ipAllocator
+	var mgmtPrefix6 netaddr.IPPrefix
+	if s := mgmtServer.Attr("mgmt_ip6"); s != "" {
+		mgmtPrefix6, err = netaddr.ParseIPPrefix(s)
+		if err != nil {
+			return err
+		}
+		if !mgmtPrefix6.IP.Is6() || !mgmtPrefix.IP.Is4() {
+			return fmt.Errorf("device %s: mgmt_ip6 must be an IPv6 "+
+				"prefix complementing an IPv4 mgmt_ip", mgmtServer.Name)
+		}
+		a6 = newIPAllocator(mgmtPrefix6)
+		a6.reserve(mgmtPrefix6.IP)
+	}
+
 	// reserve addresses configured with explicit node attrs
+	reserve := func(d *Device, attr string, a *ipAllocator) (netaddr.IP, error) {
+		ipStr := d.Attr(attr)
+		if ipStr == "" {
+			return netaddr.IP{}, nil
+		}
+		if a == nil {
+			return netaddr.IP{}, fmt.Errorf("device %s: %s requires "+
+				"%s on oob-mgmt-server", d.Name, attr, attr)
+		}
+		ip, err := netaddr.ParseIP(ipStr)
+		if err != nil {
+			return netaddr.IP{}, fmt.Errorf(
+				"device %s: parse ip: %v (%s: %s)",
+				d.Name, err, attr, ipStr)
+		}
+		if ok := a.reserve(ip); !ok {
+			return netaddr.IP{}, fmt.Errorf(
+				"device %s: unable to reserve ip %s", d.Name, ip)
+		}
+		return ip, nil
+	}
 	for _, d := range t.devs {
 		if HasFunction(d, OOBSwitch, OOBServer, Fake) {
 			continue
 		}
-		ipStr := d.Attr("mgmt_ip")
-		if ipStr == "" || d.Attr("no_mgmt") != "" {
+		if d.Attr("no_mgmt") != "" {
 			continue
 		}
-		ip, err := netaddr.ParseIP(ipStr)
-		if err != nil {
-			return fmt.Errorf("device %s: parse ip: %v (mgmt_ip: %s)",
-				d.Name, err, ipStr)
+		if d.mgmtIP, err = reserve(d, "mgmt_ip", a); err != nil {
+			return err
 		}
-		if ok := a.reserve(ip); !ok {
-			return fmt.Errorf("device %s: unable to reserve ip %s",
-				d.Name, ip)
+		if d.mgmtIP6, err = reserve(d, "mgmt_ip6", a6); err != nil {
+			return err
 		}
-		d.mgmtIP = ip
 	}
 
-	// Wire up devices to the OOB switch.
-	ifIndex := 2
-	for _, d := range t.devs {
+	// Go in order of device names so that address and port assignments
+	// are stable across runs.
+	names := make([]string, 0, len(t.devs))
+	for name := range t.devs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		d := t.devs[name]
+		if d.Attr("no_mgmt") != "" || HasFunction(d, OOBSwitch, OOBServer, Fake) {
+			continue
+		}
+		for _, s := range t.preferredMgmt[name] {
+			ip, err := netaddr.ParseIP(s)
+			if err != nil {
+				continue
+			}
+			if d.mgmtIP.IsZero() && a.reserve(ip) {
+				d.mgmtIP = ip
+			} else if a6 != nil && d.mgmtIP6.IsZero() && a6.reserve(ip) {
+				d.mgmtIP6 = ip
+			}
+		}
+	}
+	var mgmtDevs []*Device
+	for _, name := range names {
+		d := t.devs[name]
 		if d.Attr("no_mgmt") != "" {
 			continue
 		}
 		if HasFunction(d, OOBSwitch, OOBServer, Fake) {
 			continue
 		}
-		l := Link{
-			From:     mgmtSwitch.Name,
-			FromPort: fmt.Sprintf("swp%d", ifIndex),
-			To:       d.Name,
-			ToPort:   "eth0",
+		mgmtDevs = append(mgmtDevs, d)
+
+		// Devices with explicit mgmt_ip/mgmt_ip6 attrs got their
+		// addresses reserved above.
+		if d.mgmtIP.IsZero() {
+			ip, ok := a.allocate()
+			if !ok {
+				return fmt.Errorf(
+					"device %s: mgmt ip range exhausted (prefix: %s)",
+					d.Name, mgmtPrefix)
+			}
+			d.mgmtIP = ip
 		}
-		t.mgmtLinks = append(t.mgmtLinks, l)
-		ifIndex++
+		if a6 != nil && d.mgmtIP6.IsZero() {
+			ip, ok := a6.allocate()
+			if !ok {
+				return fmt.Errorf(
+					"device %s: mgmt ip range exhausted (prefix: %s)",
+					d.Name, mgmtPrefix6)
+			}
+			d.mgmtIP6 = ip
+		}
+	}
 
-		if !d.mgmtIP.IsZero() {
-			// has explicit mgmt_ip attr, address reserved above
+	return t.wireMgmtSwitches(mgmtSwitch, mgmtDevs)
+}
+
+// WireMgmtSwitches connects devs to the management network. Unless split up
+// using WithMgmtSwitchPorts or WithMgmtGroupAttr, all devices are attached to
+// spine directly. Otherwise, additional switches are generated and uplinked
+// to spine.
+func (t *T) wireMgmtSwitches(spine *Device, devs []*Device) error {
+	var direct []*Device
+	groups := make(map[string][]*Device)
+	var keys []string
+	for _, d := range devs {
+		g := ""
+		if t.mgmtGroupAttr != "" {
+			g = d.Attr(t.mgmtGroupAttr)
+			if g == "" && t.mgmtSwitchPorts == 0 {
+				direct = append(direct, d)
+				continue
+			}
+		} else if t.mgmtSwitchPorts == 0 {
+			direct = append(direct, d)
 			continue
 		}
-		ip, ok := a.allocate()
-		if !ok {
-			return fmt.Errorf(
-				"device %s: mgmt ip range exhausted (prefix: %s)",
-				d.Name, mgmtPrefix)
+		if _, ok := groups[g]; !ok {
+			keys = append(keys, g)
 		}
-		d.mgmtIP = ip
+		groups[g] = append(groups[g], d)
 	}
+	sort.Strings(keys)
+
+	spinePort := 2 // swp1 connects to oob-mgmt-server
+	for _, g := range keys {
+		members := groups[g]
+		chunks := [][]*Device{members}
+		if n := t.mgmtSwitchPorts; n > 0 {
+			chunks = nil
+			for len(members) > n {
+				chunks = append(chunks, members[:n])
+				members = members[n:]
+			}
+			chunks = append(chunks, members)
+		}
+		for i, chunk := range chunks {
+			name := spine.Name
+			if g != "" {
+				name += "-" + g
+			}
+			if t.mgmtSwitchPorts > 0 {
+				name += fmt.Sprintf("-%d", i+1)
+			}
+			if !isValidHostname(name) {
+				return fmt.Errorf("management switch for %s=%q: "+
+					"invalid hostname %s", t.mgmtGroupAttr, g, name)
+			}
+			if t.devs[name] != nil {
+				return fmt.Errorf("management switch %s: "+
+					"conflicts with existing device", name)
+			}
+			sw := &Device{
+				Name: name,
+				attrs: map[string]string{
+					"function": OOBSwitch.String(),
+				},
+			}
+			t.devs[name] = sw
+			t.mgmtLinks = append(t.mgmtLinks, Link{
+				From:     spine.Name,
+				FromPort: fmt.Sprintf("swp%d", spinePort),
+				To:       name,
+				ToPort:   "swp1",
+			})
+			spinePort++
+			t.attachMgmtDevices(sw, 2, chunk)
+		}
+	}
+	t.attachMgmtDevices(spine, spinePort, direct)
 
 	return nil
 }
+
+// AttachMgmtDevices connects the eth0 interfaces of devs to consecutive ports
+// of sw, starting at swp<first>.
+func (t *T) attachMgmtDevices(sw *Device, first int, devs []*Device) {
+	for i, d := range devs {
+		t.mgmtLinks = append(t.mgmtLinks, Link{
+			From:     sw.Name,
+			FromPort: fmt.Sprintf("swp%d", first+i),
+			To:       d.Name,
+			ToPort:   "eth0",
+		})
+	}
+}
@@ -41,6 +41,193 @@ func TestAutoMgmtNetwork(t *testing.T) {
 	}
 }
 
+func TestAutoMgmtNetworkIPv6(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		server string
+		leaf   string
+		want   []string
+	}{
+		{
+			name:   "ipv6-only",
+			server: `mgmt_ip="fd00:200::fe/64"`,
+			leaf:   `mgmt_ip="fd00:200::10"`,
+			want:   []string{"fd00:200::10"},
+		},
+		{
+			name:   "dual-stack",
+			server: `mgmt_ip="192.168.200.254/24" mgmt_ip6="fd00:200::fe/64"`,
+			leaf:   `mgmt_ip6="fd00:200::10"`,
+			want:   []string{"192.168.200.1", "fd00:200::10"},
+		},
+	} {
+		G := `graph G {
+			"oob-mgmt-server" [function="oob-server" ` + test.server + `]
+			"leaf0" [function=leaf ` + test.leaf + `]
+			"spine0" [function=spine]
+			"leaf0":swp1 -- "spine0":swp1
+		}`
+		topo, err := Parse([]byte(G), WithAutoMgmtNetwork)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		for _, d := range topo.Devices() {
+			ips := d.MgmtIPs()
+			if d.Name == "spine0" && len(ips) != len(test.want) {
+				t.Errorf("%s: spine0: got addresses %v, want %d",
+					test.name, ips, len(test.want))
+			}
+			if d.Name != "leaf0" {
+				continue
+			}
+			var got []string
+			for _, ip := range ips {
+				got = append(got, ip.String())
+			}
+			if strings.Join(got, " ") != strings.Join(test.want, " ") {
+				t.Errorf("%s: leaf0: got addresses %v, want %v",
+					test.name, got, test.want)
+			}
+		}
+	}
+
+	// mgmt_ip6 needs an IPv4 primary prefix
+	const G = `graph G {
+		"oob-mgmt-server" [function="oob-server" mgmt_ip="fd00:1::1/64" mgmt_ip6="fd00:2::1/64"]
+		"a" [function=host]
+		"b" [function=host]
+		"a":eth1 -- "b":eth1
+	}`
+	if _, err := Parse([]byte(G), WithAutoMgmtNetwork); err == nil {
+		t.Errorf("mgmt_ip6 with IPv6 mgmt_ip: got nil error")
+	}
+}
+
+func TestPreferredMgmtIPs(t *testing.T) {
+	const G = `graph G {
+		"leaf0" [function=leaf]
+		"leaf1" [function=leaf mgmt_ip="192.168.200.7"]
+		"spine0" [function=spine]
+		"leaf0":swp1 -- "spine0":swp1
+		"leaf1":swp1 -- "spine0":swp2
+	}`
+	topo, err := Parse([]byte(G), WithAutoMgmtNetwork,
+		WithPreferredMgmtIPs(map[string][]string{
+			"spine0": {"192.168.200.9"},
+			"leaf0":  {"192.168.200.7"}, // taken by leaf1
+			"leaf1":  {"192.168.200.8"}, // overridden by mgmt_ip
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"leaf0":  "192.168.200.1",
+		"leaf1":  "192.168.200.7",
+		"spine0": "192.168.200.9",
+	}
+	for _, d := range topo.Devices() {
+		if ip := d.MgmtIP(); want[d.Name] != "" && ip.String() != want[d.Name] {
+			t.Errorf("%s: got mgmt IP %v, want %s", d.Name, ip, want[d.Name])
+		}
+	}
+}
+
+func TestMgmtSwitches(t *testing.T) {
+	const G = `graph G {
+		"a0" [function=host rack=a]
+		"a1" [function=host rack=a]
+		"a2" [function=host rack=a]
+		"b0" [function=host rack=b]
+		"c0" [function=host]
+		"a0":eth1 -- "b0":eth1
+		"a1":eth1 -- "c0":eth1
+	}`
+
+	for _, test := range []struct {
+		name string
+		opts []Option
+		want []string
+	}{{
+		name: "single",
+		want: []string{
+			"oob-mgmt-switch:swp2 -- a0:eth0",
+			"oob-mgmt-switch:swp6 -- c0:eth0",
+		},
+	}, {
+		name: "ports",
+		opts: []Option{WithMgmtSwitchPorts(2)},
+		want: []string{
+			"oob-mgmt-switch:swp2 -- oob-mgmt-switch-1:swp1",
+			"oob-mgmt-switch:swp4 -- oob-mgmt-switch-3:swp1",
+			"oob-mgmt-switch-1:swp2 -- a0:eth0",
+			"oob-mgmt-switch-1:swp3 -- a1:eth0",
+			"oob-mgmt-switch-2:swp3 -- b0:eth0",
+			"oob-mgmt-switch-3:swp2 -- c0:eth0",
+		},
+	}, {
+		name: "rack",
+		opts: []Option{WithMgmtGroupAttr("rack")},
+		want: []string{
+			"oob-mgmt-switch:swp2 -- oob-mgmt-switch-a:swp1",
+			"oob-mgmt-switch:swp3 -- oob-mgmt-switch-b:swp1",
+			"oob-mgmt-switch:swp4 -- c0:eth0",
+			"oob-mgmt-switch-a:swp4 -- a2:eth0",
+			"oob-mgmt-switch-b:swp2 -- b0:eth0",
+		},
+	}, {
+		name: "rack+ports",
+		opts: []Option{WithMgmtGroupAttr("rack"), WithMgmtSwitchPorts(2)},
+		want: []string{
+			"oob-mgmt-switch:swp2 -- oob-mgmt-switch-1:swp1",
+			"oob-mgmt-switch:swp3 -- oob-mgmt-switch-a-1:swp1",
+			"oob-mgmt-switch:swp4 -- oob-mgmt-switch-a-2:swp1",
+			"oob-mgmt-switch-1:swp2 -- c0:eth0",
+			"oob-mgmt-switch-a-2:swp2 -- a2:eth0",
+		},
+	}} {
+		for i := 0; i < 3; i++ {
+			opts := append([]Option{WithAutoMgmtNetwork}, test.opts...)
+			topo, err := Parse([]byte(G), opts...)
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			links := make(map[string]bool)
+			for _, l := range topo.Links() {
+				links[l.String()] = true
+				// Generated switches are unmanaged.
+				if strings.HasPrefix(l.To, "oob-mgmt-switch-") &&
+					l.ToPort == "eth0" {
+					t.Errorf("%s: got link %s", test.name, l)
+				}
+			}
+			for _, w := range test.want {
+				if !links[w] {
+					t.Errorf("%s: missing link %s", test.name, w)
+				}
+			}
+			for _, d := range topo.Devices() {
+				if strings.HasPrefix(d.Name, "oob-mgmt-switch-") &&
+					d.MgmtIP() != nil {
+					t.Errorf("%s: %s has management address %v",
+						test.name, d.Name, d.MgmtIP())
+				}
+			}
+		}
+	}
+
+	// Group attributes must produce valid switch names.
+	const bad = `graph G {
+		"a" [function=host rack="rack_1"]
+		"b" [function=host]
+		"a":eth1 -- "b":eth1
+	}`
+	if _, err := Parse([]byte(bad), WithAutoMgmtNetwork,
+		WithMgmtGroupAttr("rack")); err == nil {
+		t.Errorf("rack=rack_1: got nil error")
+	}
+}
+
 const invalidHostnamesDOT = `graph G {
 	"t" [function=tor]
 	"h_with_underscore" [function=host]
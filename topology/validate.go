@@ -0,0 +1,145 @@
+package topology
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// A ValidationError describes a single problem found in a topology. It
+// carries a reference to the DOT node or edge the problem originates from.
+type ValidationError struct {
+	Node string // device name, if the problem is with a node
+	Edge string // edge in DOT notation, if the problem is with an edge
+	Msg  string
+}
+
+func (e *ValidationError) Error() string {
+	switch {
+	case e.Edge != "":
+		return fmt.Sprintf("edge %s: %s", e.Edge, e.Msg)
+	case e.Node != "":
+		return fmt.Sprintf("node %q: %s", e.Node, e.Msg)
+	}
+	return e.Msg
+}
+
+// ValidationErrors is the error returned by Validate. It lists every problem
+// found in a topology instead of stopping at the first one.
+type ValidationErrors []*ValidationError
+
+func (es ValidationErrors) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "topology has %d problem(s):", len(es))
+	for _, e := range es {
+		b.WriteString("\n\t")
+		b.WriteString(e.Error())
+	}
+	return b.String()
+}
+
+// Validate checks t for problems that would otherwise only surface when
+// starting the topology, like unknown or malformed attributes, ports used more
+// than once on the same device or conflicting MAC addresses. If any problems
+// are found, the returned error is of type ValidationErrors and describes all
+// of them.
+func (t *T) Validate() error {
+	var errs ValidationErrors
+	nodeErr := func(name, format string, args ...interface{}) {
+		errs = append(errs, &ValidationError{
+			Node: name,
+			Msg:  fmt.Sprintf(format, args...),
+		})
+	}
+	edgeErr := func(l *Link, format string, args ...interface{}) {
+		errs = append(errs, &ValidationError{
+			Edge: dotEdgeString(l),
+			Msg:  fmt.Sprintf(format, args...),
+		})
+	}
+
+	nodeSpecs := nodeAttrSpecs
+	if a := t.mgmtGroupAttr; a != "" && lookupAttrSpec(nodeSpecs, a) == nil {
+		// Custom attribute used for grouping the management network.
+		nodeSpecs = append(nodeSpecs[:len(nodeSpecs):len(nodeSpecs)],
+			attrSpec{name: a, typ: attrString})
+	}
+	devs := t.Devices()
+	sort.Slice(devs, func(i, j int) bool {
+		return devs[i].Name < devs[j].Name
+	})
+	for _, d := range devs {
+		if !isValidHostname(d.Name) && d.Function() != Fake {
+			nodeErr(d.Name, "invalid hostname")
+		}
+		for _, msg := range checkAttrs(nodeSpecs, d.attrs) {
+			nodeErr(d.Name, "%s", msg)
+		}
+	}
+
+	links := t.Links()
+	sort.SliceStable(links, func(i, j int) bool {
+		return links[i].String() < links[j].String()
+	})
+	type endpoint struct{ dev, port string }
+	ports := make(map[endpoint]*Link)
+	macs := make(map[string]endpoint)
+	checkEndpoint := func(l *Link, dev, port, macAttr string) {
+		if port == "" {
+			edgeErr(l, "missing port on %s", dev)
+		} else if prev := ports[endpoint{dev, port}]; prev != nil {
+			edgeErr(l, "port %s:%s already used by edge %s",
+				dev, port, dotEdgeString(prev))
+		} else {
+			ports[endpoint{dev, port}] = l
+		}
+
+		s := l.Attr(macAttr)
+		if s == "" {
+			return
+		}
+		mac, err := net.ParseMAC(s)
+		if err != nil {
+			// reported by checkAttrs
+			return
+		}
+		key := mac.String()
+		if prev, ok := macs[key]; ok {
+			edgeErr(l, "%s %s already assigned to %s:%s",
+				macAttr, key, prev.dev, prev.port)
+			return
+		}
+		macs[key] = endpoint{dev, port}
+	}
+	for i := range links {
+		l := &links[i]
+		for _, msg := range checkAttrs(edgeAttrSpecs, l.attrs) {
+			edgeErr(l, "%s", msg)
+		}
+		if l.From == l.To {
+			edgeErr(l, "self-loop on %s", l.From)
+		}
+		checkEndpoint(l, l.From, l.FromPort, "left_mac")
+		if l.To == "" || l.Attr("libvirt_type") == "network" {
+			// Dangling management uplink or the RHS refers to a
+			// libvirt network, not a device.
+			continue
+		}
+		checkEndpoint(l, l.To, l.ToPort, "right_mac")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// DotEdgeString formats l the way it'd appear in a DOT file.
+func dotEdgeString(l *Link) string {
+	s := fmt.Sprintf("%q:%s", l.From, l.FromPort)
+	if l.To != "" {
+		s += fmt.Sprintf(" -- %q:%s", l.To, l.ToPort)
+	}
+	return s
+}
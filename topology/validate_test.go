@@ -0,0 +1,59 @@
+package topology
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+const invalidLinksDOT = `graph G {
+	"a" [function=leaf]
+	"b" [function=spine]
+	"c_d" [function=host]
+	"a":swp1 -- "b":swp1
+	"a":swp1 -- "b":swp2
+	"a" -- "b":swp3
+	"b":swp4 -- "b":swp5
+	"a":swp2 -- "c_d":eth1 [left_mac="44:38:39:00:00:01"]
+	"a":swp3 -- "b":swp6 [left_mac="44:38:39:00:00:01" right_mac="nope"]
+}
+`
+
+func TestValidate(t *testing.T) {
+	_, err := Parse([]byte(invalidLinksDOT))
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("got err=%v, want ValidationErrors", err)
+	}
+
+	want := []string{
+		`node "c_d": invalid hostname`,
+		`edge "a":swp1 -- "b":swp2: port a:swp1 already used`,
+		`edge "a": -- "b":swp3: missing port on a`,
+		`edge "b":swp4 -- "b":swp5: self-loop on b`,
+		`left_mac 44:38:39:00:00:01 already assigned`,
+		`attribute right_mac: want EUI-48 MAC address, got "nope"`,
+	}
+	if len(errs) != len(want) {
+		t.Errorf("got %d problems, want %d:\n%v", len(errs), len(want), err)
+	}
+	msg := err.Error()
+	for _, w := range want {
+		if !strings.Contains(msg, w) {
+			t.Errorf("missing problem %q in:\n%s", w, msg)
+		}
+	}
+}
+
+func TestValidateAutoMgmtPortConflict(t *testing.T) {
+	const G = `graph G {
+		"leaf0" [function=leaf]
+		"leaf0":eth0 -- "spine0":swp1
+		"spine0" [function=spine no_mgmt=1]
+	}`
+
+	_, err := Parse([]byte(G), WithAutoMgmtNetwork)
+	if err == nil || !strings.Contains(err.Error(), "port leaf0:eth0 already used") {
+		t.Errorf("got err=%v, want port conflict on leaf0:eth0", err)
+	}
+}
@@ -0,0 +1,283 @@
+package topology
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// A structuredTopology is the document format understood by ParseYAML and
+// ParseJSON. It carries the same information as a DOT graph:
+//
+//	settings:
+//	  auto_mgmt: true
+//	  mgmt_group: rack
+//	  link_pools: [10.1.0.0/16, "fd00:1::/64"]
+//	  loopback_pools: [10.0.0.0/24]
+//	defaults:
+//	  leaf:
+//	    vcpus: 2
+//	devices:
+//	- name: leaf0
+//	  attributes: {function: leaf}
+//	- name: spine0
+//	  attributes: {function: spine}
+//	links:
+//	- from: leaf0:swp1
+//	  to: {device: spine0, port: swp1}
+//	  attributes: {left_mac: "44:38:39:00:00:01"}
+//	groups:
+//	- name: pod1
+//	  attributes: {os: "https://example.org/cumulus.qcow2"}
+//	  devices: [leaf0, spine0]
+//
+// Link endpoints are given either as "device:port" strings or as objects
+// with device and port keys. The optional defaults section has the same
+// format as documents passed to WithDefaults.
+//
+// The include section merges other topology files (fragments) into the
+// document, optionally prefixing the names of their devices and groups:
+//
+//	include:
+//	- file: oob.dot
+//	- file: racks/rack.dot
+//	  prefix: rack1-
+//
+// Fragments may be in any format understood by ParseFile, including further
+// structured documents with includes. Relative paths are resolved against the
+// including file's directory. Only the devices, links and groups of a fragment
+// are merged, its settings and defaults sections are ignored. Relative config
+// attributes are rewritten to remain relative to the fragment's directory.
+type structuredTopology struct {
+	Settings structuredSettings        `yaml:"settings" json:"settings"`
+	Defaults map[string]deviceDefaults `yaml:"defaults" json:"defaults"`
+	Devices  []structuredDevice        `yaml:"devices" json:"devices"`
+	Links    []structuredLink          `yaml:"links" json:"links"`
+	Groups   []structuredGroup         `yaml:"groups" json:"groups"`
+	Include  []structuredInclude       `yaml:"include" json:"include"`
+}
+
+type structuredInclude struct {
+	File   string `yaml:"file" json:"file"`
+	Prefix string `yaml:"prefix" json:"prefix"`
+}
+
+type structuredSettings struct {
+	AutoMgmt        bool   `yaml:"auto_mgmt" json:"auto_mgmt"`
+	MgmtSwitchPorts int    `yaml:"mgmt_switch_ports" json:"mgmt_switch_ports"`
+	MgmtGroup       string `yaml:"mgmt_group" json:"mgmt_group"`
+
+	LinkPools     []string `yaml:"link_pools" json:"link_pools"`
+	LoopbackPools []string `yaml:"loopback_pools" json:"loopback_pools"`
+}
+
+type structuredDevice struct {
+	Name       string  `yaml:"name" json:"name"`
+	Attributes attrMap `yaml:"attributes" json:"attributes"`
+}
+
+type structuredGroup struct {
+	Name       string   `yaml:"name" json:"name"`
+	Attributes attrMap  `yaml:"attributes" json:"attributes"`
+	Devices    []string `yaml:"devices" json:"devices"`
+}
+
+type structuredLink struct {
+	From       endpoint `yaml:"from" json:"from"`
+	To         endpoint `yaml:"to" json:"to"`
+	Attributes attrMap  `yaml:"attributes" json:"attributes"`
+}
+
+type endpoint struct {
+	Device string `yaml:"device" json:"device"`
+	Port   string `yaml:"port" json:"port"`
+}
+
+// ParseYAML unmarshals a structured topology document in YAML format. It
+// returns the topology described by it or an error, if any. See ParseJSON for
+// the JSON variant.
+//
+// Included files are resolved relative to the current working directory, use
+// ParseFile to have them resolved relative to the document's location.
+func ParseYAML(p []byte, opts ...Option) (*T, error) {
+	return parseYAML(p, &includer{dir: "."}, opts)
+}
+
+func parseYAML(p []byte, inc *includer, opts []Option) (*T, error) {
+	var doc structuredTopology
+	if err := yaml.UnmarshalStrict(p, &doc); err != nil {
+		return nil, fmt.Errorf("ParseYAML: %w", err)
+	}
+	t, err := doc.topology(inc, opts)
+	if err != nil {
+		return nil, fmt.Errorf("ParseYAML: %w", err)
+	}
+	return t, nil
+}
+
+// ParseJSON is like ParseYAML but expects a JSON document.
+func ParseJSON(p []byte, opts ...Option) (*T, error) {
+	return parseJSON(p, &includer{dir: "."}, opts)
+}
+
+func parseJSON(p []byte, inc *includer, opts []Option) (*T, error) {
+	var doc structuredTopology
+	dec := json.NewDecoder(bytes.NewReader(p))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("ParseJSON: %w", err)
+	}
+	t, err := doc.topology(inc, opts)
+	if err != nil {
+		return nil, fmt.Errorf("ParseJSON: %w", err)
+	}
+	return t, nil
+}
+
+func (doc *structuredTopology) topology(inc *includer, opts []Option) (*T, error) {
+	b := NewBuilder()
+	origin := make(map[string]string) // device name → including file
+	for _, in := range doc.Include {
+		if err := inc.include(b, origin, in); err != nil {
+			return nil, err
+		}
+	}
+	for _, d := range doc.Devices {
+		if d.Name == "" {
+			return nil, fmt.Errorf("device without name")
+		}
+		if file, ok := origin[d.Name]; ok {
+			return nil, fmt.Errorf("device %q already defined in %s",
+				d.Name, file)
+		}
+		if b.HasDevice(d.Name) {
+			return nil, fmt.Errorf("duplicate device %q", d.Name)
+		}
+		b.AddDevice(d.Name, d.Attributes)
+	}
+	for _, l := range doc.Links {
+		if !b.HasDevice(l.From.Device) {
+			return nil, fmt.Errorf("link %s -- %s: unknown device %q",
+				l.From, l.To, l.From.Device)
+		}
+		// As with DOT, the RHS of a libvirt_type=network edge names
+		// a libvirt network and is not declared as a device.
+		if !b.HasDevice(l.To.Device) && l.Attributes["libvirt_type"] != "network" {
+			return nil, fmt.Errorf("link %s -- %s: unknown device %q",
+				l.From, l.To, l.To.Device)
+		}
+		b.AddLink(l.From.Device, l.From.Port,
+			l.To.Device, l.To.Port, l.Attributes)
+	}
+
+	for _, g := range doc.Groups {
+		if g.Name == "" {
+			return nil, fmt.Errorf("group without name")
+		}
+		for _, d := range g.Devices {
+			if !b.HasDevice(d) {
+				return nil, fmt.Errorf("group %s: unknown device %q",
+					g.Name, d)
+			}
+		}
+		b.AddGroup(g.Name, g.Attributes, g.Devices...)
+	}
+
+	var docOpts []Option
+	if doc.Settings.AutoMgmt {
+		docOpts = append(docOpts, WithAutoMgmtNetwork)
+	}
+	if n := doc.Settings.MgmtSwitchPorts; n < 0 {
+		return nil, fmt.Errorf("settings: mgmt_switch_ports: "+
+			"want non-negative number, got %d", n)
+	} else if n != 0 {
+		docOpts = append(docOpts, WithMgmtSwitchPorts(n))
+	}
+	if a := doc.Settings.MgmtGroup; a != "" {
+		docOpts = append(docOpts, WithMgmtGroupAttr(a))
+	}
+	for _, p := range doc.Settings.LinkPools {
+		docOpts = append(docOpts, WithLinkAddressPool(p))
+	}
+	for _, p := range doc.Settings.LoopbackPools {
+		docOpts = append(docOpts, WithLoopbackPool(p))
+	}
+	if doc.Defaults != nil {
+		docOpts = append(docOpts, func(t *T) {
+			t.defaultsSrc = append(t.defaultsSrc, defaultsSource{
+				name: "defaults section",
+				doc:  doc.Defaults,
+			})
+		})
+	}
+	// Options from the document come first so that the caller may
+	// override them.
+	return b.Build(append(docOpts, opts...)...)
+}
+
+func (e endpoint) String() string {
+	return e.Device + ":" + e.Port
+}
+
+func (e *endpoint) fromString(s string) error {
+	i := strings.LastIndexByte(s, ':')
+	if i < 0 {
+		return fmt.Errorf("endpoint %q: want device:port", s)
+	}
+	e.Device, e.Port = s[:i], s[i+1:]
+	return nil
+}
+
+func (e *endpoint) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err == nil {
+		return e.fromString(s)
+	}
+	type plain endpoint
+	return unmarshal((*plain)(e))
+}
+
+func (e *endpoint) UnmarshalJSON(p []byte) error {
+	var s string
+	if err := json.Unmarshal(p, &s); err == nil {
+		return e.fromString(s)
+	}
+	type plain endpoint
+	dec := json.NewDecoder(bytes.NewReader(p))
+	dec.DisallowUnknownFields()
+	return dec.Decode((*plain)(e))
+}
+
+// An attrMap holds node or edge attributes. Scalar values of any type are
+// accepted and converted to their string representation, so that e.g. cpu: 2
+// and cpu: "2" are equivalent.
+type attrMap map[string]string
+
+func (m *attrMap) UnmarshalJSON(p []byte) error {
+	var raw map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(p))
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return err
+	}
+	*m = make(attrMap, len(raw))
+	for k, v := range raw {
+		switch v := v.(type) {
+		case string:
+			(*m)[k] = v
+		case json.Number:
+			(*m)[k] = v.String()
+		case bool:
+			(*m)[k] = strconv.FormatBool(v)
+		case nil:
+			(*m)[k] = ""
+		default:
+			return fmt.Errorf("attribute %s: want scalar value", k)
+		}
+	}
+	return nil
+}
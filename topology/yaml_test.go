@@ -0,0 +1,80 @@
+package topology
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestParseStructured(t *testing.T) {
+	want, err := ParseFile("testdata/leafspine.dot", WithAutoMgmtNetwork)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{
+		"testdata/leafspine.yaml",
+		"testdata/leafspine.json",
+	} {
+		opts := []Option{WithAutoMgmtNetwork}
+		if strings.HasSuffix(file, ".json") {
+			// enabled through the settings section
+			opts = nil
+		}
+		topo, err := ParseFile(file, opts...)
+		if err != nil {
+			t.Errorf("%s: %v", file, err)
+			continue
+		}
+		if got, want := len(topo.Links()), len(want.Links()); got != want {
+			t.Errorf("%s: got %d links, want %d", file, got, want)
+		}
+		if got, want := linkStrings(topo), linkStrings(want); got != want {
+			t.Errorf("%s: got links\n%s\nwant\n%s", file, got, want)
+		}
+		if got, want := len(topo.Devices()), len(want.Devices()); got != want {
+			t.Errorf("%s: got %d devices, want %d", file, got, want)
+		}
+		for _, d := range topo.Devices() {
+			if d.Name == "leaf0" && strings.HasSuffix(file, ".json") {
+				if n := d.VCPUs(); n != 2 {
+					t.Errorf("%s: got %d vcpus for leaf0, want 2",
+						file, n)
+				}
+			}
+		}
+		if _, err := Parse(topo.DOT()); err != nil {
+			t.Errorf("%s: cannot parse generated DOT: %v", file, err)
+		}
+	}
+}
+
+func TestParseStructuredErrors(t *testing.T) {
+	for _, test := range []struct {
+		doc, want string
+	}{
+		{"devices: [{name: a}]\nlinks: [{from: 'a:eth0', to: 'b:eth0'}]\n", `unknown device "b"`},
+		{"devices: [{name: a}, {name: a}]\n", `duplicate device "a"`},
+		{"devices: [{name: a, attrs: {}}]\n", "not found in type"},
+		{"links: [{from: a, to: b}]\n", "want device:port"},
+		{"devices: [{name: a, attributes: {cpu: many}}]\n", "attribute cpu"},
+		{"settings: {mgmt_switch_ports: -1}\n", "mgmt_switch_ports: want non-negative"},
+	} {
+		_, err := ParseYAML([]byte(test.doc))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%q: got err=%v, want %q", test.doc, err, test.want)
+		}
+	}
+}
+
+// LinkStrings returns the sorted non-management links of t, one per line.
+func linkStrings(t *T) string {
+	var ss []string
+	for _, l := range t.Links() {
+		if l.From == "oob-mgmt-switch" || l.From == "oob-mgmt-server" {
+			continue
+		}
+		ss = append(ss, l.String())
+	}
+	sort.Strings(ss)
+	return strings.Join(ss, "\n")
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"slrz.net/runtopo/runner/libvirt"
+	"slrz.net/runtopo/topology"
+)
+
+// VerifyMain implements the verify command. It compares the LLDP neighbors
+// seen by the devices of a running topology to its links, printing a line per
+// link end that doesn't match. The exit status is 1 if there were any
+// mismatches.
+func verifyMain(args []string) {
+	if len(args) != 1 {
+		log.Fatalf("usage: runtopo [options…] verify topology.dot")
+	}
+
+	topo, err := topology.ParseFile(args[0], topologyOptions(args[0])...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	auth, err := sshAuthMethods()
+	if err != nil {
+		log.Fatal(err)
+	}
+	runnerOpts := []libvirt.RunnerOption{
+		libvirt.WithNamePrefix(*namePrefix),
+		libvirt.WithSSHAuth(auth...),
+	}
+	if s := *libvirtURI; s != "" {
+		runnerOpts = append(runnerOpts, libvirt.WithConnectionURI(s))
+	}
+	if s := *stateDir; s != "" {
+		runnerOpts = append(runnerOpts, libvirt.WithStateDir(s))
+	}
+	runnerOpts = append(runnerOpts, hostsOptions()...)
+	r := libvirt.NewRunner(runnerOpts...)
+
+	ctx, cancel := signal.NotifyContext(context.Background(),
+		os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	checks, err := r.Verify(ctx, topo)
+	if err != nil {
+		log.Fatal(err)
+	}
+	failed := 0
+	for _, c := range checks {
+		if c.Status == libvirt.LinkOK {
+			continue
+		}
+		fmt.Println(c.String())
+		failed++
+	}
+	if failed > 0 {
+		log.Printf("%d of %d link ends failed verification", failed, len(checks))
+		os.Exit(1)
+	}
+}
+
+// SSHAuthMethods returns the methods for authenticating to the devices of a
+// running topology: the keys held by ssh-agent, if running, followed by the
+// unencrypted private keys matching those installed by loadSSHPublicKeys.
+func sshAuthMethods() ([]ssh.AuthMethod, error) {
+	var methods []ssh.AuthMethod
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			return nil, err
+		}
+		methods = append(methods,
+			ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+	}
+
+	pubKeyFiles, err := sshPublicKeyFiles()
+	if err != nil {
+		return nil, err
+	}
+	var signers []ssh.Signer
+	for _, file := range pubKeyFiles {
+		p, err := ioutil.ReadFile(strings.TrimSuffix(file, ".pub"))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		s, err := ssh.ParsePrivateKey(p)
+		if err != nil {
+			// Most likely passphrase-protected, leave that to
+			// the agent.
+			continue
+		}
+		signers = append(signers, s)
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+	if len(methods) == 0 {
+		return nil, fmt.Errorf("no SSH keys available (tried ssh-agent and %s)",
+			filepath.Join("~", ".ssh", "id_*"))
+	}
+	return methods, nil
+}